@@ -1,19 +1,41 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	_ "embed"
+	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"html/template"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
 	"log"
+	"math"
 	mrand "math/rand"
+	"net"
 	"net/http"
 	"os"
+	"path"
+	"path/filepath"
+	"runtime/debug"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 // --- Embedded templates & CSS ---
@@ -37,31 +59,159 @@ const (
 	cellEmpty = byte(0)
 	cellR     = byte('R')
 	cellY     = byte('Y')
-	cellBlk   = byte('X') // immobile block
+	cellG     = byte('G') // third player (local games only)
+	cellB     = byte('B') // fourth player
+	cellBlk   = byte('X') // immobile block, pieces fall through it
+	cellSolid = byte('S') // immobile block that stops falling pieces
 )
 
+// isBlock reports whether v is a block of either kind.
+func isBlock(v byte) bool { return v == cellBlk || v == cellSolid }
+
+// isPiece reports whether v belongs to a player.
+func isPiece(v byte) bool { return v != cellEmpty && !isBlock(v) }
+
+// turnOrder is the rotation of colors; a game uses the first Players of them.
+var turnOrder = []byte{cellR, cellY, cellG, cellB}
+
 type Game struct {
 	Rows, Cols int
 	Grid       [][]byte
 	Winning    [][]bool
-	Current    byte
-	Player1    string
-	Player2    string
-	Scores     struct{ R, Y int }
-	Message    string
-	GameOver   bool
+	// the cells marked in Winning, from one end of the line to the other
+	WinLine  [][2]int
+	Current  byte
+	Player1  string
+	Player2  string
+	Player3  string
+	Player4  string
+	Players  int // 2 (default) to 4, see turnOrder
+	Scores   tally
+	Message  string
+	GameOver bool
+	// why the game ended; "" while it is running
+	GameOverReason overReason
+	// the game is drawn once Turns reaches MaxTurns; 0 = no cap
+	MaxTurns int
+	// online: one session holds both seats, so the result must not count
+	// toward rankings
+	Unranked bool
+
+	// blocks rolled, their kind and the seed of the layout (see GameConfig)
+	Blocks      int
+	SolidBlocks bool
+	Seed        int64
+	// UTC date of the daily board ("2006-01-02"), "" for other games
+	Daily      string
 	Turns      int
 	GravityUp  bool
 	Mode       string // "local" | "ai" | "online"
 	CreatedAt  time.Time
 	Difficulty string
 
+	// rules (see variant): pieces to align, and gravity flips every FlipEvery
+	// moves (0 = never), or every FlipEvery full rounds with FlipMode
+	// flipPerRound. Variant is the preset name, "" when set by difficulty.
+	// WinBy overrides WinLen per direction (see lens).
+	WinLen    int
+	WinBy     dirLens
+	FlipEvery int
+	FlipMode  string
+	Variant   string
+
+	// AI mode: heuristic weights used by evalBoard. The AI plays Yellow,
+	// named AIName ("" outside AI mode, see isAISide).
+	AI     aiPersonality
+	AIName string
+
+	// local/AI: a first tap only selects PendingCol (-1 = none), a second
+	// tap on the same column (or the confirm button) drops the piece
+	ConfirmMoves bool
+	PendingCol   int
+
+	// opt-in: end as a draw as soon as neither side can still align WinLen
+	EarlyDraw bool
+
+	// opt-in balancing rule: the first move must go in the center column
+	// (either of the two on an even board), see openingAllows
+	CenterOpening bool
+
+	// opt-in: a coin flip drawn from Seed picks who moves first instead of
+	// Red (see firstPlayer)
+	RandomStart bool
+
+	// opt-in: a scheduled flip is held back while the side about to move has
+	// a winning drop (see flipDue)
+	FlipGuard bool
+
+	// endless mode (local/AI): a completed line scores a point in Points, is
+	// cleared and play goes on until the board is full or MaxTurns is reached
+	Endless bool
+	Points  tally
+
+	// endless mode: for each color, the rank of its latest point in the game
+	// (1 = the first one scored); breaks a shared lead between three or more
+	// players in endlessOver
+	PointSeq tally
+
+	// the color that won each game of the series, in order (see addScore),
+	// carried with Scores; Trophies are the achievement IDs the winner
+	// unlocked with this game (see unlockAchievements)
+	Series   string
+	Trophies []string
+
+	HintsUsed int
+
+	// power-up variant (off by default): column clears and manual gravity
+	// flips left per side
+	PowerUps   bool
+	ClearsLeft struct{ R, Y int }
+	FlipsLeft  struct{ R, Y int }
+
 	// online
 	LobbyCode string
 	ThisIsRed bool // viewer flag for online page
 
 	// NEW: who placed the most recent piece ('R' or 'Y')
 	LastPlayed byte
+
+	// move history, in play order, and the board before the first of them
+	// (blocks, plus pieces for /start/position games); Start is never
+	// written to once the game is built
+	Moves []Move
+	Start [][]byte
+
+	// online: time spent paused since the last move, kept out of the next
+	// move's Think
+	PauseTime time.Duration
+
+	// last request through session(); zero until the game is first served
+	LastSeen time.Time
+	// set when session() replaced an idle game; cleared by expiredRedirect
+	Expired bool
+}
+
+// overReason tells the result page how a game ended.
+type overReason string
+
+const (
+	reasonConnect overReason = "connect" // a line was completed
+	reasonDraw    overReason = "draw"    // board full or no line possible
+	reasonResign  overReason = "resign"  // a player gave up
+	reasonTimeout overReason = "timeout" // the player to move disconnected
+	reasonAborted overReason = "aborted" // ended by an operator (/admin)
+)
+
+// Move is one entry of the move history. Think is the wall-clock gap since
+// the previous move (or since the game was created for the first one).
+type Move struct {
+	Row, Col  int
+	Side      byte
+	At        time.Time
+	Think     time.Duration
+	GravityUp bool   // gravity when the piece was dropped
+	Kind      string // "" for a drop, "clear"/"flip" for power-ups (Row = -1)
+	Hash      string // chains this move to the previous ones (see appendMove)
 }
 
 type ChatMessage struct {
@@ -83,42 +233,336 @@ type lobby struct {
 	// NEW: rematch votes
 	RematchR bool
 	RematchY bool
+
+	// session id (pg_sid) of whoever created the lobby; only it may kick.
+	// The creator holds Red; YellowSID is whoever joined (see seatOwnedBy).
+	CreatorSID string
+	YellowSID  string
+	// bumped each time the Yellow seat is freed, so a kicked client notices
+	SeatGen int
+	// a guest has taken the Yellow seat at some point (freeing the seat
+	// keeps it); until then the lobby is an unanswered invite, see
+	// lobbyExpired
+	Joined bool
+
+	// both seats must POST /online/ready before moves are accepted
+	ReadyR bool
+	ReadyY bool
+
+	// last heartbeat (POST /online/ping, or any action) per seat
+	LastSeenR time.Time
+	LastSeenY time.Time
+
+	// one-time token carried by the play form; rotated after every accepted
+	// move so a resubmitted POST (refresh, back button) is a no-op
+	MoveToken string
+
+	// POST /online/pause: the seat that paused ("" = running) and since
+	// when; PausedTotal adds up the finished pauses of the current game
+	PausedBy    string
+	PausedAt    time.Time
+	PausedTotal time.Duration
+}
+
+// defaultChatCap is how many chat messages a lobby keeps (POWER4_CHAT_CAP).
+const defaultChatCap = 200
+
+// Server-wide chat limits, whatever the lobby: longest message in
+// characters (POWER4_CHAT_MAX_LEN) and messages per second across all
+// lobbies (POWER4_CHAT_RATE, 0 = unlimited).
+const (
+	defaultChatMaxLen = 240
+	defaultChatRate   = 20
+)
+
+// addChat numbers msg and appends it, dropping the oldest messages beyond
+// limit. Ids keep growing across trims, so /chat/feed?since= stays valid.
+func (lb *lobby) addChat(msg ChatMessage, limit int) {
+	lb.NextChatID++
+	msg.ID = lb.NextChatID
+	lb.Chat = append(lb.Chat, msg)
+	if limit > 0 && len(lb.Chat) > limit {
+		lb.Chat = append([]ChatMessage(nil), lb.Chat[len(lb.Chat)-limit:]...)
+	}
+}
+
+// seatOwnedBy reports whether session sid holds side ("R" or "Y").
+func (lb *lobby) seatOwnedBy(side, sid string) bool {
+	switch side {
+	case "R":
+		return sid != "" && sid == lb.CreatorSID
+	case "Y":
+		return lb.HasYellow && sid != "" && sid == lb.YellowSID
+	}
+	return false
+}
+
+// pause freezes lb's running game for side. It fails when the game is
+// not under way or is already paused.
+func (lb *lobby) pause(side string, now time.Time) bool {
+	g := lb.Game
+	if g == nil || g.GameOver || !(lb.ReadyR && lb.ReadyY) || lb.PausedBy != "" {
+		return false
+	}
+	lb.PausedBy, lb.PausedAt = side, now
+	return true
+}
+
+// resume ends the pause. The paused time is left out of the next move's
+// think time, and both seats count as just seen so the forfeit clock
+// restarts from now.
+func (lb *lobby) resume(now time.Time) {
+	if lb.PausedBy == "" {
+		return
+	}
+	d := now.Sub(lb.PausedAt)
+	lb.PausedTotal += d
+	lb.Game.PauseTime += d
+	lb.PausedBy, lb.PausedAt = "", time.Time{}
+	lb.LastSeenR = now
+	if lb.HasYellow {
+		lb.LastSeenY = now
+	}
+}
+
+// pausedFor is the game's paused time so far, the current pause included.
+func (lb *lobby) pausedFor(now time.Time) time.Duration {
+	d := lb.PausedTotal
+	if lb.PausedBy != "" {
+		d += now.Sub(lb.PausedAt)
+	}
+	return d
+}
+
+// seen records activity from a seat.
+func (lb *lobby) seen(side string, now time.Time) {
+	if side == "R" {
+		lb.LastSeenR = now
+	} else if side == "Y" {
+		lb.LastSeenY = now
+	}
 }
 
 type server struct {
-	tpl      *template.Template
-	mu       sync.Mutex
-	sessions map[string]*Game
-	lobbies  map[string]*lobby
+	tpl   *template.Template
+	mu    sync.Mutex
+	store Store // session games and lobbies (POWER4_STORE)
+
+	// POWER4_SECURE_COOKIES=1: always mark cookies Secure (TLS in front)
+	secureCookies bool
+
+	// several instances can share a domain: each one gets its own session
+	// cookie name (POWER4_COOKIE_NAME) and URL prefix (POWER4_BASE_PATH)
+	cookieName string
+	basePath   string // "" or "/prefix", no trailing slash
+
+	// lobby codes never generated nor accepted (see loadBlockedCodes)
+	blockedCodes map[string]bool
+
+	// session id → the lobby it created last, for createDebounce; guarded
+	// by mu
+	recentCreates map[string]recentLobby
+
+	// the player to move forfeits after this long without a heartbeat
+	// (POWER4_FORFEIT_GRACE, 0 disables)
+	forfeitGrace time.Duration
+
+	// a lobby nobody ever joined is dropped after this long without a
+	// change (POWER4_UNJOINED_TTL, 0 = lobbyIdleTTL like the others)
+	unjoinedTTL time.Duration
+
+	// /online/state reports opponentThinking once the opponent has had the
+	// move this long (POWER4_THINKING_AFTER, 0 = straight away)
+	thinkingAfter time.Duration
+
+	// POWER4_DEV=1: templates are re-read from this directory on every
+	// render instead of using the embedded copies parsed at startup
+	devTemplates string
+
+	// chat messages kept per lobby (POWER4_CHAT_CAP), longest message
+	// accepted (POWER4_CHAT_MAX_LEN) and one budget shared by every lobby
+	// (POWER4_CHAT_RATE / POWER4_CHAT_BURST, nil = unlimited)
+	chatCap     int
+	chatMaxLen  int
+	chatLimiter *ipLimiter
+
+	// per-IP budget of the JSON endpoints polled by pages and bots (see
+	// limited); nil = unlimited
+	apiLimiter *ipLimiter
+
+	// origins allowed to call /api/* from a browser (POWER4_CORS_ORIGINS);
+	// empty = same origin only
+	corsOrigins map[string]bool
+
+	// POWER4_ADMIN_TOKEN: bearer token of the /admin endpoints, which are
+	// not mounted at all when it is empty
+	adminToken string
+
+	startedAt time.Time
+	stats     serverStats
+
+	// POWER4_RESULTS_LOG: one JSON line per finished game; nil = off
+	results *resultsLog
+}
+
+// serverStats are the aggregates behind GET /api/stats. Games end both with
+// and without s.mu held (local games are not locked), so they have their
+// own lock.
+type serverStats struct {
+	mu     sync.Mutex
+	games  int // finished games this run
+	draws  int
+	winsBy map[byte]int // side → wins, forfeits included
+
+	// best win against today's daily board (see dailyBoard); reset when
+	// the first result of a new day comes in
+	dailyDate string
+	dailyBest dailyResult
+
+	// achievement IDs held per player name (see achievementKey)
+	trophies map[string]map[string]bool
+}
+
+// countGameOver records the end of g; call it once, right after g ends.
+func (s *server) countGameOver(g *Game) {
+	s.results.record(g, time.Now())
+	s.stats.mu.Lock()
+	defer s.stats.mu.Unlock()
+	s.stats.games++
+	if g.GameOverReason == reasonDraw {
+		s.stats.draws++
+		return
+	}
+	if s.stats.winsBy == nil {
+		s.stats.winsBy = make(map[byte]int)
+	}
+	s.stats.winsBy[g.LastPlayed]++
+	g.Trophies = s.stats.unlockAchievements(g, g.LastPlayed)
+	if g.Daily != "" && g.GameOverReason == reasonConnect && g.LastPlayed == cellR {
+		s.stats.recordDaily(g.Daily, dailyResult{Player: g.Player1, Turns: g.Turns})
+	}
+}
+
+// templateFiles are concatenated in this order, like the embedded strings.
+var templateFiles = []string{"base.html", "start.html", "game.html", "result.html"}
+
+// parseTemplatesDir parses templateFiles from dir.
+func parseTemplatesDir(dir string) (*template.Template, error) {
+	var src strings.Builder
+	for _, name := range templateFiles {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		src.Write(b)
+	}
+	return template.New("base").Parse(src.String())
+}
+
+// templates returns the set to render with: fresh from disk in dev mode,
+// otherwise the one parsed once at startup.
+func (s *server) templates() (*template.Template, error) {
+	if s.devTemplates != "" {
+		return parseTemplatesDir(s.devTemplates)
+	}
+	return s.tpl, nil
 }
 
 func main() {
 	mrand.Seed(time.Now().UnixNano())
 
+	// go run . tournament [flags]: headless AI vs AI games, no server
+	if len(os.Args) > 1 && os.Args[1] == "tournament" {
+		os.Exit(runTournament(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
 	s := &server{
-		tpl:      template.Must(template.New("base").Parse(baseTpl + startTpl + gameTpl + resultTpl)),
-		sessions: make(map[string]*Game),
-		lobbies:  make(map[string]*lobby),
+		tpl: template.Must(template.New("base").Parse(baseTpl + startTpl + gameTpl + resultTpl)),
+
+		secureCookies: os.Getenv("POWER4_SECURE_COOKIES") == "1",
+		cookieName:    os.Getenv("POWER4_COOKIE_NAME"),
+		basePath:      normalizeBasePath(os.Getenv("POWER4_BASE_PATH")),
+		startedAt:     time.Now(),
+	}
+	if s.cookieName == "" {
+		s.cookieName = "pg_sid"
+	}
+	store, err := newStore()
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.store = store
+	s.blockedCodes = loadBlockedCodes(os.Getenv("POWER4_BLOCKED_CODES"), os.Getenv("POWER4_BLOCKED_CODES_FILE"))
+	s.forfeitGrace = envDuration("POWER4_FORFEIT_GRACE", 60*time.Second)
+	s.thinkingAfter = envDuration("POWER4_THINKING_AFTER", 0)
+	s.unjoinedTTL = envDuration("POWER4_UNJOINED_TTL", 15*time.Minute)
+	s.adminToken = os.Getenv("POWER4_ADMIN_TOKEN")
+	s.chatCap = envInt("POWER4_CHAT_CAP", defaultChatCap)
+	s.chatMaxLen = envInt("POWER4_CHAT_MAX_LEN", defaultChatMaxLen)
+	if rate := envInt("POWER4_CHAT_RATE", defaultChatRate); rate > 0 {
+		s.chatLimiter = newIPLimiter(rate, envInt("POWER4_CHAT_BURST", 2*rate))
 	}
+	s.apiLimiter = newIPLimiter(envInt("POWER4_API_RATE", 10), envInt("POWER4_API_BURST", 30))
+	s.corsOrigins = parseOrigins(os.Getenv("POWER4_CORS_ORIGINS"))
+	if p := os.Getenv("POWER4_RESULTS_LOG"); p != "" {
+		if s.results, err = openResultsLog(p); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if os.Getenv("POWER4_AI_DEBUG") == "1" {
+		aiDebug = log.Default()
+	}
+	if os.Getenv("POWER4_DEV") == "1" {
+		s.devTemplates = "templates"
+		log.Printf("dev mode: templates reloaded from ./%s on each request", s.devTemplates)
+	}
+	go s.runSweeper(sweepEvery)
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", s.handleStart)
 	mux.HandleFunc("/start", s.handleStartPost)
+	mux.HandleFunc("/start/position", s.handleStartPosition)
+	mux.HandleFunc("/puzzle", s.handlePuzzle)
+	mux.HandleFunc("/api/new", s.cors(s.limited(s.handleAPINew)))
+	mux.HandleFunc("/api/stats", s.cors(s.limited(s.handleAPIStats)))
+	mux.HandleFunc("/api/preview", s.cors(s.limited(s.handleAPIPreview)))
 	mux.HandleFunc("/game", s.handleGame)
 	mux.HandleFunc("/play", s.handlePlay)
+	mux.HandleFunc("/play/clearcol", s.handleClearCol)
+	mux.HandleFunc("/play/flip", s.handleFlip)
+	mux.HandleFunc("/hint", s.limited(s.handleHint))
+	mux.HandleFunc("/analyze", s.limited(s.handleAnalyze))
+	mux.HandleFunc("/game/history/state", s.limited(s.handleHistoryState))
 	mux.HandleFunc("/replay", s.handleReplay)
+	mux.HandleFunc("/daily", s.handleDaily)
 	mux.HandleFunc("/reset", s.handleReset)
+	mux.HandleFunc("/board/reroll", s.handleReroll)
 	mux.HandleFunc("/result", s.handleResult)
+	mux.HandleFunc("/result/og", s.handleResultOG)
+	mux.HandleFunc("/result/board.png", s.limited(s.handleBoardPNG))
+	mux.HandleFunc("/theme", s.handleTheme)
+	mux.HandleFunc("/coords", s.handleCoords)
+	mux.HandleFunc("/highlight", s.handleHighlight)
 
 	// Online (MVP)
+	mux.HandleFunc("/online/", s.handleOnlineLink)
+	mux.HandleFunc("/online/watch", s.handleOnlineWatch)
 	mux.HandleFunc("/online/create", s.handleOnlineCreate)
 	mux.HandleFunc("/online/join", s.handleOnlineJoin)
 	mux.HandleFunc("/online/wait", s.handleOnlineWait)
-	mux.HandleFunc("/online/state", s.handleOnlineState)
+	mux.HandleFunc("/online/state", s.limited(s.handleOnlineState))
+	mux.HandleFunc("/online/config", s.limited(s.handleOnlineConfig))
 	mux.HandleFunc("/online/play", s.handleOnlinePlay)
 	mux.HandleFunc("/chat/post", s.handleChatPost)
-	mux.HandleFunc("/chat/feed", s.handleChatFeed)
+	mux.HandleFunc("/chat/feed", s.limited(s.handleChatFeed))
 	mux.HandleFunc("/online/replay", s.handleOnlineReplay)
+	mux.HandleFunc("/online/kick", s.handleOnlineKick)
+	mux.HandleFunc("/online/fork", s.handleOnlineFork)
+	mux.HandleFunc("/online/ready", s.handleOnlineReady)
+	mux.HandleFunc("/online/pause", s.handleOnlinePause)
+	mux.HandleFunc("/online/resume", s.handleOnlineResume)
+	mux.HandleFunc("/online/ping", s.handleOnlinePing)
+	mux.HandleFunc("/online/moves", s.limited(s.handleOnlineMoves))
 
 	// Static
 	mux.HandleFunc("/static/style.css", func(w http.ResponseWriter, r *http.Request) {
@@ -126,7 +570,13 @@ func main() {
 		_, _ = w.Write(cssBytes)
 	})
 	// Serve images (e.g., bg-space.jpg) from disk
-	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+	mux.Handle("/static/", http.StripPrefix("/static/", s.staticFiles("static")))
+
+	// Operators only (see requireAdmin)
+	if s.adminToken != "" {
+		mux.HandleFunc("/admin/lobby", s.requireAdmin(s.handleAdminLobby))
+		mux.HandleFunc("/admin/lobby/terminate", s.requireAdmin(s.handleAdminTerminate))
+	}
 
 	// Health
 	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
@@ -134,81 +584,185 @@ func main() {
 		_, _ = w.Write([]byte(`{"ok":true}`))
 	})
 
+	// mount everything under the base path (no-op when empty)
+	var root http.Handler = s.persisting(mux)
+	if s.basePath != "" {
+		outer := http.NewServeMux()
+		outer.Handle(s.basePath+"/", http.StripPrefix(s.basePath, root))
+		outer.Handle(s.basePath, http.RedirectHandler(s.basePath+"/", http.StatusMovedPermanently))
+		root = outer
+	}
+
 	port := os.Getenv("SERVER_PORT")
 	if port == "" {
 		port = "8080"
 	}
-	srv := &http.Server{
-		Addr:         ":" + port,
-		Handler:      securityHeaders(mux),
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 15 * time.Second,
-		IdleTimeout:  60 * time.Second,
-	}
-	log.Printf("Power4 BONUS listening on :%s\n", port)
+	srv := newHTTPServer(":"+port, securityHeaders(recoverPanics(root)))
+	log.Printf("Power4 BONUS listening on :%s%s/\n", port, s.basePath)
 	log.Fatal(srv.ListenAndServe())
 }
 
 func (s *server) handleStart(w http.ResponseWriter, r *http.Request) {
+	// "/" is the mux catch-all
+	if r.URL.Path != "/" {
+		s.renderNotFound(w, r)
+		return
+	}
 	g := s.gameForRequest(w, r, false)
+	// a fresh session falls back to the visitor's saved preferences
+	p1, diff := g.Player1, g.Difficulty
+	if p := prefsForRequest(r); p1 == "" && diff == "" {
+		p1, diff = p.Name, p.Difficulty
+	}
+	p2 := g.Player2
+	if g.AIName != "" {
+		p2 = "" // that was the AI, prefilled in its own field
+	}
+	data := map[string]any{
+		"Mode":       "local",
+		"Player1":    p1,
+		"Player2":    p2,
+		"AIName":     g.AIName,
+		"Player3":    "",
+		"Player4":    "",
+		"Players":    "2",
+		"MaxTurns":   "0",
+		"Density":    strconv.Itoa(defaultBlockDensity),
+		"Difficulty": diff,
+		"Variant":    g.Variant,
+		"Variants":   variants,
+		"AIStyle":    g.AI.Name,
+		"AIStyles":   aiPersonalities,
+		"LobbyCode":  "",
+		"Checked":    map[string]bool{},
+		"Errors":     map[string]string{},
+		"Expired":    r.URL.Query().Get("expired") == "1",
+	}
+	s.render(w, r, "start", data)
+}
+
+// startCheckboxes are the start form's on/off options, echoed back by
+// renderStartErrors.
+var startCheckboxes = []string{"confirm_moves", "early_draw", "center_opening", "random_start", "flip_guard", "flip_per_round", "endless", "custom_density", "no_blocks", "solid_blocks", "powerups", "online_no_flip"}
+
+// renderStartErrors shows the start page again with what was submitted and
+// errs (form input name → message) next to the offending fields.
+func (s *server) renderStartErrors(w http.ResponseWriter, r *http.Request, errs map[string]string) {
+	checked := make(map[string]bool, len(startCheckboxes))
+	for _, name := range startCheckboxes {
+		checked[name] = r.FormValue(name) != ""
+	}
 	data := map[string]any{
-		"Player1":    g.Player1,
-		"Player2":    g.Player2,
-		"Difficulty": g.Difficulty,
+		"Mode":       r.FormValue("mode"),
+		"Player1":    r.FormValue("player1"),
+		"Player2":    r.FormValue("player2"),
+		"AIName":     r.FormValue("ai_name"),
+		"Player3":    r.FormValue("player3"),
+		"Player4":    r.FormValue("player4"),
+		"Players":    r.FormValue("players"),
+		"MaxTurns":   r.FormValue("max_turns"),
+		"Density":    r.FormValue("block_density"),
+		"Difficulty": r.FormValue("difficulty"),
+		"Variant":    r.FormValue("variant"),
+		"Variants":   variants,
+		"AIStyle":    r.FormValue("ai_style"),
+		"AIStyles":   aiPersonalities,
+		"LobbyCode":  r.FormValue("lobby_code"),
+		"Checked":    checked,
+		"Errors":     errs,
+		"Expired":    false,
 	}
-	s.render(w, "start", data)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusBadRequest)
+	s.render(w, r, "start", data)
 }
 
 func (s *server) handleStartPost(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		s.redirect(w, r, "/")
+		return
+	}
+	if !parseForm(w, r) {
 		return
 	}
 
-	mode := strings.ToLower(strings.TrimSpace(r.FormValue("mode")))
+	errs := map[string]string{}
+	atoi := func(name string) int {
+		v := strings.TrimSpace(r.FormValue(name))
+		if v == "" {
+			return 0
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			errs[name] = "nombre entier attendu"
+		}
+		return n
+	}
+	players, maxTurns := atoi("players"), atoi("max_turns")
+	var density *int
+	if r.FormValue("custom_density") != "" {
+		d := atoi("block_density")
+		density = &d
+	}
+	sr := startRequest{
+		MaxTurns:   maxTurns,
+		Mode:       r.FormValue("mode"),
+		P1:         r.FormValue("player1"),
+		P2:         r.FormValue("player2"),
+		P3:         r.FormValue("player3"),
+		P4:         r.FormValue("player4"),
+		AIName:     r.FormValue("ai_name"),
+		Players:    players,
+		Solid:      r.FormValue("solid_blocks") != "",
+		NoBlocks:   r.FormValue("no_blocks") != "",
+		Density:    density,
+		Center:     r.FormValue("center_opening") != "",
+		Random:     r.FormValue("random_start") != "",
+		Difficulty: r.FormValue("difficulty"),
+		Variant:    r.FormValue("variant"),
+	}
+	if r.FormValue("flip_per_round") != "" {
+		sr.FlipMode = flipPerRound
+	}
 	oa := strings.ToLower(strings.TrimSpace(r.FormValue("online_action"))) // "create" | "join" | ""
 
 	// If an online button was clicked, force online mode regardless of dropdown
-	if mode != "online" && (oa == "create" || oa == "join") {
-		mode = "online"
-	}
-	if mode == "" {
-		mode = "local"
+	if oa == "create" || oa == "join" {
+		sr.Mode = "online"
 	}
 
-	p1 := strings.TrimSpace(r.FormValue("player1"))
-	p2 := strings.TrimSpace(r.FormValue("player2"))
-	if p1 == "" {
-		p1 = "Rouge"
-	}
-	if p2 == "" {
-		p2 = "Jaune"
+	typedName := strings.TrimSpace(sr.P1) // before normalize puts the default in
+	v, err := sr.normalize()
+	var fe *fieldError
+	if errors.As(err, &fe) && errs[fe.Field] == "" {
+		errs[fe.Field] = fe.Msg
 	}
-
-	diff := strings.ToLower(strings.TrimSpace(r.FormValue("difficulty")))
-	if diff == "" {
-		diff = "easy"
+	if len(errs) > 0 {
+		s.renderStartErrors(w, r, errs)
+		return
 	}
+	mode, p1, p2, diff := sr.Mode, sr.P1, sr.P2, sr.Difficulty
+	s.savePrefs(w, r, prefs{Name: typedName, Difficulty: diff})
 
-	rows, cols, blocks := configByDifficulty(diff)
+	ai := aiPersonalityByName(strings.ToLower(strings.TrimSpace(r.FormValue("ai_style"))))
+	confirm := r.FormValue("confirm_moves") != ""
+	powerUps := r.FormValue("powerups") != ""
+	earlyDraw := r.FormValue("early_draw") != ""
+	endless := r.FormValue("endless") != ""
+	flipGuard := r.FormValue("flip_guard") != ""
 
 	switch mode {
-	case "local":
-		g := s.gameForRequest(w, r, true)
-		*g = *newGame(rows, cols, blocks)
-		g.Player1, g.Player2 = p1, p2
-		g.Difficulty = diff
-		g.Mode = "local"
-		http.Redirect(w, r, "/game", http.StatusSeeOther)
-		return
-
-	case "ai":
+	case "local", "ai":
+		cfg := sr.config(v)
+		if mode == "ai" {
+			cfg.AI = ai
+		}
+		cfg.ConfirmMoves, cfg.EarlyDraw, cfg.PowerUps = confirm, earlyDraw, powerUps
+		cfg.Endless, cfg.FlipGuard = endless, flipGuard
 		g := s.gameForRequest(w, r, true)
-		*g = *newGame(rows, cols, blocks)
-		g.Player1, g.Player2 = p1, p2
-		g.Difficulty = diff
-		g.Mode = "ai"
-		http.Redirect(w, r, "/game", http.StatusSeeOther)
+		*g = *NewGameFromConfig(cfg)
+		s.playAITurn(g) // the coin may have given the AI the first move
+		s.redirect(w, r, "/game")
 		return
 
 	case "online":
@@ -216,515 +770,4630 @@ func (s *server) handleStartPost(w http.ResponseWriter, r *http.Request) {
 
 		// If "Join" button pressed OR (big button with a code) => join
 		if oa == "join" || (oa == "" && len(code) >= 4) {
-			http.Redirect(w, r, "/online/join?code="+code, http.StatusSeeOther)
+			s.redirect(w, r, "/online/join?code="+code)
 			return
 		}
 
 		// Otherwise => create (auto code generated server-side)
-		createURL := "/online/create?rows=" + strconv.Itoa(rows) + "&cols=" + strconv.Itoa(cols) + "&blocks=" + strconv.Itoa(blocks) +
-			"&p1=" + urlQueryEscape(p1) + "&p2=" + urlQueryEscape(p2) + "&diff=" + diff
-		http.Redirect(w, r, createURL, http.StatusSeeOther)
+		createURL := "/online/create?rows=" + strconv.Itoa(v.Rows) + "&cols=" + strconv.Itoa(v.Cols) + "&blocks=" + strconv.Itoa(v.Blocks) +
+			"&p1=" + urlQueryEscape(p1) + "&p2=" + urlQueryEscape(p2) + "&diff=" + diff + "&variant=" + v.Name
+		if earlyDraw {
+			createURL += "&early_draw=1"
+		}
+		if sr.Center {
+			createURL += "&center_opening=1"
+		}
+		if sr.Random {
+			createURL += "&random_start=1"
+		}
+		if sr.Density != nil {
+			createURL += "&density=" + strconv.Itoa(*sr.Density)
+		}
+		if sr.NoBlocks {
+			createURL += "&no_blocks=1"
+		}
+		if sr.Solid {
+			createURL += "&solid=1"
+		}
+		if flipGuard {
+			createURL += "&flip_guard=1"
+		}
+		if sr.FlipMode == flipPerRound {
+			createURL += "&flip_mode=" + flipPerRound
+		}
+		if r.FormValue("online_no_flip") != "" {
+			createURL += "&no_flip=1"
+		}
+		s.redirect(w, r, createURL)
 		return
 
 	default:
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		s.redirect(w, r, "/")
 		return
 	}
 }
 
-func urlQueryEscape(s string) string {
-	// light helper (avoids importing net/url here)
-	replacer := strings.NewReplacer(" ", "+")
-	return replacer.Replace(s)
+// startRequest is what a new game asks for, from the start form or from
+// POST /api/new. Zero board fields keep the variant / difficulty preset.
+type startRequest struct {
+	Mode       string  `json:"mode"`
+	Rows       int     `json:"rows"`
+	Cols       int     `json:"cols"`
+	Blocks     *int    `json:"blocks"`
+	Solid      bool    `json:"solidBlocks"`   // blocks stop pieces instead of letting them through
+	NoBlocks   bool    `json:"noBlocks"`      // forces blocks to 0, whatever the preset
+	Density    *int    `json:"blockDensity"`  // % of cells, replaces the preset's block count
+	Center     bool    `json:"centerOpening"` // first move in the center column only
+	Random     bool    `json:"randomStart"`   // a coin flip picks who moves first
+	WinLen     int     `json:"winLen"`
+	WinBy      dirLens `json:"winLens"` // per-direction overrides of winLen
+	FlipEvery  *int    `json:"flipEvery"`
+	FlipMode   string  `json:"flipMode"` // flipPerMove (default) or flipPerRound
+	P1         string  `json:"p1"`
+	P2         string  `json:"p2"`
+	P3         string  `json:"p3"`
+	P4         string  `json:"p4"`
+	AIName     string  `json:"aiName"`   // ai mode: Yellow's name, defaultAIName if empty
+	Players    int     `json:"players"`  // 0 = 2; 3 and 4 are local-only
+	MaxTurns   int     `json:"maxTurns"` // 0 = no cap
+	Difficulty string  `json:"difficulty"`
+	Variant    string  `json:"variant"`
 }
 
-func (s *server) handleGame(w http.ResponseWriter, r *http.Request) {
-	g := s.gameForRequest(w, r, false)
-	data := s.viewModel(g)
-	s.render(w, "game", data)
+// fieldError is a validation error about one start-form field (its input
+// name), so the start page can show it next to that field. /api/new only
+// reports the message.
+type fieldError struct {
+	Field string
+	Msg   string
 }
 
-func (s *server) handlePlay(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Redirect(w, r, "/game", http.StatusSeeOther)
-		return
+func (e *fieldError) Error() string { return e.Msg }
+
+// normalize fills in defaults and checks sr, returning the rules to play.
+// Errors are *fieldError.
+func (sr *startRequest) normalize() (variant, error) {
+	sr.Mode = strings.ToLower(strings.TrimSpace(sr.Mode))
+	if sr.Mode == "" {
+		sr.Mode = "local"
 	}
-	g := s.gameForRequest(w, r, false)
-	if g.GameOver {
-		http.Redirect(w, r, "/result", http.StatusSeeOther)
-		return
+	if sr.Mode != "local" && sr.Mode != "ai" && sr.Mode != "online" {
+		return variant{}, &fieldError{"mode", fmt.Sprintf("mode inconnu %q", sr.Mode)}
 	}
 
-	colStr := r.FormValue("col")
-	c, err := strconv.Atoi(colStr)
-	if err != nil || c < 0 || c >= g.Cols {
-		http.Redirect(w, r, "/game", http.StatusSeeOther)
-		return
+	sr.P1, sr.P2 = strings.TrimSpace(sr.P1), strings.TrimSpace(sr.P2)
+	sr.P3, sr.P4 = strings.TrimSpace(sr.P3), strings.TrimSpace(sr.P4)
+	for i, name := range []string{sr.P1, sr.P2, sr.P3, sr.P4} {
+		if utf8.RuneCountInString(name) > maxNameLen {
+			return variant{}, &fieldError{fmt.Sprintf("player%d", i+1), fmt.Sprintf("%d caractères maximum", maxNameLen)}
+		}
+	}
+	sr.AIName = strings.TrimSpace(sr.AIName)
+	if utf8.RuneCountInString(sr.AIName) > maxNameLen {
+		return variant{}, &fieldError{"ai_name", fmt.Sprintf("%d caractères maximum", maxNameLen)}
+	}
+	if sr.P1 == "" {
+		sr.P1 = "Rouge"
+	}
+	if sr.P2 == "" {
+		sr.P2 = "Jaune"
+	}
+	if sr.P3 == "" {
+		sr.P3 = "Vert"
+	}
+	if sr.P4 == "" {
+		sr.P4 = "Bleu"
+	}
+	if sr.Players == 0 {
+		sr.Players = 2
+	}
+	if sr.Players < 2 || sr.Players > len(turnOrder) {
+		return variant{}, &fieldError{"players", fmt.Sprintf("entre 2 et %d joueurs", len(turnOrder))}
+	}
+	if sr.Players > 2 && sr.Mode != "local" {
+		return variant{}, &fieldError{"players", "plus de 2 joueurs : mode local uniquement"}
 	}
 
-	row := dropRow(g.Grid, c, g.GravityUp)
-	if row == -1 || g.Grid[row][c] != cellEmpty {
-		http.Redirect(w, r, "/game", http.StatusSeeOther)
-		return
+	sr.Difficulty = strings.ToLower(strings.TrimSpace(sr.Difficulty))
+	switch sr.Difficulty {
+	case "":
+		sr.Difficulty = "easy"
+	case "easy", "normal", "hard":
+	default:
+		return variant{}, &fieldError{"difficulty", fmt.Sprintf("difficulté inconnue %q", sr.Difficulty)}
 	}
-	g.Grid[row][c] = g.Current
-	g.LastPlayed = g.Current
 
-	g.Turns++
+	sr.Variant = strings.ToLower(strings.TrimSpace(sr.Variant))
+	if _, ok := variantConfig(sr.Variant); sr.Variant != "" && !ok {
+		return variant{}, &fieldError{"variant", fmt.Sprintf("variante inconnue %q", sr.Variant)}
+	}
+	v := rulesFor(sr.Difficulty, sr.Variant)
+	if sr.Rows != 0 {
+		v.Rows = sr.Rows
+	}
+	if sr.Cols != 0 {
+		v.Cols = sr.Cols
+	}
+	if sr.Blocks != nil {
+		v.Blocks = *sr.Blocks
+	}
+	if sr.Density != nil {
+		if *sr.Density < 0 || *sr.Density > maxBlockDensity {
+			return variant{}, &fieldError{"block_density", fmt.Sprintf("densité entre 0 et %d %%", maxBlockDensity)}
+		}
+		v.Blocks = blocksForDensity(v.Rows, v.Cols, *sr.Density)
+	}
+	if sr.NoBlocks {
+		v.Blocks = 0
+	}
+	if sr.WinLen != 0 {
+		v.WinLen = sr.WinLen
+	}
+	if sr.WinBy != (dirLens{}) {
+		v.WinBy = sr.WinBy
+	}
+	if sr.FlipEvery != nil {
+		v.FlipEvery = *sr.FlipEvery
+	}
 
-	// Win / Draw?
-	if s.checkResult(g, row, c, g.Current) {
-		http.Redirect(w, r, "/result", http.StatusSeeOther)
-		return
+	// the form only picks board rules through the variant
+	switch {
+	case v.Rows < minBoardSide || v.Rows > maxBoardSide || v.Cols < minBoardSide || v.Cols > maxBoardSide:
+		return variant{}, &fieldError{"variant", fmt.Sprintf("grille entre %d et %d de côté", minBoardSide, maxBoardSide)}
+	case v.Blocks < 0 || v.Blocks > maxBlocks(v.Rows, v.Cols):
+		return variant{}, &fieldError{"variant", fmt.Sprintf("entre 0 et %d blocs", maxBlocks(v.Rows, v.Cols))}
+	case v.WinLen < 3 || (v.WinLen > v.Rows && v.WinLen > v.Cols):
+		return variant{}, &fieldError{"variant", fmt.Sprintf("longueur à aligner invalide (%d)", v.WinLen)}
+	case v.WinBy.H != 0 && (v.WinBy.H < 3 || v.WinBy.H > v.Cols):
+		return variant{}, &fieldError{"variant", fmt.Sprintf("longueur horizontale invalide (%d)", v.WinBy.H)}
+	case v.WinBy.V != 0 && (v.WinBy.V < 3 || v.WinBy.V > v.Rows):
+		return variant{}, &fieldError{"variant", fmt.Sprintf("longueur verticale invalide (%d)", v.WinBy.V)}
+	case v.WinBy.D != 0 && (v.WinBy.D < 3 || v.WinBy.D > min(v.Rows, v.Cols)):
+		return variant{}, &fieldError{"variant", fmt.Sprintf("longueur diagonale invalide (%d)", v.WinBy.D)}
+	case v.FlipEvery < 0:
+		return variant{}, &fieldError{"variant", "fréquence d’inversion négative"}
+	case sr.FlipMode != "" && sr.FlipMode != flipPerMove && sr.FlipMode != flipPerRound:
+		return variant{}, &fieldError{"flip_per_round", fmt.Sprintf("mode d’inversion inconnu %q", sr.FlipMode)}
+	case sr.MaxTurns < 0:
+		return variant{}, &fieldError{"max_turns", "limite de tours négative"}
 	}
+	return v, nil
+}
 
-	// Switch player
-	if g.Current == cellR {
-		g.Current = cellY
-	} else {
-		g.Current = cellR
+// config is the GameConfig for sr played with rules v.
+func (sr *startRequest) config(v variant) GameConfig {
+	cfg := v.config()
+	cfg.Player1, cfg.Player2 = sr.P1, sr.P2
+	cfg.Player3, cfg.Player4 = sr.P3, sr.P4
+	cfg.AIName = sr.AIName
+	cfg.FlipMode = sr.FlipMode
+	cfg.Players = sr.Players
+	cfg.MaxTurns = sr.MaxTurns
+	cfg.SolidBlocks = sr.Solid
+	cfg.CenterOpening = sr.Center
+	cfg.RandomStart = sr.Random
+	cfg.Difficulty = sr.Difficulty
+	cfg.Mode = sr.Mode
+	return cfg
+}
+
+// gameState is the JSON view of a session game for API clients. Grid rows
+// use the /start/position notation ('.', 'R', 'Y', 'X', 'S').
+type gameState struct {
+	Mode       string   `json:"mode"`
+	Rows       int      `json:"rows"`
+	Cols       int      `json:"cols"`
+	WinLen     int      `json:"winLen"`
+	WinLens    lineLens `json:"winLens"` // horizontal, vertical, both diagonals
+	FlipEvery  int      `json:"flipEvery"`
+	FlipMode   string   `json:"flipMode"`
+	Grid       []string `json:"grid"`
+	Current    string   `json:"current"`
+	GravityUp  bool     `json:"gravityUp"`
+	Turns      int      `json:"turns"`
+	GameOver   bool     `json:"gameOver"`
+	Event      string   `json:"event"` // see lastEvent
+	WinLine    *winLine `json:"winLine,omitempty"`
+	P1         string   `json:"p1"`
+	P2         string   `json:"p2"`
+	Difficulty string   `json:"difficulty"`
+}
+
+func stateOf(g *Game) gameState {
+	return gameState{
+		Mode:       g.Mode,
+		Rows:       g.Rows,
+		Cols:       g.Cols,
+		WinLen:     g.WinLen,
+		WinLens:    g.lens(),
+		FlipEvery:  g.FlipEvery,
+		FlipMode:   g.flipMode(),
+		Grid:       formatGrid(g.Grid),
+		Current:    string(g.Current),
+		GravityUp:  g.GravityUp,
+		Turns:      g.Turns,
+		GameOver:   g.GameOver,
+		Event:      lastEvent(g),
+		WinLine:    winLineOf(g),
+		P1:         g.Player1,
+		P2:         g.Player2,
+		Difficulty: g.Difficulty,
 	}
+}
 
-	// Flip gravity every 5 moves
-	if g.Turns%5 == 0 {
-		g.GravityUp = !g.GravityUp
-		g.Message = ""
+// winLine is the completed line in drawing order, so a client can reveal it
+// piece by piece: Dir is the [row, col] step from one cell to the next.
+type winLine struct {
+	Cells [][2]int `json:"cells"`
+	Dir   [2]int   `json:"dir"`
+}
+
+// winLineOf returns g's completed line, or nil when no line was made.
+func winLineOf(g *Game) *winLine {
+	if len(g.WinLine) < 2 {
+		return nil
 	}
+	a, b := g.WinLine[0], g.WinLine[1]
+	return &winLine{Cells: g.WinLine, Dir: [2]int{b[0] - a[0], b[1] - a[1]}}
+}
 
-	// If AI mode and now it's AI's turn, let AI play immediately
-	if g.Mode == "ai" && g.Current == cellY && !g.GameOver {
-		aiCol := chooseAIMove(g)
-		if aiCol >= 0 {
-			rowAI := dropRow(g.Grid, aiCol, g.GravityUp)
-			if rowAI != -1 && g.Grid[rowAI][aiCol] == cellEmpty {
-				g.Grid[rowAI][aiCol] = cellY
-				g.LastPlayed = g.Current
-				g.Turns++
-				if s.checkResult(g, rowAI, aiCol, cellY) {
-					http.Redirect(w, r, "/result", http.StatusSeeOther)
-					return
-				}
-				// switch back to human
-				g.Current = cellR
-				if g.Turns%5 == 0 {
-					g.GravityUp = !g.GravityUp
-					g.Message = ""
-				}
+// formatGrid is the inverse of parsePosition.
+func formatGrid(grid [][]byte) []string {
+	out := make([]string, len(grid))
+	for r, row := range grid {
+		b := make([]byte, len(row))
+		for c, v := range row {
+			b[c] = v
+			if v == cellEmpty {
+				b[c] = '.'
 			}
 		}
+		out[r] = string(b)
 	}
-
-	http.Redirect(w, r, "/game", http.StatusSeeOther)
+	return out
 }
 
-func (s *server) handleReplay(w http.ResponseWriter, r *http.Request) {
+// POST /api/new  (JSON startRequest)  →  201 + gameState
+// Programmatic start form: creates the session game (and cookie).
+func (s *server) handleAPINew(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Redirect(w, r, "/game", http.StatusSeeOther)
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"err": "POST only"})
 		return
 	}
-	g := s.gameForRequest(w, r, false)
-	diff := g.Difficulty
-	rows, cols, blocks := configByDifficulty(diff)
-	scoreR, scoreY := g.Scores.R, g.Scores.Y
-	p1, p2 := g.Player1, g.Player2
-	*g = *newGame(rows, cols, blocks)
-	g.Player1, g.Player2 = p1, p2
-	g.Scores.R, g.Scores.Y = scoreR, scoreY
-	g.Difficulty = diff
-	http.Redirect(w, r, "/game", http.StatusSeeOther)
+	var sr startRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&sr); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"err": "invalid JSON: " + err.Error()})
+		return
+	}
+	v, err := sr.normalize()
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"err": err.Error()})
+		return
+	}
+	if sr.Mode == "online" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"err": "online games start from /online/create"})
+		return
+	}
+
+	g := s.gameForRequest(w, r, true)
+	*g = *NewGameFromConfig(sr.config(v))
+	s.playAITurn(g)
+	writeJSON(w, http.StatusCreated, stateOf(g))
 }
 
-func (s *server) handleReset(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+// statsView is the /api/stats body: aggregates only, nothing that names a
+// player, a session or a lobby.
+type statsView struct {
+	GamesPlayed   int            `json:"gamesPlayed"`
+	Draws         int            `json:"draws"`
+	Wins          map[string]int `json:"wins"` // "R", "Y", "G", "B"
+	ActiveLobbies int            `json:"activeLobbies"`
+	Sessions      int            `json:"sessions"`
+	UptimeSeconds int64          `json:"uptimeSeconds"`
+	Daily         *dailyResult   `json:"daily,omitempty"` // today's best, if any
+}
+
+// GET /api/stats  →  statsView
+// Lightweight numbers for dashboards; unauthenticated on purpose.
+func (s *server) handleAPIStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"err": "GET only"})
 		return
 	}
-	_ = s.gameForRequest(w, r, true) // reset session
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	v := statsView{
+		Wins:          map[string]int{},
+		UptimeSeconds: int64(time.Since(s.startedAt).Seconds()),
+	}
+	v.Sessions, v.ActiveLobbies = s.store.Len() // see Store: no s.mu needed
+
+	s.stats.mu.Lock()
+	v.GamesPlayed, v.Draws = s.stats.games, s.stats.draws
+	for _, side := range turnOrder {
+		v.Wins[string(side)] = s.stats.winsBy[side]
+	}
+	if best, ok := s.stats.dailyBestOn(dailyDate(time.Now())); ok {
+		v.Daily = &best
+	}
+	s.stats.mu.Unlock()
+	writeJSON(w, http.StatusOK, v)
 }
 
-func (s *server) handleResult(w http.ResponseWriter, r *http.Request) {
-	// default: session game
-	g := s.gameForRequest(w, r, false)
-	data := s.viewModel(g)
+// previewView is the /api/preview body. Row is -1 (and Full set) when the
+// column cannot take a piece.
+type previewView struct {
+	Col     int      `json:"col"`
+	Row     int      `json:"row"`
+	Side    string   `json:"side"`
+	Full    bool     `json:"full"`
+	Wins    bool     `json:"wins"`
+	Draws   bool     `json:"draws"`
+	Through [][2]int `json:"through"` // blocks the piece would cross, [row, col]
+}
 
-	code := strings.ToUpper(strings.TrimSpace(r.URL.Query().Get("code")))
-	side := strings.ToUpper(strings.TrimSpace(r.URL.Query().Get("side")))
+// GET /api/preview?col=N  →  previewView
+// Where the session game's current player would land in column N and what
+// it would do, so the client can draw a ghost piece without redoing the
+// gravity rules. Nothing is played.
+func (s *server) handleAPIPreview(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"err": "GET only"})
+		return
+	}
+	g := s.gameForRequest(w, r, false)
 
-	if code != "" && (side == "R" || "Y" == side) {
-		// Prefer authoritative lobby state
-		s.mu.Lock()
-		lb, ok := s.lobbies[code]
-		var gsrc *Game
-		if ok && lb.Game != nil {
-			// copy to avoid races while templating
-			gcopy := *lb.Game
-			gsrc = &gcopy
-		}
-		s.mu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	col, err := strconv.Atoi(r.URL.Query().Get("col"))
+	if err != nil || col < 0 || col >= g.Cols {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"err": "invalid col"})
+		return
+	}
+	if g.Mode == "online" || g.GameOver {
+		writeJSON(w, http.StatusConflict, map[string]string{"err": "no move to preview"})
+		return
+	}
 
-		if gsrc != nil {
-			data = s.viewModel(gsrc)
+	v := previewView{Col: col, Side: string(g.Current), Through: [][2]int{}}
+	var ok bool
+	v.Row, v.Wins, v.Draws, ok = dryDrop(g, col, g.Current)
+	v.Full = !ok
+	if ok {
+		if _, through := fallPath(g.Grid, v.Row, col, g.GravityUp); through != nil {
+			v.Through = through
 		}
-		data["IsOnline"] = true
-		data["LobbyCode"] = code
-		data["ThisIsRed"] = (side == "R")
 	}
-
-	s.render(w, "result", data)
+	writeJSON(w, http.StatusOK, v)
 }
 
-func (s *server) checkResult(g *Game, r, c int, p byte) bool {
-	line := winningLine(g.Grid, r, c, p)
-	if len(line) >= 4 {
-		for _, rc := range line[:4] {
-			g.Winning[rc[0]][rc[1]] = true
-		}
-		g.GameOver = true
-		if p == cellR {
-			g.Scores.R++
-		} else {
-			g.Scores.Y++
+// POST /start/position  (form: position, mode, player1, player2)
+// Starts a local/AI game from a given layout, e.g. for "win in 2" puzzles.
+func (s *server) handleStartPosition(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.redirect(w, r, "/")
+		return
+	}
+	if !parseForm(w, r) {
+		return
+	}
+	pg, err := gameFromPosition(r.FormValue("position"))
+	if err != nil {
+		http.Error(w, "position invalide : "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	mode := strings.ToLower(strings.TrimSpace(r.FormValue("mode")))
+	if mode != "ai" {
+		mode = "local"
+	}
+	p1 := strings.TrimSpace(r.FormValue("player1"))
+	p2 := strings.TrimSpace(r.FormValue("player2"))
+	if p1 == "" {
+		p1 = "Rouge"
+	}
+	if p2 == "" {
+		p2 = "Jaune"
+	}
+
+	g := s.gameForRequest(w, r, true)
+	*g = *pg
+	g.Player1, g.Player2 = p1, p2
+	g.Difficulty = "custom"
+	g.Mode = mode
+	if mode == "ai" {
+		nameAI(g, strings.TrimSpace(r.FormValue("ai_name")))
+	}
+	// Yellow to move on the given layout: the AI plays it straight away
+	if mode == "ai" && s.playAITurn(g) {
+		s.redirect(w, r, "/result")
+		return
+	}
+	s.redirect(w, r, "/game")
+}
+
+// Puzzle links (/puzzle?d=) carry a position and its rules in one URL-safe
+// base64 string: puzzleVersion, rows, cols, winLen, flipEvery, a flags byte
+// (bit 0: gravity up), then one nibble per cell, row by row from the top.
+const (
+	puzzleVersion   = 1
+	puzzleHeaderLen = 6
+	// maxPuzzleParam is the longest d accepted: a 12×12 board is 104
+	// characters
+	maxPuzzleParam = 128
+)
+
+// puzzleCells maps a cell to its nibble; the index is the nibble.
+var puzzleCells = []byte{cellEmpty, cellR, cellY, cellBlk, cellSolid}
+
+// errPuzzleTooLarge is decodePuzzle's answer to a d over maxPuzzleParam.
+var errPuzzleTooLarge = errors.New("lien d’énigme trop long")
+
+// encodePuzzle is the /puzzle?d= value for g's current position.
+func encodePuzzle(g *Game) string {
+	b := make([]byte, puzzleHeaderLen, puzzleHeaderLen+(g.Rows*g.Cols+1)/2)
+	b[0], b[1], b[2], b[3], b[4] = puzzleVersion, byte(g.Rows), byte(g.Cols), byte(g.WinLen), byte(g.FlipEvery)
+	if g.GravityUp {
+		b[5] = 1
+	}
+	for i := 0; i < g.Rows*g.Cols; i++ {
+		n := byte(bytes.IndexByte(puzzleCells, g.Grid[i/g.Cols][i%g.Cols]))
+		if i%2 == 0 {
+			b = append(b, n<<4)
+		} else {
+			b[len(b)-1] |= n
+		}
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// puzzleCodeOf is encodePuzzle(g) for a two-player game still in progress
+// on classic rules, "" when g cannot be shared as a puzzle.
+func puzzleCodeOf(g *Game) string {
+	if g.GameOver || g.Players > 2 || g.Endless || g.PowerUps || g.WinBy != (dirLens{}) || g.FlipMode == flipPerRound ||
+		g.starter() != cellR { // the decoder gives Red the first move
+
+		return ""
+	}
+	return encodePuzzle(g)
+}
+
+// decodePuzzle turns a /puzzle?d= value back into a game, with the same
+// checks as a /start/position board.
+func decodePuzzle(d string) (*Game, error) {
+	if len(d) > maxPuzzleParam {
+		return nil, errPuzzleTooLarge
+	}
+	b, err := base64.RawURLEncoding.DecodeString(d)
+	if err != nil || len(b) < puzzleHeaderLen || b[0] != puzzleVersion {
+		return nil, errors.New("lien d’énigme illisible")
+	}
+	rows, cols, winLen, flipEvery := int(b[1]), int(b[2]), int(b[3]), int(b[4])
+	switch {
+	case rows < minBoardSide || rows > maxBoardSide || cols < minBoardSide || cols > maxBoardSide:
+		return nil, fmt.Errorf("grille entre %d et %d de côté", minBoardSide, maxBoardSide)
+	case len(b) != puzzleHeaderLen+(rows*cols+1)/2:
+		return nil, errors.New("lien d’énigme tronqué")
+	case winLen < 3 || (winLen > rows && winLen > cols):
+		return nil, fmt.Errorf("longueur à aligner invalide (%d)", winLen)
+	case b[5]&^1 != 0:
+		return nil, errors.New("lien d’énigme illisible")
+	}
+	grid := make([][]byte, rows)
+	for r := range grid {
+		grid[r] = make([]byte, cols)
+		for c := range grid[r] {
+			i := r*cols + c
+			n := b[puzzleHeaderLen+i/2]
+			if i%2 == 0 {
+				n >>= 4
+			}
+			n &= 0x0f
+			if int(n) >= len(puzzleCells) {
+				return nil, fmt.Errorf("case invalide (%d)", n)
+			}
+			grid[r][c] = puzzleCells[n]
+		}
+	}
+	g, err := gameFromGrid(GameConfig{WinLen: winLen, FlipEvery: flipEvery, Difficulty: "custom", Grid: grid})
+	if err != nil {
+		return nil, err
+	}
+	g.GravityUp = b[5]&1 == 1
+	return g, nil
+}
+
+// GET /puzzle?d=...[&mode=ai]
+// Starts a local (or AI) game from a shared puzzle link, see encodePuzzle.
+func (s *server) handlePuzzle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method", http.StatusMethodNotAllowed)
+		return
+	}
+	pg, err := decodePuzzle(r.URL.Query().Get("d"))
+	if errors.Is(err, errPuzzleTooLarge) {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "énigme invalide : "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	g := s.gameForRequest(w, r, true)
+	*g = *pg
+	g.Player1, g.Player2 = "Rouge", "Jaune"
+	if name := prefsForRequest(r).Name; name != "" {
+		g.Player1 = name
+	}
+	if r.URL.Query().Get("mode") == "ai" {
+		g.Mode = "ai"
+		nameAI(g, "")
+		// Yellow to move in the puzzle: the AI opens
+		if s.playAITurn(g) {
+			s.redirect(w, r, "/result")
+			return
+		}
+	}
+	s.redirect(w, r, "/game")
+}
+
+// envDuration reads a Go duration ("90s", "2m") from the environment.
+func envDuration(name string, def time.Duration) time.Duration {
+	v := strings.TrimSpace(os.Getenv(name))
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		log.Printf("%s: invalid duration %q, using %s", name, v, def)
+		return def
+	}
+	return d
+}
+
+// envInt reads a positive integer from the environment, falling back to def
+// (with a log line) when it is unset or invalid.
+func envInt(name string, def int) int {
+	v := strings.TrimSpace(os.Getenv(name))
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		log.Printf("%s: invalid number %q, using %d", name, v, def)
+		return def
+	}
+	return n
+}
+
+// newHTTPServer applies the connection timeouts, overridable with
+// POWER4_READ_TIMEOUT, POWER4_WRITE_TIMEOUT and POWER4_IDLE_TIMEOUT
+// (0 = no timeout).
+func newHTTPServer(addr string, h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:         addr,
+		Handler:      h,
+		ReadTimeout:  envDuration("POWER4_READ_TIMEOUT", 5*time.Second),
+		WriteTimeout: envDuration("POWER4_WRITE_TIMEOUT", 15*time.Second),
+		IdleTimeout:  envDuration("POWER4_IDLE_TIMEOUT", 60*time.Second),
+	}
+}
+
+// maxFormBytes caps a form body: the largest legit one is a chat message or
+// a /start/position board.
+const maxFormBytes = 64 << 10
+
+// parseForm parses r's url-encoded or multipart body (fetch sends FormData
+// as multipart). A malformed or oversized body gets a 400 instead of being
+// read as empty fields; parseForm then reports false.
+func parseForm(w http.ResponseWriter, r *http.Request) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, maxFormBytes)
+	var err error
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		err = r.ParseMultipartForm(maxFormBytes)
+	} else {
+		err = r.ParseForm()
+	}
+	if err != nil {
+		http.Error(w, "formulaire invalide : "+err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// redirect sends a 303 to an internal path, under the configured base path.
+func (s *server) redirect(w http.ResponseWriter, r *http.Request, path string) {
+	http.Redirect(w, r, s.basePath+path, http.StatusSeeOther)
+}
+
+// normalizeBasePath turns "p4", "/p4/" or "/p4" into "/p4" and "/" into "".
+func normalizeBasePath(p string) string {
+	p = strings.Trim(strings.TrimSpace(p), "/")
+	if p == "" {
+		return ""
+	}
+	return "/" + p
+}
+
+func urlQueryEscape(s string) string {
+	// light helper (avoids importing net/url here)
+	replacer := strings.NewReplacer(" ", "+")
+	return replacer.Replace(s)
+}
+
+func (s *server) handleGame(w http.ResponseWriter, r *http.Request) {
+	g := s.gameForRequest(w, r, false)
+	if s.expiredRedirect(w, r, g) {
+		return
+	}
+	data := s.viewModel(g)
+	// the back button from /result must ask again, not show a stale board
+	w.Header().Set("Cache-Control", "no-store")
+	s.render(w, r, "game", data)
+}
+
+func (s *server) handlePlay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.redirect(w, r, "/game")
+		return
+	}
+	if !parseForm(w, r) {
+		return
+	}
+	g := s.gameForRequest(w, r, false)
+	if s.expiredRedirect(w, r, g) {
+		return
+	}
+	if g.GameOver {
+		s.redirect(w, r, "/result")
+		return
+	}
+
+	colStr := r.FormValue("col")
+	c, err := strconv.Atoi(colStr)
+	if err != nil || c < 0 || c >= g.Cols {
+		s.redirect(w, r, "/game")
+		return
+	}
+
+	if _, ok := landingRow(g, c); !ok {
+		s.redirect(w, r, "/game")
+		return
+	}
+
+	// confirm mode: the first tap (or a tap on another column) only selects
+	if g.ConfirmMoves && g.PendingCol != c {
+		g.PendingCol = c
+		s.redirect(w, r, "/game")
+		return
+	}
+	g.PendingCol = -1
+
+	row, _ := tryPlace(g, c, g.Current)
+
+	// Win / Draw?
+	if s.checkResult(g, row, c, g.Current) {
+		s.redirect(w, r, "/result")
+		return
+	}
+
+	// Switch player
+	g.Current = nextPlayer(g, g.Current)
+
+	// Flip gravity on schedule (see flipPeriod)
+	if flipDue(g, g.Current) {
+		g.GravityUp = !g.GravityUp
+		g.Message = ""
+	}
+
+	// If AI mode and now it's AI's turn, let AI play immediately
+	if s.playAITurn(g) {
+		s.redirect(w, r, "/result")
+		return
+	}
+
+	s.redirect(w, r, "/game")
+}
+
+// playAITurn lets the AI (Yellow) answer in AI mode. It reports whether the
+// game ended on the AI's move.
+func (s *server) playAITurn(g *Game) bool {
+	if g.Mode != "ai" || g.Current != cellY || g.GameOver {
+		return false
+	}
+	aiCol := chooseAIMove(g)
+	if aiCol < 0 {
+		return false
+	}
+	rowAI, ok := tryPlace(g, aiCol, cellY)
+	if !ok {
+		return false
+	}
+	if s.checkResult(g, rowAI, aiCol, cellY) {
+		return true
+	}
+	// switch back to human
+	g.Current = cellR
+	if flipDue(g, g.Current) {
+		g.GravityUp = !g.GravityUp
+		g.Message = ""
+	}
+	return false
+}
+
+// powerUpsPerSide is how many uses of each power-up (column clear, gravity
+// flip) a side gets when the power-up variant is on.
+const powerUpsPerSide = 1
+
+// POST /play/clearcol  (form: col)
+// Power-up: the side to move empties a column of its pieces (blocks stay),
+// which costs its turn.
+func (s *server) handleClearCol(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.redirect(w, r, "/game")
+		return
+	}
+	if !parseForm(w, r) {
+		return
+	}
+	g := s.gameForRequest(w, r, false)
+	if s.expiredRedirect(w, r, g) {
+		return
+	}
+	if g.GameOver {
+		s.redirect(w, r, "/result")
+		return
+	}
+	c, err := strconv.Atoi(r.FormValue("col"))
+	if err != nil || c < 0 || c >= g.Cols || !g.PowerUps || g.Mode == "online" {
+		s.redirect(w, r, "/game")
+		return
+	}
+	left := &g.ClearsLeft.R
+	if g.Current == cellY {
+		left = &g.ClearsLeft.Y
+	}
+	if *left <= 0 || !clearColumn(g.Grid, c, g.GravityUp) {
+		s.redirect(w, r, "/game")
+		return
+	}
+	*left--
+	s.finishPowerUp(w, r, g, Move{Row: -1, Col: c, Kind: "clear"})
+}
+
+// POST /play/flip
+// Power-up: the side to move flips gravity right now; every piece resettles
+// toward the new floor, which can complete lines anywhere on the board.
+func (s *server) handleFlip(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.redirect(w, r, "/game")
+		return
+	}
+	if !parseForm(w, r) {
+		return
+	}
+	g := s.gameForRequest(w, r, false)
+	if s.expiredRedirect(w, r, g) {
+		return
+	}
+	if g.GameOver {
+		s.redirect(w, r, "/result")
+		return
+	}
+	if !g.PowerUps || g.Mode == "online" {
+		s.redirect(w, r, "/game")
+		return
+	}
+	left := &g.FlipsLeft.R
+	if g.Current == cellY {
+		left = &g.FlipsLeft.Y
+	}
+	if *left <= 0 {
+		s.redirect(w, r, "/game")
+		return
+	}
+	*left--
+	g.GravityUp = !g.GravityUp
+	resettleBoard(g.Grid, g.GravityUp)
+	s.finishPowerUp(w, r, g, Move{Row: -1, Col: -1, Kind: "flip"})
+}
+
+// finishPowerUp records a power-up as the mover's turn, then resolves the
+// board like a normal move would (win scan, switch, scheduled flip, AI).
+func (s *server) finishPowerUp(w http.ResponseWriter, r *http.Request, g *Game, m Move) {
+	m.Side, m.At, m.GravityUp = g.Current, time.Now(), g.GravityUp
+	appendMove(g, m)
+	g.PendingCol = -1
+	g.Turns++
+
+	if s.checkBoard(g, g.Current) {
+		s.redirect(w, r, "/result")
+		return
+	}
+	g.Current = opponent(g.Current)
+	if flipDue(g, g.Current) {
+		g.GravityUp = !g.GravityUp
+		g.Message = ""
+	}
+	if s.playAITurn(g) {
+		s.redirect(w, r, "/result")
+		return
+	}
+	s.redirect(w, r, "/game")
+}
+
+// maxHints is how many hints a player may ask for in one game.
+const maxHints = 3
+
+// POST /hint  →  {"col":3,"reason":"...","left":2}
+// Suggests the AI's move for the side to play in the session game. It is a
+// POST because it spends one of the game's hints. The AI only knows how to
+// play against one opponent, so there are no hints with 3 or 4 players.
+func (s *server) handleHint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"err": "POST only"})
+		return
+	}
+	g := s.gameForRequest(w, r, false)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if g.Mode == "online" || g.GameOver || g.Players > 2 {
+		writeJSON(w, http.StatusConflict, map[string]string{"err": "no hint available"})
+		return
+	}
+	if g.HintsUsed >= maxHints {
+		writeJSON(w, http.StatusTooManyRequests, map[string]string{"err": "no hints left"})
+		return
+	}
+
+	// the search plays its candidates out on the board, so it works on a copy
+	me, sim := g.Current, cloneGame(g)
+	col := chooseMove(sim, me)
+	if col < 0 {
+		writeJSON(w, http.StatusConflict, map[string]string{"err": "no legal move"})
+		return
+	}
+	reason := "meilleure position"
+	switch {
+	case winsAt(sim, col, me):
+		reason = "coup gagnant"
+	case winsAt(sim, col, opponent(me)):
+		reason = "bloque une victoire adverse"
+	}
+	g.HintsUsed++
+	writeJSON(w, http.StatusOK, map[string]any{"col": col, "reason": reason, "left": maxHints - g.HintsUsed})
+}
+
+// POST /replay  (form: swap, next; both optional)
+// Another game with the same players, rules and scores on a fresh board.
+// swap trades the colors (local, two players); next plays the next round of
+// the series, where the first move passes to the next color.
+func (s *server) handleReplay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.redirect(w, r, "/game")
+		return
+	}
+	if !parseForm(w, r) {
+		return
+	}
+	g := s.gameForRequest(w, r, false)
+	cfg, scores, series := g.rematchConfig(), g.Scores, g.Series
+	if r.FormValue("swap") != "" && g.Mode == "local" && g.Players == 2 {
+		// the two players trade colors; names and scores follow the players
+		cfg.Player1, cfg.Player2 = cfg.Player2, cfg.Player1
+		scores.R, scores.Y = scores.Y, scores.R
+		series = strings.Map(func(c rune) rune { return rune(opponent(byte(c))) }, series)
+	}
+	if r.FormValue("next") != "" {
+		// next round of a series: same colors, the first move passes on
+		cfg.Starter = nextPlayer(g, g.starter())
+	}
+	*g = *NewGameFromConfig(cfg)
+	g.Scores, g.Series = scores, series
+	s.playAITurn(g)
+	s.redirect(w, r, "/game")
+}
+
+func (s *server) handleReset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.redirect(w, r, "/")
+		return
+	}
+	if !parseForm(w, r) {
+		return
+	}
+	_ = s.gameForRequest(w, r, true) // reset session
+	s.redirect(w, r, "/")
+}
+
+// canReroll reports whether g's blocks may still be rolled again: a local or
+// AI game nobody has played in yet, and not the shared board of the day.
+func canReroll(g *Game) bool {
+	return g.Turns == 0 && !g.GameOver && g.Mode != "online" && g.Daily == ""
+}
+
+// POST /board/reroll  (form: seed, optional)
+// Rolls a new block layout for the session game before its first move,
+// keeping players and rules. 409 once a move has been made.
+func (s *server) handleReroll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.redirect(w, r, "/game")
+		return
+	}
+	if !parseForm(w, r) {
+		return
+	}
+	seed := mrand.Int63()
+	if v := strings.TrimSpace(r.FormValue("seed")); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n == 0 {
+			http.Error(w, "graine invalide", http.StatusBadRequest)
+			return
+		}
+		seed = n
+	}
+	g := s.gameForRequest(w, r, false)
+	if s.expiredRedirect(w, r, g) {
+		return
+	}
+	if !canReroll(g) {
+		http.Error(w, "le plateau ne peut plus être tiré à nouveau", http.StatusConflict)
+		return
+	}
+	n := 0 // a preset position may hold a different count than g.Blocks
+	for _, row := range g.Grid {
+		for _, v := range row {
+			if isBlock(v) {
+				n++
+			}
+		}
+	}
+	rollBlocks(g, n, mrand.New(mrand.NewSource(seed)))
+	g.Seed = seed
+	for i := range g.Grid {
+		g.Start[i] = append(g.Start[i][:0], g.Grid[i]...)
+	}
+	g.PendingCol = -1
+	s.redirect(w, r, "/game")
+}
+
+func (s *server) handleResult(w http.ResponseWriter, r *http.Request) {
+	// default: session game
+	g := s.gameForRequest(w, r, false)
+	if r.URL.Query().Get("code") == "" && s.expiredRedirect(w, r, g) {
+		return
+	}
+	data := s.viewModel(g)
+	shown := g
+
+	code := strings.ToUpper(strings.TrimSpace(r.URL.Query().Get("code")))
+	side := strings.ToUpper(strings.TrimSpace(r.URL.Query().Get("side")))
+
+	if code != "" && (side == "R" || "Y" == side) {
+		// Prefer authoritative lobby state
+		s.mu.Lock()
+		lb, ok := s.lobby(r, code)
+		var gsrc *Game
+		if ok && lb.Game != nil {
+			// copy to avoid races while templating
+			gcopy := *lb.Game
+			gsrc = &gcopy
+		}
+		s.mu.Unlock()
+
+		if gsrc != nil {
+			data = s.viewModel(gsrc)
+			shown = gsrc
+		}
+		data["IsOnline"] = true
+		data["LobbyCode"] = code
+		data["ThisIsRed"] = (side == "R")
+	}
+
+	// announcements only cover the two-player score for now
+	if shown.Players <= 2 {
+		data["ScoreLine"] = scoreAnnouncement(langFor(r), shown.Player1, shown.Player2, shown.Scores.R, shown.Scores.Y)
+	}
+	s.render(w, r, "result", data)
+}
+
+func (s *server) checkResult(g *Game, r, c int, p byte) (over bool) {
+	defer func() {
+		if over {
+			s.countGameOver(g)
+		}
+	}()
+	line := winningLine(g.Grid, r, c, p, g.lens())
+	if g.Endless {
+		if line != nil {
+			scoreEndless(g, p, line)
+		}
+		return endlessOver(g)
+	}
+	// a line wins even when it also fills the last free cell
+	if line != nil {
+		s.awardWin(g, p, line)
+		return true
+	}
+	if noMoveLeft(g) {
+		g.GameOver = true
+		g.GameOverReason = reasonDraw
+		g.Message = "🤝 Égalité !"
+		return true
+	}
+	if g.EarlyDraw && g.Players <= 2 && isDeadPosition(g.Grid, g.lens(), opponent(p)) {
+		g.GameOver = true
+		g.GameOverReason = reasonDraw
+		g.Message = "🤝 Égalité ! (plus aucun alignement possible)"
+		return true
+	}
+	return turnCapReached(g)
+}
+
+// turnCapReached ends g as a draw once it has played MaxTurns turns.
+func turnCapReached(g *Game) bool {
+	if g.MaxTurns <= 0 || g.Turns < g.MaxTurns {
+		return false
+	}
+	g.GameOver = true
+	g.GameOverReason = reasonDraw
+	g.Message = fmt.Sprintf("🤝 Égalité ! (limite de %d tours atteinte)", g.MaxTurns)
+	return true
+}
+
+// checkBoard is checkResult for moves that can change several cells at once
+// (power-ups): it scans the whole board, the mover's lines taking priority.
+func (s *server) checkBoard(g *Game, mover byte) (over bool) {
+	defer func() {
+		if over {
+			s.countGameOver(g)
+		}
+	}()
+	for _, p := range []byte{mover, opponent(mover)} {
+		line := findWin(g.Grid, p, g.lens())
+		switch {
+		case line == nil:
+		case g.Endless:
+			scoreEndless(g, p, line)
+		default:
+			s.awardWin(g, p, line)
+			return true
+		}
+	}
+	if g.Endless {
+		return endlessOver(g)
+	}
+	if noMoveLeft(g) {
+		g.GameOver = true
+		g.GameOverReason = reasonDraw
+		g.Message = "🤝 Égalité !"
+		return true
+	}
+	return turnCapReached(g)
+}
+
+func (s *server) awardWin(g *Game, p byte, line [][2]int) {
+	g.WinLine = append([][2]int(nil), line[:g.lens().along(line)]...)
+	for _, rc := range g.WinLine {
+		g.Winning[rc[0]][rc[1]] = true
+	}
+	g.GameOver = true
+	g.GameOverReason = reasonConnect
+	g.LastPlayed = p
+	addScore(g, p)
+	g.Message = ""
+}
+
+// endlessTurnsPerCell sets an endless game's default turn cap from its size.
+const endlessTurnsPerCell = 2
+
+// scoreEndless gives p a point for line, clears the line and lets the
+// columns it crossed settle. Lines formed by the settling score for their
+// own color, until the board is quiet.
+func scoreEndless(g *Game, p byte, line [][2]int) {
+	for line != nil {
+		g.Points.add(p)
+		g.PointSeq.set(p, g.Points.R+g.Points.Y+g.Points.G+g.Points.B)
+		touched := make([]bool, g.Cols)
+		for _, rc := range line {
+			g.Grid[rc[0]][rc[1]] = cellEmpty
+			touched[rc[1]] = true
+		}
+		for c, t := range touched {
+			if t {
+				resettleColumn(g.Grid, c, g.GravityUp)
+			}
+		}
+		line = nil
+		for _, q := range turnOrder[:g.Players] {
+			if l := findWin(g.Grid, q, g.lens()); l != nil {
+				p, line = q, l
+				break
+			}
+		}
+	}
+}
+
+// endlessOver ends an endless game once the board is full or the turn cap
+// is reached: the most points wins the round. A shared lead is a draw
+// between two players, or when nobody scored. With three or four players,
+// the leader who completed a line most recently (see PointSeq) wins it: the
+// others at the top had their chance to pull ahead since.
+func endlessOver(g *Game) bool {
+	if !noMoveLeft(g) && g.Turns < g.MaxTurns {
+		return false
+	}
+	g.GameOver = true
+	best, leaders := -1, []byte(nil)
+	for _, p := range turnOrder[:g.Players] {
+		switch n := g.Points.of(p); {
+		case n > best:
+			best, leaders = n, []byte{p}
+		case n == best:
+			leaders = append(leaders, p)
+		}
+	}
+	if len(leaders) > 1 && (g.Players == 2 || best == 0) {
+		g.GameOverReason = reasonDraw
+		g.Message = fmt.Sprintf("🤝 Égalité aux points (%d chacun) !", best)
+		return true
+	}
+	leader := leaders[0]
+	for _, p := range leaders[1:] {
+		if g.PointSeq.of(p) > g.PointSeq.of(leader) {
+			leader = p
+		}
+	}
+	g.GameOverReason = reasonConnect
+	g.LastPlayed = leader
+	addScore(g, leader)
+	g.Message = fmt.Sprintf("🏆 %s l’emporte aux points (%d) !", playerName(g, leader), best)
+	if len(leaders) > 1 {
+		g.Message = fmt.Sprintf("🏆 %s l’emporte aux points (%d, à égalité avec %d autre(s) joueur(s), départagés par la ligne la plus récente) !",
+			playerName(g, leader), best, len(leaders)-1)
+	}
+	return true
+}
+
+// findWin scans the whole board for a completed line of p.
+func findWin(grid [][]byte, p byte, lens lineLens) [][2]int {
+	for r := range grid {
+		for c, v := range grid[r] {
+			if v != p {
+				continue
+			}
+			if line := winningLine(grid, r, c, p, lens); line != nil {
+				return line
+			}
+		}
+	}
+	return nil
+}
+
+func enablePowerUps(g *Game, on bool) {
+	n := 0
+	if on {
+		n = powerUpsPerSide
+	}
+	g.PowerUps = on
+	g.ClearsLeft.R, g.ClearsLeft.Y = n, n
+	g.FlipsLeft.R, g.FlipsLeft.Y = n, n
+}
+
+// clearColumn removes every piece of col (blocks stay) and resettles what is
+// left. It reports false when the column held no piece.
+func clearColumn(grid [][]byte, col int, gravityUp bool) bool {
+	cleared := false
+	for r := range grid {
+		if v := grid[r][col]; isPiece(v) {
+			grid[r][col] = cellEmpty
+			cleared = true
+		}
+	}
+	if cleared {
+		resettleColumn(grid, col, gravityUp)
+	}
+	return cleared
+}
+
+// resettleColumn drops every piece of col again, the one nearest the floor
+// first, so pieces close gaps exactly like fresh drops would (blocks stay).
+// A solid block acts as the floor of the cells above it.
+func resettleColumn(grid [][]byte, col int, gravityUp bool) {
+	h := len(grid)
+	at := func(i int) int { // i-th cell from the floor
+		if gravityUp {
+			return i
+		}
+		return h - 1 - i
+	}
+	next := 0 // lowest free slot of the current segment
+	for i := 0; i < h; i++ {
+		r := at(i)
+		switch v := grid[r][col]; {
+		case v == cellSolid:
+			next = i + 1
+		case isPiece(v):
+			grid[r][col] = cellEmpty
+			for grid[at(next)][col] == cellBlk {
+				next++
+			}
+			grid[at(next)][col] = v
+			next++
+		}
+	}
+}
+
+// resettleBoard lets every column settle toward the current gravity.
+func resettleBoard(grid [][]byte, gravityUp bool) {
+	if len(grid) == 0 {
+		return
+	}
+	for c := range grid[0] {
+		resettleColumn(grid, c, gravityUp)
+	}
+}
+
+// nextPlayer is the color to move after p, rotating through the game's
+// active colors.
+func nextPlayer(g *Game, p byte) byte {
+	n := g.Players
+	if n < 2 || n > len(turnOrder) {
+		n = 2
+	}
+	for i, c := range turnOrder[:n] {
+		if c == p {
+			return turnOrder[(i+1)%n]
+		}
+	}
+	return cellR
+}
+
+// firstPlayer is the coin flip of a RandomStart game: the color that moves
+// first, one of the game's players, the same for the same seed. It draws
+// from its own source so the coin says nothing about the block layout.
+func firstPlayer(seed int64, players int) byte {
+	if players < 2 || players > len(turnOrder) {
+		players = 2
+	}
+	return turnOrder[mrand.New(mrand.NewSource(^seed)).Intn(players)]
+}
+
+// starter is the color that moved (or is to move) first in g.
+func (g *Game) starter() byte {
+	if len(g.Moves) > 0 {
+		return g.Moves[0].Side
+	}
+	if g.Turns == 0 {
+		return g.Current
+	}
+	return cellR
+}
+
+// coinStarter is the name announced by the game page while the first round
+// of a RandomStart game is played, "" otherwise.
+func coinStarter(g *Game) string {
+	if !g.RandomStart || g.Turns >= g.Players || g.GameOver {
+		return ""
+	}
+	return playerName(g, g.starter())
+}
+
+// defaultAIName is Yellow's name in AI mode when the player picks none.
+const defaultAIName = "RoboPower"
+
+// nameAI gives the AI's side (Yellow) its name.
+func nameAI(g *Game, name string) {
+	if name == "" {
+		name = defaultAIName
+	}
+	g.AIName, g.Player2 = name, name
+}
+
+// isAISide reports whether p is played by the AI in g.
+func (g *Game) isAISide(p byte) bool {
+	return g.Mode == "ai" && p == cellY
+}
+
+// playerName is the display name of color p.
+func playerName(g *Game, p byte) string {
+	switch p {
+	case cellY:
+		return g.Player2
+	case cellG:
+		return g.Player3
+	case cellB:
+		return g.Player4
+	}
+	return g.Player1
+}
+
+// tally counts wins (or endless-mode points) per color.
+type tally struct{ R, Y, G, B int }
+
+func (t *tally) add(p byte) {
+	switch p {
+	case cellR:
+		t.R++
+	case cellY:
+		t.Y++
+	case cellG:
+		t.G++
+	case cellB:
+		t.B++
+	}
+}
+
+func (t *tally) set(p byte, n int) {
+	switch p {
+	case cellR:
+		t.R = n
+	case cellY:
+		t.Y = n
+	case cellG:
+		t.G = n
+	case cellB:
+		t.B = n
+	}
+}
+
+func (t tally) of(p byte) int {
+	switch p {
+	case cellY:
+		return t.Y
+	case cellG:
+		return t.G
+	case cellB:
+		return t.B
+	}
+	return t.R
+}
+
+// addScore credits a win to color p.
+func addScore(g *Game, p byte) {
+	g.Scores.add(p)
+	g.Series += string(p)
+}
+
+func opponent(p byte) byte {
+	if p == cellR {
+		return cellY
+	}
+	return cellR
+}
+
+// isDeadPosition reports whether neither side can still complete a line
+// (lens long in its direction), next being the side to move. A line stays
+// open for p while it holds no block and no opposing piece, and p still has
+// enough moves left to fill its empty cells. Every empty cell is counted as
+// fillable, though a cell walled in by solid blocks never is: that only
+// over-counts, so the check may call a dead position live, never the reverse.
+func isDeadPosition(grid [][]byte, lens lineLens, next byte) bool {
+	empty := 0
+	for r := range grid {
+		for _, v := range grid[r] {
+			if v == cellEmpty {
+				empty++
+			}
+		}
+	}
+	movesLeft := map[byte]int{next: (empty + 1) / 2, opponent(next): empty / 2}
+	for _, p := range []byte{cellR, cellY} {
+		if minMissing(grid, lens, p) <= movesLeft[p] {
+			return false
+		}
+	}
+	return true
+}
+
+// minMissing returns how many more pieces p needs to complete its cheapest
+// still-open line (a large number when every line is dead).
+func minMissing(grid [][]byte, lens lineLens, p byte) int {
+	best := 1 << 30
+	h := len(grid)
+	if h == 0 {
+		return best
+	}
+	w := len(grid[0])
+	for r := 0; r < h; r++ {
+		for c := 0; c < w; c++ {
+			for k, d := range lineDirs {
+				missing, open := 0, true
+				for i := 0; i < lens[k] && open; i++ {
+					rr, cc := r+d[0]*i, c+d[1]*i
+					if rr < 0 || rr >= h || cc < 0 || cc >= w {
+						open = false
+						break
+					}
+					switch grid[rr][cc] {
+					case p:
+					case cellEmpty:
+						missing++
+					default:
+						open = false
+					}
+				}
+				if open && missing < best {
+					best = missing
+				}
+			}
+		}
+	}
+	return best
+}
+
+/*** helpers ***/
+
+// cloneGame deep-copies a game so the copy shares no grid or history with
+// the original (e.g. a lobby's game snapshotted into a session).
+func cloneGame(g *Game) *Game {
+	c := *g
+	c.Grid = make([][]byte, len(g.Grid))
+	for i := range g.Grid {
+		c.Grid[i] = append([]byte(nil), g.Grid[i]...)
+	}
+	c.Winning = make([][]bool, len(g.Winning))
+	for i := range g.Winning {
+		c.Winning[i] = append([]bool(nil), g.Winning[i]...)
+	}
+	c.WinLine = append([][2]int(nil), g.WinLine...)
+	c.Moves = append([]Move(nil), g.Moves...)
+	if g.Start != nil {
+		c.Start = make([][]byte, len(g.Start))
+		for i := range g.Start {
+			c.Start[i] = append([]byte(nil), g.Start[i]...)
+		}
+	}
+	return &c
+}
+
+func configByDifficulty(d string) (rows, cols, blocks int) {
+	switch d {
+	case "hard":
+		return 6, 9, 7
+	case "normal":
+		return 6, 8, 5
+	default: // easy
+		return 6, 7, 3
+	}
+}
+
+// variant is a named, balanced bundle of rules chosen from a single dropdown.
+// The difficulty presets map onto the same struct (see rulesFor).
+type variant struct {
+	Name               string
+	Label              string
+	Rows, Cols, Blocks int
+	WinLen             int
+	WinBy              dirLens
+	FlipEvery          int // 0 = gravity never flips
+}
+
+var variants = []variant{
+	{Name: "classic", Label: "Classique — 6×7 • sans blocs • sans inversion", Rows: 6, Cols: 7, Blocks: 0, WinLen: 4, FlipEvery: 0},
+	{Name: "chaos", Label: "Chaos — 6×8 • 10 blocs • inversion tous les 3", Rows: 6, Cols: 8, Blocks: 10, WinLen: 4, FlipEvery: 3},
+	{Name: "marathon", Label: "Marathon — 8×10 • 6 blocs • aligner 5", Rows: 8, Cols: 10, Blocks: 6, WinLen: 5, FlipEvery: 5},
+	{Name: "diagonals", Label: "Diagonales — 7×8 • 4 blocs • aligner 5 en diagonale", Rows: 7, Cols: 8, Blocks: 4, WinLen: 4, WinBy: dirLens{D: 5}, FlipEvery: 5},
+}
+
+func variantConfig(name string) (variant, bool) {
+	for _, v := range variants {
+		if v.Name == name {
+			return v, true
+		}
+	}
+	return variant{}, false
+}
+
+// rulesFor returns the named variant if it exists, else the difficulty preset
+// with the default rules (connect 4, flip every 5).
+func rulesFor(diff, variantName string) variant {
+	if v, ok := variantConfig(variantName); ok {
+		return v
+	}
+	rows, cols, blocks := configByDifficulty(diff)
+	return variant{Rows: rows, Cols: cols, Blocks: blocks, WinLen: 4, FlipEvery: 5}
+}
+
+// config is the GameConfig for the board rules of v.
+func (v variant) config() GameConfig {
+	return GameConfig{
+		Rows: v.Rows, Cols: v.Cols, Blocks: v.Blocks,
+		WinLen: v.WinLen, WinBy: v.WinBy, FlipEvery: v.FlipEvery, Variant: v.Name,
+	}
+}
+
+// Gravity flip modes: every FlipEvery moves, whoever made them, or every
+// FlipEvery full rounds so each player sees the same number of moves
+// between two flips.
+const (
+	flipPerMove  = "per-move"
+	flipPerRound = "per-round"
+)
+
+// flipMode is g.FlipMode with the default filled in.
+func (g *Game) flipMode() string {
+	if g.FlipMode == "" {
+		return flipPerMove
+	}
+	return g.FlipMode
+}
+
+// flipPeriod is the number of moves between two scheduled flips, 0 when
+// gravity never flips.
+func (g *Game) flipPeriod() int {
+	if g.FlipMode == flipPerRound {
+		return g.FlipEvery * g.Players
+	}
+	return g.FlipEvery
+}
+
+func shouldFlip(g *Game) bool {
+	n := g.flipPeriod()
+	return n > 0 && g.Turns%n == 0
+}
+
+// flipDue reports whether gravity flips before next plays: the schedule of
+// shouldFlip, except that with FlipGuard a flip never scatters a win next
+// could complete right now.
+func flipDue(g *Game, next byte) bool {
+	if !shouldFlip(g) {
+		return false
+	}
+	return !g.FlipGuard || !hasWinningDrop(g, next)
+}
+
+// hasWinningDrop reports whether p wins by dropping somewhere, under the
+// current gravity (the threat scan the AI runs before every move).
+func hasWinningDrop(g *Game, p byte) bool {
+	for c := 0; c < g.Cols; c++ {
+		if winsAt(g, c, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// GameConfig fully describes a new game, so NewGameFromConfig leaves
+// nothing for callers to patch afterwards. Zero values pick the defaults:
+// align 4, two players, local mode, first AI personality, random layout.
+type GameConfig struct {
+	Rows, Cols  int
+	Blocks      int
+	SolidBlocks bool // blocks stop falling pieces (cellSolid) instead of cellBlk
+	WinLen      int
+	WinBy       dirLens
+	FlipEvery   int    // 0 = gravity never flips
+	FlipMode    string // flipPerMove if empty
+	Variant     string
+	Difficulty  string
+	Mode        string // "local" | "ai" | "online"
+
+	Players                            int // 2 to 4, see turnOrder
+	Player1, Player2, Player3, Player4 string
+
+	AI            aiPersonality
+	AIName        string // ai mode: replaces Player2, defaultAIName if empty
+	MaxTurns      int
+	ConfirmMoves  bool
+	EarlyDraw     bool // two players only
+	FlipGuard     bool
+	CenterOpening bool
+	RandomStart   bool
+	Starter       byte // who moves first: Red (or RandomStart's coin) if 0
+	PowerUps      bool // two players only
+	Endless       bool // MaxTurns defaults to endlessTurnsPerCell per cell
+
+	LobbyCode string
+
+	// Seed makes the block layout reproducible; 0 draws a random one.
+	Seed  int64
+	Daily string // see Game.Daily
+	// Grid is a preset layout (e.g. /start/position) used instead of
+	// rolling Blocks; it is copied.
+	Grid [][]byte
+}
+
+// defaultConfig is the game a fresh session starts with.
+func defaultConfig() GameConfig {
+	rows, cols, blocks := configByDifficulty("easy")
+	return GameConfig{Rows: rows, Cols: cols, Blocks: blocks, FlipEvery: 5}
+}
+
+// NewGameFromConfig builds a ready-to-play game from cfg.
+func NewGameFromConfig(cfg GameConfig) *Game {
+	if cfg.WinLen == 0 {
+		cfg.WinLen = 4
+	}
+	if cfg.Mode == "" {
+		cfg.Mode = "local"
+	}
+	if cfg.Players == 0 {
+		cfg.Players = 2
+	}
+	if cfg.AI.Name == "" {
+		cfg.AI = aiPersonalities[0]
+	}
+	if cfg.Mode == "ai" && cfg.AI.Selective == 0 {
+		cfg.AI.Selective = selectiveDepth[cfg.Difficulty]
+	}
+	if cfg.Seed == 0 {
+		cfg.Seed = mrand.Int63()
+	}
+	if len(cfg.Grid) == 0 {
+		cfg.Grid = nil // an empty preset would leave no board at all
+	}
+	rows, cols := cfg.Rows, cfg.Cols
+	if cfg.Grid != nil {
+		rows, cols = len(cfg.Grid), len(cfg.Grid[0])
+	}
+
+	g := &Game{
+		Rows:       rows,
+		Cols:       cols,
+		Grid:       make([][]byte, rows),
+		Winning:    make([][]bool, rows),
+		Current:    cellR,
+		Mode:       cfg.Mode,
+		CreatedAt:  time.Now(),
+		WinLen:     cfg.WinLen,
+		WinBy:      cfg.WinBy,
+		FlipEvery:  cfg.FlipEvery,
+		FlipMode:   cfg.FlipMode,
+		Variant:    cfg.Variant,
+		Difficulty: cfg.Difficulty,
+		AI:         cfg.AI,
+		Players:    cfg.Players,
+		Player1:    cfg.Player1,
+		Player2:    cfg.Player2,
+		Player3:    cfg.Player3,
+		Player4:    cfg.Player4,
+		MaxTurns:   cfg.MaxTurns,
+		LobbyCode:  cfg.LobbyCode,
+		Blocks:     cfg.Blocks,
+		Seed:       cfg.Seed,
+		Daily:      cfg.Daily,
+
+		SolidBlocks: cfg.SolidBlocks,
+
+		ConfirmMoves: cfg.ConfirmMoves,
+		EarlyDraw:    cfg.EarlyDraw && cfg.Players == 2 && !cfg.Endless,
+		Endless:      cfg.Endless,
+		FlipGuard:    cfg.FlipGuard,
+		PendingCol:   -1,
+
+		CenterOpening: cfg.CenterOpening,
+		RandomStart:   cfg.RandomStart,
+	}
+	switch {
+	case cfg.Starter != 0:
+		g.Current = cfg.Starter
+	case cfg.RandomStart:
+		g.Current = firstPlayer(cfg.Seed, cfg.Players)
+	}
+	if g.Mode == "ai" {
+		nameAI(g, cfg.AIName)
+	}
+	if g.Endless && g.MaxTurns <= 0 {
+		// cleared lines keep the board from filling up: make sure it ends
+		g.MaxTurns = endlessTurnsPerCell * rows * cols
+	}
+	for i := range g.Grid {
+		g.Grid[i] = make([]byte, cols)
+		g.Winning[i] = make([]bool, cols)
+		if cfg.Grid != nil {
+			copy(g.Grid[i], cfg.Grid[i])
+		}
+	}
+	if cfg.Grid == nil {
+		rollBlocks(g, cfg.Blocks, mrand.New(mrand.NewSource(cfg.Seed)))
+	}
+	g.Start = make([][]byte, rows)
+	for i := range g.Grid {
+		g.Start[i] = append([]byte(nil), g.Grid[i]...)
+	}
+	enablePowerUps(g, cfg.PowerUps && cfg.Players == 2)
+	return g
+}
+
+// rematchConfig is the config for another game with g's settings: same
+// board size and rules, a fresh layout. Scores are carried by the caller.
+func (g *Game) rematchConfig() GameConfig {
+	return GameConfig{
+		Rows: g.Rows, Cols: g.Cols, Blocks: g.Blocks, SolidBlocks: g.SolidBlocks,
+		WinLen: g.WinLen, WinBy: g.WinBy, FlipEvery: g.FlipEvery, FlipMode: g.FlipMode,
+		Variant: g.Variant, Difficulty: g.Difficulty, Mode: g.Mode,
+		Players: g.Players,
+		Player1: g.Player1, Player2: g.Player2, Player3: g.Player3, Player4: g.Player4,
+		AI: g.AI, AIName: g.AIName, MaxTurns: g.MaxTurns,
+		ConfirmMoves: g.ConfirmMoves, EarlyDraw: g.EarlyDraw, PowerUps: g.PowerUps,
+		Endless: g.Endless, FlipGuard: g.FlipGuard, CenterOpening: g.CenterOpening,
+		RandomStart: g.RandomStart, LobbyCode: g.LobbyCode,
+	}
+}
+
+// Bounds accepted by parsePosition.
+const (
+	minBoardSide = 4
+	maxBoardSide = 12
+)
+
+// Block density (% of cells) bounds for the start form: the slider starts at
+// defaultBlockDensity, and blocksForDensity still caps the count at maxBlocks.
+const (
+	defaultBlockDensity = 15
+	maxBlockDensity     = 40
+)
+
+// maxBlocks is the most blocks a rows×cols board takes and stays playable.
+func maxBlocks(rows, cols int) int {
+	return rows * cols / 3
+}
+
+// blocksForDensity turns a block density (% of cells) into a block count
+// for a rows×cols board, rounded to the nearest block and capped at
+// maxBlocks.
+func blocksForDensity(rows, cols, pct int) int {
+	return min((rows*cols*pct+50)/100, maxBlocks(rows, cols))
+}
+
+// parsePosition reads a board written row by row from the top, rows separated
+// by '/' or newlines, one of R, Y, X or '.' per cell.
+func parsePosition(text string) ([][]byte, error) {
+	text = strings.NewReplacer("\r", "", "\n", "/", " ", "").Replace(strings.TrimSpace(text))
+	lines := strings.Split(strings.Trim(text, "/"), "/")
+	if len(lines) < minBoardSide || len(lines) > maxBoardSide {
+		return nil, fmt.Errorf("entre %d et %d lignes attendues", minBoardSide, maxBoardSide)
+	}
+	cols := len(lines[0])
+	if cols < minBoardSide || cols > maxBoardSide {
+		return nil, fmt.Errorf("entre %d et %d colonnes attendues", minBoardSide, maxBoardSide)
+	}
+	grid := make([][]byte, len(lines))
+	for r, line := range lines {
+		if len(line) != cols {
+			return nil, fmt.Errorf("ligne %d : %d cases au lieu de %d", r+1, len(line), cols)
+		}
+		grid[r] = make([]byte, cols)
+		for c := 0; c < cols; c++ {
+			switch ch := line[c] &^ 0x20; ch { // upper-case letters
+			case cellR, cellY, cellBlk, cellSolid:
+				grid[r][c] = ch
+			default:
+				if line[c] != '.' {
+					return nil, fmt.Errorf("case invalide %q", line[c])
+				}
+			}
+		}
+	}
+	return grid, nil
+}
+
+// gameFromPosition builds a game on a parsed layout.
+func gameFromPosition(text string) (*Game, error) {
+	grid, err := parsePosition(text)
+	if err != nil {
+		return nil, err
+	}
+	return gameFromGrid(GameConfig{FlipEvery: 5, Difficulty: "custom", Grid: grid})
+}
+
+// gameFromGrid builds a game on the preset layout cfg.Grid. Red always
+// starts, so there are as many Reds as Yellows (Red to move) or one more
+// (Yellow to move).
+func gameFromGrid(cfg GameConfig) (*Game, error) {
+	grid := cfg.Grid
+	var nR, nY int
+	for r := range grid {
+		for _, v := range grid[r] {
+			switch v {
+			case cellR:
+				nR++
+			case cellY:
+				nY++
+			}
+		}
+	}
+	if nR != nY && nR != nY+1 {
+		return nil, fmt.Errorf("parité impossible : %d rouges pour %d jaunes", nR, nY)
+	}
+
+	g := NewGameFromConfig(cfg)
+	if !hasWinnableLine(grid, g.lens().shortest()) {
+		return nil, errors.New("aucun alignement possible sur ce plateau")
+	}
+	for r := range grid {
+		for c, v := range grid[r] {
+			if isPiece(v) && winningLine(grid, r, c, v, g.lens()) != nil {
+				return nil, errors.New("la position est déjà gagnée")
+			}
+		}
+	}
+	if isDraw(grid) {
+		return nil, errors.New("le plateau est déjà plein")
+	}
+	g.Turns = nR + nY
+	if nR > nY {
+		g.Current = cellY
+	}
+	g.GravityUp = g.flipPeriod() > 0 && (g.Turns/g.flipPeriod())%2 == 1
+	return g, nil
+}
+
+// maxBlockRolls bounds how many layouts rollBlocks tries before giving up
+// and keeping the last one.
+const maxBlockRolls = 20
+
+// minFairness is the lowest boardFairness rollBlocks accepts.
+const minFairness = 0.8
+
+// rollBlocks (re)places n blocks on an otherwise empty grid, retrying while
+// the layout leaves no room for a line of g.WinLen, hands a side an opening
+// threat or gives the first mover a clearly better opening than usual.
+func rollBlocks(g *Game, n int, rng *mrand.Rand) {
+	for try := 0; try < maxBlockRolls; try++ {
+		for r := range g.Grid {
+			for c := range g.Grid[r] {
+				g.Grid[r][c] = cellEmpty
+			}
+		}
+		kind := cellBlk
+		if g.SolidBlocks {
+			kind = cellSolid
+		}
+		placeBlocks(g.Grid, n, kind, rng)
+		if hasWinnableLine(g.Grid, g.lens().shortest()) && !hasOpeningThreat(g) &&
+			boardFairness(g.Grid, g.lens().shortest(), g.GravityUp) >= minFairness {
+			return
+		}
+	}
+}
+
+// hasWinnableLine reports whether some straight line of winLen cells is free
+// of blocks, i.e. whether a win is still geometrically possible.
+func hasWinnableLine(grid [][]byte, winLen int) bool {
+	h := len(grid)
+	if h == 0 || winLen <= 0 {
+		return false
+	}
+	w := len(grid[0])
+	dirs := [][2]int{{0, 1}, {1, 0}, {1, 1}, {1, -1}}
+	for r := 0; r < h; r++ {
+		for c := 0; c < w; c++ {
+			for _, d := range dirs {
+				ok := true
+				for i := 0; i < winLen && ok; i++ {
+					rr, cc := r+d[0]*i, c+d[1]*i
+					ok = rr >= 0 && rr < h && cc >= 0 && cc < w && !isBlock(grid[rr][cc])
+				}
+				if ok {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// hasOpeningThreat reports whether the side to move on g's fresh board can
+// force a line with its very first moves (as many as the shortest line
+// needs), whatever the other side answers: blocks can shorten columns so
+// that both ends of an open line are playable at once. The board is left as
+// found.
+func hasOpeningThreat(g *Game) bool {
+	n := g.lens().shortest()
+	if g.Endless || g.Players > 2 || n <= 1 {
+		return false
+	}
+	return winsInLine(g, g.Current, n, nil)
+}
+
+// winsInLine reports whether me, to move, wins within left more moves of
+// its own that all land, with mine (its pieces so far), in one line of the
+// shortest length. Moves off that line cannot help such a quick win, which
+// keeps the search small.
+func winsInLine(g *Game, me byte, left int, mine [][2]int) bool {
+	op := opponent(me)
+	for c := 0; c < g.Cols; c++ {
+		row, ok := landingRow(g, c)
+		if !ok {
+			continue
+		}
+		cells := append(mine[:len(mine):len(mine)], [2]int{row, c})
+		if !sharesOpenLine(g, cells, op) {
+			continue
+		}
+		win, undo, _ := simTurn(g, c, me)
+		forced := win
+		if !win && left > 1 {
+			forced = true
+			replies := 0
+			for c2 := 0; c2 < g.Cols && forced; c2++ {
+				opWin, undoOp, ok := simTurn(g, c2, op)
+				if !ok {
+					continue
+				}
+				replies++
+				forced = !opWin && winsInLine(g, me, left-1, cells)
+				undoOp()
+			}
+			forced = forced && replies > 0
+		}
+		undo()
+		if forced {
+			return true
+		}
+	}
+	return false
+}
+
+// sharesOpenLine reports whether cells all fit in one line of the shortest
+// length that holds no block and no piece of op.
+func sharesOpenLine(g *Game, cells [][2]int, op byte) bool {
+	lens := g.lens()
+	n := lens.shortest()
+	for k, d := range lineDirs {
+		if lens[k] != n {
+			continue
+		}
+		// every window along d that covers the first cell
+		for back := 0; back < n; back++ {
+			r0, c0 := cells[0][0]-d[0]*back, cells[0][1]-d[1]*back
+			open := true
+			for i := 0; i < n && open; i++ {
+				rr, cc := r0+d[0]*i, c0+d[1]*i
+				open = rr >= 0 && rr < g.Rows && cc >= 0 && cc < g.Cols && !isBlock(g.Grid[rr][cc]) && g.Grid[rr][cc] != op
+			}
+			for _, rc := range cells[1:] {
+				i := rc[0] - r0
+				if d[0] == 0 {
+					i = rc[1] - c0
+				}
+				open = open && i >= 0 && i < n && rc == [2]int{r0 + d[0]*i, c0 + d[1]*i}
+			}
+			if open {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// lineMap counts, for every cell, the block-free lines of winLen cells
+// through it: the positional worth of owning that cell.
+func lineMap(grid [][]byte, winLen int) [][]int {
+	if len(grid) == 0 {
+		return nil
+	}
+	h, w := len(grid), len(grid[0])
+	m := make([][]int, h)
+	for r := range m {
+		m[r] = make([]int, w)
+	}
+	dirs := [][2]int{{0, 1}, {1, 0}, {1, 1}, {1, -1}}
+	for r := 0; r < h; r++ {
+		for c := 0; c < w; c++ {
+			for _, d := range dirs {
+				er, ec := r+d[0]*(winLen-1), c+d[1]*(winLen-1)
+				if er >= h || ec < 0 || ec >= w {
+					continue
+				}
+				free := true
+				for i := 0; i < winLen && free; i++ {
+					free = !isBlock(grid[r+d[0]*i][c+d[1]*i])
+				}
+				for i := 0; i < winLen && free; i++ {
+					m[r+d[0]*i][c+d[1]*i]++
+				}
+			}
+		}
+	}
+	return m
+}
+
+// openingEdge is how much the best first move beats an average one: the
+// lineMap weight of the best landing cell over the mean of all of them
+// (1 = every opening is worth the same).
+func openingEdge(grid [][]byte, winLen int, gravityUp bool) float64 {
+	if len(grid) == 0 {
+		return 1
+	}
+	m := lineMap(grid, winLen)
+	best, sum, n := 0, 0, 0
+	for c := range grid[0] {
+		r := dropRow(grid, c, gravityUp)
+		if r == -1 {
+			continue
+		}
+		best = max(best, m[r][c])
+		sum += m[r][c]
+		n++
+	}
+	if sum == 0 {
+		return 1
+	}
+	return float64(best*n) / float64(sum)
+}
+
+// boardFairness compares the first mover's edge on grid with the one the
+// same board has without blocks: 1 means the blocks add no advantage,
+// lower values mean a layout that favors whoever starts.
+func boardFairness(grid [][]byte, winLen int, gravityUp bool) float64 {
+	bare := make([][]byte, len(grid))
+	for r := range bare {
+		bare[r] = make([]byte, len(grid[r]))
+	}
+	f := openingEdge(bare, winLen, gravityUp) / openingEdge(grid, winLen, gravityUp)
+	return math.Min(f, 1)
+}
+
+func placeBlocks(grid [][]byte, n int, kind byte, rng *mrand.Rand) {
+	if len(grid) == 0 || len(grid[0]) == 0 {
+		return
+	}
+	h, w := len(grid), len(grid[0])
+	tries := n * 10
+	for n > 0 && tries > 0 {
+		tries--
+		r := rng.Intn(h)
+		c := rng.Intn(w)
+		if grid[r][c] == cellEmpty {
+			grid[r][c] = kind
+			n--
+		}
+	}
+}
+
+// dropRow choisit la case d'arrivée dans la colonne col.
+// Règle custom : rien ne bloque le chemin (ni R/Y ni X).
+// On atterrit sur la case VIDE la plus éloignée dans le sens de la gravité.
+// - Gravité normale (down)  : la case vide la PLUS BASSE
+// - Gravité inversée (up)   : la case vide la PLUS HAUTE
+// On ne peut pas atterrir sur une case 'X' (mais on peut "passer à travers").
+// Un bloc plein 'S' arrête la chute : on atterrit au-dessus (ou en dessous).
+func dropRow(grid [][]byte, col int, gravityUp bool) int {
+	h := len(grid)
+	if h == 0 || col < 0 || col >= len(grid[0]) {
+		return -1
+	}
+
+	// on part du bord d'entrée et on avance jusqu'au premier bloc plein
+	r, step := 0, 1
+	if gravityUp {
+		r, step = h-1, -1
+	}
+	row := -1
+	for ; r >= 0 && r < h && grid[r][col] != cellSolid; r += step {
+		if grid[r][col] == cellEmpty {
+			row = r
+		}
+	}
+	return row
+}
+
+// landingRow is the single playability check shared by the play handlers,
+// the disabled-column flags and the AI: a column is playable iff dropRow
+// finds an empty cell the piece can reach. A column holding only blocks (or
+// full) is never playable.
+func landingRow(g *Game, col int) (int, bool) {
+	if col < 0 || col >= g.Cols || !openingAllows(g, col) {
+		return -1, false
+	}
+	r := dropRow(g.Grid, col, g.GravityUp)
+	return r, r != -1
+}
+
+// openingAllows applies CenterOpening: on the first move only the center
+// column (or either middle one on an even board) is open, unless solid
+// blocks leave neither of them playable.
+func openingAllows(g *Game, col int) bool {
+	if !g.CenterOpening || g.Turns > 0 {
+		return true
+	}
+	lo, hi := (g.Cols-1)/2, g.Cols/2
+	if col == lo || col == hi {
+		return true
+	}
+	return dropRow(g.Grid, lo, g.GravityUp) == -1 && dropRow(g.Grid, hi, g.GravityUp) == -1
+}
+
+// tryPlace drops side's piece into col and records the move; it is the only
+// place a move writes to the grid. Callers hold whatever lock guards g, so
+// finding the landing cell and filling it happen as one step. ok is false
+// (and g untouched) when col is not playable.
+func tryPlace(g *Game, col int, side byte) (row int, ok bool) {
+	row, ok = landingRow(g, col)
+	if !ok {
+		return -1, false
+	}
+	g.Grid[row][col] = side
+	g.LastPlayed = side
+	recordMove(g, row, col, side)
+	g.Turns++
+	return row, true
+}
+
+// winningLine returns the full line through (r,c) if it has at least as
+// many pieces of p as lens asks for in its direction. The cells are in
+// order along that direction.
+func winningLine(grid [][]byte, r, c int, p byte, lens lineLens) [][2]int {
+	if len(grid) == 0 {
+		return nil
+	}
+	h, w := len(grid), len(grid[0])
+	in := func(rr, cc int) bool { return rr >= 0 && rr < h && cc >= 0 && cc < w }
+	for i, d := range lineDirs {
+		line := [][2]int{{r, c}}
+		rr, cc := r+d[0], c+d[1]
+		for in(rr, cc) && grid[rr][cc] == p {
+			line = append(line, [2]int{rr, cc})
+			rr += d[0]
+			cc += d[1]
+		}
+		rr, cc = r-d[0], c-d[1]
+		for in(rr, cc) && grid[rr][cc] == p {
+			line = append([][2]int{{rr, cc}}, line...)
+			rr -= d[0]
+			cc -= d[1]
+		}
+		if len(line) >= lens[i] {
+			return line
+		}
+	}
+	return nil
+}
+
+// lineDirs are the four line directions as [row, col] steps: horizontal,
+// vertical, and the two diagonals.
+var lineDirs = [4][2]int{{0, 1}, {1, 0}, {1, 1}, {1, -1}}
+
+// lineLens is how many pieces make a line along each of lineDirs.
+type lineLens [4]int
+
+// dirLens overrides the length to align per direction (horizontal,
+// vertical, both diagonals); 0 keeps the game's WinLen.
+type dirLens struct {
+	H int `json:"h,omitempty"`
+	V int `json:"v,omitempty"`
+	D int `json:"d,omitempty"`
+}
+
+// lensFor resolves the overrides in by over the default winLen.
+func lensFor(winLen int, by dirLens) lineLens {
+	l := lineLens{winLen, winLen, winLen, winLen}
+	if by.H > 0 {
+		l[0] = by.H
+	}
+	if by.V > 0 {
+		l[1] = by.V
+	}
+	if by.D > 0 {
+		l[2], l[3] = by.D, by.D
+	}
+	return l
+}
+
+func (g *Game) lens() lineLens {
+	return lensFor(g.WinLen, g.WinBy)
+}
+
+// shortest is the smallest length of l, what the layout checks (open lines,
+// opening threats, fairness) go by.
+func (l lineLens) shortest() int {
+	return min(l[0], l[1], l[2], l[3])
+}
+
+// along is the length required for line, as returned by winningLine.
+func (l lineLens) along(line [][2]int) int {
+	step := [2]int{line[1][0] - line[0][0], line[1][1] - line[0][1]}
+	for i, d := range lineDirs {
+		if d == step {
+			return l[i]
+		}
+	}
+	return l[0]
+}
+
+// recordMove appends a move to the history, timing it against the previous one.
+func recordMove(g *Game, row, col int, side byte) {
+	now := time.Now()
+	prev := g.CreatedAt
+	if n := len(g.Moves); n > 0 {
+		prev = g.Moves[n-1].At
+	}
+	appendMove(g, Move{Row: row, Col: col, Side: side, At: now, Think: now.Sub(prev) - g.PauseTime, GravityUp: g.GravityUp})
+	g.PauseTime = 0
+}
+
+// appendMove adds m to the history, hashed with the move before it (or the
+// starting board), so changing any recorded move breaks every later hash.
+func appendMove(g *Game, m Move) {
+	m.Hash = chainLink(g.chainHead(), len(g.Moves)+1, string(m.Side), m.Kind, m.Col, m.Row, m.GravityUp)
+	g.Moves = append(g.Moves, m)
+}
+
+// chainHead is the hash of the last move, the genesis hash before the first.
+func (g *Game) chainHead() string {
+	if n := len(g.Moves); n > 0 {
+		return g.Moves[n-1].Hash
+	}
+	return chainGenesis(formatGrid(g.Start))
+}
+
+// chainGenesis hashes the starting board, one formatGrid row per line.
+func chainGenesis(start []string) string {
+	sum := sha256.Sum256([]byte("power4-chain-v1\n" + strings.Join(start, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// chainLink hashes move number turn (from 1) onto prev, the fields joined
+// by "|" in this order; booleans are "true"/"false".
+func chainLink(prev string, turn int, side, kind string, col, row int, gravityUp bool) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%d|%s|%s|%d|%d|%t", prev, turn, side, kind, col, row, gravityUp)))
+	return hex.EncodeToString(sum[:])
+}
+
+// verifyChain replays the hashes of an exported history from its starting
+// board: it returns the index of the first entry that does not match, -1
+// when the whole chain holds.
+func verifyChain(start []string, moves []logEntry) int {
+	prev := chainGenesis(start)
+	for i, m := range moves {
+		if chainLink(prev, m.Turn, m.Side, m.Kind, m.Col, m.Row, m.GravityUp) != m.Hash {
+			return i
+		}
+		prev = m.Hash
+	}
+	return -1
+}
+
+// Notable things the last move did, most notable first, so clients can pick
+// a sound without re-deriving the rules.
+const (
+	eventWin         = "win"
+	eventDraw        = "draw"
+	eventForfeit     = "forfeit"
+	eventFlip        = "flip" // scheduled flip or the flip power-up
+	eventClear       = "clear"
+	eventPassThrough = "block-passthrough"
+	eventDrop        = "normal-drop"
+)
+
+// lastEvent names what the last move did ("" before the first one). It
+// reads the same facts the move handlers acted on: the end reason, the
+// flip schedule and the blocks the piece crossed.
+func lastEvent(g *Game) string {
+	switch g.GameOverReason {
+	case reasonConnect:
+		return eventWin
+	case reasonDraw:
+		return eventDraw
+	case reasonTimeout:
+		return eventForfeit
+	}
+	if len(g.Moves) == 0 {
+		return ""
+	}
+	m := g.Moves[len(g.Moves)-1]
+	switch {
+	case m.Kind == "flip" || (g.FlipEvery > 0 && g.Turns > 0 && flipDue(g, g.Current)):
+		return eventFlip
+	case m.Kind == "clear":
+		return eventClear
+	}
+	if _, through := fallPath(g.Grid, m.Row, m.Col, m.GravityUp); len(through) > 0 {
+		return eventPassThrough
+	}
+	return eventDrop
+}
+
+// dropInfo describes how the last piece travelled so a client can animate it
+// falling (or rising) through blocks. Turn ties it to the state it belongs to.
+type dropInfo struct {
+	Turn    int      `json:"turn"`
+	Side    string   `json:"side"`
+	Row     int      `json:"row"`
+	Col     int      `json:"col"`
+	From    string   `json:"from"`    // "top" | "bottom"
+	Path    [][2]int `json:"path"`    // entry edge → landing cell, [row, col]
+	Through [][2]int `json:"through"` // blocks crossed on the way
+}
+
+// fallPath lists the cells a piece crosses from the entry edge to (row, col).
+// Blocks are pass-through (see dropRow), so they show up in through; solid
+// ones are never crossed.
+func fallPath(grid [][]byte, row, col int, gravityUp bool) (path, through [][2]int) {
+	step, r := 1, 0
+	if gravityUp {
+		step, r = -1, len(grid)-1
+	}
+	for ; r >= 0 && r < len(grid); r += step {
+		path = append(path, [2]int{r, col})
+		if r == row {
+			break
+		}
+		if grid[r][col] == cellBlk {
+			through = append(through, [2]int{r, col})
+		}
+	}
+	return path, through
+}
+
+func lastDrop(g *Game) *dropInfo {
+	if len(g.Moves) == 0 || g.Moves[len(g.Moves)-1].Kind != "" {
+		return nil
+	}
+	m := g.Moves[len(g.Moves)-1]
+	path, through := fallPath(g.Grid, m.Row, m.Col, m.GravityUp)
+	if through == nil {
+		through = [][2]int{}
+	}
+	from := "top"
+	if m.GravityUp {
+		from = "bottom"
+	}
+	return &dropInfo{
+		Turn:    len(g.Moves),
+		Side:    string(m.Side),
+		Row:     m.Row,
+		Col:     m.Col,
+		From:    from,
+		Path:    path,
+		Through: through,
+	}
+}
+
+// passedThrough marks the blocks the last dropped piece fell through, so the
+// board can pulse them briefly; all false when the last move crossed none.
+func passedThrough(g *Game) [][]bool {
+	passed := make([][]bool, g.Rows)
+	for r := range passed {
+		passed[r] = make([]bool, g.Cols)
+	}
+	if d := lastDrop(g); d != nil {
+		for _, rc := range d.Through {
+			passed[rc[0]][rc[1]] = true
+		}
+	}
+	return passed
+}
+
+// thinkStat is the per-side pace summary shown on the result page.
+type thinkStat struct {
+	Moves    int
+	Avg, Max string
+}
+
+func thinkStats(moves []Move, side byte) thinkStat {
+	var total, longest time.Duration
+	n := 0
+	for _, m := range moves {
+		if m.Side != side {
+			continue
+		}
+		n++
+		total += m.Think
+		if m.Think > longest {
+			longest = m.Think
+		}
+	}
+	if n == 0 {
+		return thinkStat{}
+	}
+	return thinkStat{
+		Moves: n,
+		Avg:   fmtSeconds(total / time.Duration(n)),
+		Max:   fmtSeconds(longest),
+	}
+}
+
+func fmtSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 1, 64) + "s"
+}
+
+// noMoveLeft reports whether the next side to move (after the scheduled
+// flip, if any) has no playable column. Without solid blocks this is a full
+// board; solid blocks can wall off empty cells for good.
+func noMoveLeft(g *Game) bool {
+	up := g.GravityUp != flipDue(g, nextPlayer(g, g.Current))
+	for c := 0; c < g.Cols; c++ {
+		if dropRow(g.Grid, c, up) != -1 {
+			return false
+		}
+	}
+	return true
+}
+
+// isDraw reports whether the board is full: no column takes a piece, with
+// gravity either way. Row 0 alone says nothing once gravity points up (it
+// fills first) or a block sits in it.
+func isDraw(grid [][]byte) bool {
+	if len(grid) == 0 {
+		return true // no cell to play in
+	}
+	for c := 0; c < len(grid[0]); c++ {
+		if dropRow(grid, c, false) != -1 || dropRow(grid, c, true) != -1 {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *server) viewModel(g *Game) map[string]any {
+	// indices, and the 1-based labels shown by the coordinates overlay
+	colsIdx := make([]int, g.Cols)
+	rowsIdx := make([]int, g.Rows)
+	colNums := make([]int, g.Cols)
+	rowNums := make([]int, g.Rows)
+	for i := 0; i < g.Cols; i++ {
+		colsIdx[i] = i
+		colNums[i] = i + 1
+	}
+	for i := 0; i < g.Rows; i++ {
+		rowsIdx[i] = i
+		rowNums[i] = i + 1
+	}
+
+	// whose turn (only matters online)
+	myTurn := true
+	if g.Mode == "online" {
+		if g.ThisIsRed {
+			myTurn = (g.Current == cellR)
+		} else {
+			myTurn = (g.Current == cellY)
+		}
+	}
+
+	// which columns are disabled?
+	disabled := make([]bool, g.Cols)
+	for c := 0; c < g.Cols; c++ {
+		if !myTurn || g.GameOver {
+			disabled[c] = true
+			continue
+		}
+		_, ok := landingRow(g, c)
+		disabled[c] = !ok
+	}
+
+	turnsLeft := 0
+	if g.MaxTurns > 0 {
+		turnsLeft = max(g.MaxTurns-g.Turns, 0)
+	}
+
+	var dailyBest *dailyResult
+	if g.Daily != "" {
+		s.stats.mu.Lock()
+		if best, ok := s.stats.dailyBestOn(g.Daily); ok {
+			dailyBest = &best
+		}
+		s.stats.mu.Unlock()
+	}
+
+	// 1-based position of each cell in the winning line (0 = not in it),
+	// used to stagger the highlight
+	winStep := make([][]int, g.Rows)
+	for r := range winStep {
+		winStep[r] = make([]int, g.Cols)
+	}
+	for i, rc := range g.WinLine {
+		winStep[rc[0]][rc[1]] = i + 1
+	}
+
+	return map[string]any{
+		"Grid":           g.Grid,
+		"PlayStart":      g.Turns == 0 && !g.GameOver,
+		"Winning":        g.Winning,
+		"Mine":           piecesOf(g.Grid, g.Current),
+		"AIName":         g.AIName,
+		"AITurn":         g.isAISide(g.Current),
+		"ChainHead":      g.chainHead(),
+		"WinStep":        winStep,
+		"Passed":         passedThrough(g),
+		"Rows":           rowsIdx,
+		"Cols":           colsIdx,
+		"RowNums":        rowNums,
+		"ColNums":        colNums,
+		"Disabled":       disabled,
+		"CurrentStr":     string(g.Current),
+		"LastPlayed":     string(g.LastPlayed),
+		"WinnerName":     playerName(g, g.LastPlayed),
+		"P1":             g.Player1,
+		"P2":             g.Player2,
+		"P3":             g.Player3,
+		"P4":             g.Player4,
+		"Players":        g.Players,
+		"CurrentName":    playerName(g, g.Current),
+		"Scores":         g.Scores,
+		"Endless":        g.Endless,
+		"Daily":          g.Daily,
+		"Trophies":       trophiesOf(g),
+		"CanReroll":      canReroll(g),
+		"PuzzleCode":     puzzleCodeOf(g),
+		"CenterOpening":  g.CenterOpening && g.Turns == 0,
+		"CoinStarter":    coinStarter(g),
+		"DailyBest":      dailyBest,
+		"Points":         g.Points,
+		"Message":        g.Message,
+		"GravityUp":      g.GravityUp,
+		"FlipEvery":      g.FlipEvery,
+		"FlipRounds":     g.FlipMode == flipPerRound,
+		"WinLen":         g.WinLen,
+		"WinLens":        g.lens(),
+		"WinByDir":       g.WinBy != (dirLens{}),
+		"Turns":          g.Turns,
+		"MaxTurns":       g.MaxTurns,
+		"TurnsLeft":      turnsLeft,
+		"Difficulty":     g.Difficulty,
+		"GameOver":       g.GameOver,
+		"GameOverReason": string(g.GameOverReason),
+		"Unranked":       g.Unranked,
+		"IsOnline":       g.Mode == "online",
+		"CanSwap":        g.Mode == "local" && g.Players == 2,
+		"NextStarter":    playerName(g, nextPlayer(g, g.starter())),
+		"LobbyCode":      g.LobbyCode,
+		"ChatMaxLen":     s.chatMaxLen,
+		"ThisIsRed":      g.ThisIsRed,
+		"Confirm":        g.ConfirmMoves && g.Mode != "online",
+		"HintsLeft":      maxHints - g.HintsUsed,
+		"PowerUps":       g.PowerUps && g.Mode != "online",
+		"ClearsLeft":     g.ClearsLeft,
+		"FlipsLeft":      g.FlipsLeft,
+		"PendingCol":     g.PendingCol,
+		"ThinkR":         thinkStats(g.Moves, cellR),
+		"ThinkY":         thinkStats(g.Moves, cellY),
+	}
+}
+
+func (s *server) render(w http.ResponseWriter, r *http.Request, page string, data map[string]any) {
+	if data == nil {
+		data = map[string]any{}
+	}
+	data["Page"] = page // "start", "game", or "result"
+	s.renderPartial(w, r, "base", data)
+}
+
+// renderPartial executes one named template (a whole page is "base") with
+// the per-request display settings added to data.
+func (s *server) renderPartial(w http.ResponseWriter, r *http.Request, name string, data map[string]any) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	data["Base"] = s.basePath
+	t, cb := themeForRequest(r), colorBlindForRequest(r)
+	if cb {
+		t = t.withShapes()
+	}
+	data["Theme"] = t
+	data["Themes"] = themes
+	data["ColorBlind"] = cb
+	data["Coords"] = coordsForRequest(r)
+	data["Highlight"] = highlightForRequest(r)
+	tpl, err := s.templates()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if err := tpl.ExecuteTemplate(w, name, data); err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+func (s *server) gameForRequest(w http.ResponseWriter, r *http.Request, reset bool) *Game {
+	_, g := s.session(w, r, reset)
+	return g
+}
+
+// sessionID returns the request's pg_sid, issuing a new session if it has none.
+func (s *server) sessionID(w http.ResponseWriter, r *http.Request) string {
+	id, _ := s.session(w, r, false)
+	return id
+}
+
+func (s *server) session(w http.ResponseWriter, r *http.Request, reset bool) (string, *Game) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cookie, err := r.Cookie(s.cookieName)
+	if err != nil || cookie.Value == "" || reset {
+		id := newID()
+		g := NewGameFromConfig(defaultConfig())
+		s.putSessionGame(r, id, g)
+		s.setCookie(w, r, &http.Cookie{
+			Name:     s.cookieName,
+			Value:    id,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+			MaxAge:   60 * 60 * 24,
+		})
+		return id, g
+	}
+	now := time.Now()
+	if g, ok := s.sessionGame(r, cookie.Value); ok {
+		if !g.LastSeen.IsZero() && now.Sub(g.LastSeen) > sessionIdleTTL {
+			g = NewGameFromConfig(defaultConfig())
+			g.Expired = true
+			s.putSessionGame(r, cookie.Value, g)
+		}
+		g.LastSeen = now
+		return cookie.Value, g
+	}
+	g := NewGameFromConfig(defaultConfig())
+	g.LastSeen = now
+	s.putSessionGame(r, cookie.Value, g)
+	return cookie.Value, g
+}
+
+// sessionIdleTTL is how long a session game may sit untouched before it is
+// dropped; the cookie can outlive it.
+const sessionIdleTTL = 6 * time.Hour
+
+// expiredRedirect sends the player back to the start page, once, when their
+// idle game was just dropped instead of resuming a fresh default board.
+func (s *server) expiredRedirect(w http.ResponseWriter, r *http.Request, g *Game) bool {
+	s.mu.Lock()
+	expired := g.Expired
+	g.Expired = false
+	s.mu.Unlock()
+	if expired {
+		s.redirect(w, r, "/?expired=1")
+	}
+	return expired
+}
+
+/*** i18n ***/
+
+// defaultLang is the language the pages are written in.
+const defaultLang = "fr"
+
+// catalog holds the server-formatted strings, keyed by language then
+// message id. Plural forms use ".one" / ".other" suffixes (see plural).
+var catalog = map[string]map[string]string{
+	"fr": {
+		"score.none":      "Aucun point marqué",
+		"score.lead":      "%s mène %d à %d",
+		"score.tie.one":   "Égalité de score : %d point partout",
+		"score.tie.other": "Égalité de score : %d points partout",
+	},
+	"en": {
+		"score.none":      "No points scored yet",
+		"score.lead":      "%s leads %d to %d",
+		"score.tie.one":   "Scores level: %d point each",
+		"score.tie.other": "Scores level: %d points each",
+	},
+}
+
+// langFor picks the catalog language the visitor's Accept-Language prefers,
+// e.g. "en-GB,en;q=0.9,fr;q=0.8" → "en"; defaultLang when none is in the
+// catalog.
+func langFor(r *http.Request) string {
+	best, bestQ := defaultLang, 0.0
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		tag, _, _ = strings.Cut(strings.ToLower(strings.TrimSpace(tag)), "-")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if _, ok := catalog[tag]; ok && q > bestQ {
+			best, bestQ = tag, q
+		}
+	}
+	return best
+}
+
+// tr formats message id in lang, falling back to defaultLang.
+func tr(lang, id string, args ...any) string {
+	msg, ok := catalog[lang][id]
+	if !ok {
+		msg = catalog[defaultLang][id]
+	}
+	return fmt.Sprintf(msg, args...)
+}
+
+// plural picks the ".one" or ".other" form of id for n.
+// French treats 0 and 1 as singular, English only 1.
+func plural(lang, id string, n int) string {
+	one := n == 1
+	if lang == "fr" {
+		one = n <= 1
+	}
+	if one {
+		return id + ".one"
+	}
+	return id + ".other"
+}
+
+// scoreAnnouncement describes the running score, e.g. "Rouge mène 3 à 2".
+func scoreAnnouncement(lang, p1, p2 string, r, y int) string {
+	switch {
+	case r == 0 && y == 0:
+		return tr(lang, "score.none")
+	case r > y:
+		return tr(lang, "score.lead", p1, r, y)
+	case y > r:
+		return tr(lang, "score.lead", p2, y, r)
+	}
+	return tr(lang, plural(lang, "score.tie", r), r)
+}
+
+/*** Themes ***/
+
+// theme describes how cells are drawn. Glyphs are printed inside the piece
+// (empty string = plain disc); Name is also the <body> class suffix.
+type theme struct {
+	Name  string
+	Label string
+	R     string
+	Y     string
+	G     string
+	B     string
+	Block string
+	Solid string
+	Empty string
+}
+
+// themes is the closed set of accepted values for the pg_theme cookie.
+// The first entry is the default.
+var themes = []theme{
+	{Name: "classic", Label: "Classique"},
+	{Name: "neon", Label: "Néon"},
+	{Name: "symbols", Label: "Symboles", R: "●", Y: "▲", G: "◆", B: "■", Block: "✖", Solid: "⬛", Empty: "·"},
+}
+
+// themeByName never echoes an unknown name back: it falls back to the default.
+func themeByName(name string) theme {
+	for _, t := range themes {
+		if t.Name == name {
+			return t
+		}
+	}
+	return themes[0]
+}
+
+// withShapes gives every side a distinct glyph so pieces can be told apart
+// without color (pg_colorblind). Themes with their own glyphs keep them.
+func (t theme) withShapes() theme {
+	def := func(v *string, glyph string) {
+		if *v == "" {
+			*v = glyph
+		}
+	}
+	def(&t.R, "●")
+	def(&t.Y, "▲")
+	def(&t.G, "◆")
+	def(&t.B, "■")
+	def(&t.Block, "✖")
+	def(&t.Solid, "⬛")
+	return t
+}
+
+// Glyph is the glyph drawn for side ("R", "Y", "G", "B"), for labels.
+func (t theme) Glyph(side string) string {
+	switch side {
+	case "R":
+		return t.R
+	case "Y":
+		return t.Y
+	case "G":
+		return t.G
+	case "B":
+		return t.B
+	}
+	return ""
+}
+
+func colorBlindForRequest(r *http.Request) bool {
+	c, err := r.Cookie("pg_colorblind")
+	return err == nil && c.Value == "1"
+}
+
+func coordsForRequest(r *http.Request) bool {
+	c, err := r.Cookie("pg_coords")
+	return err == nil && c.Value == "1"
+}
+
+func highlightForRequest(r *http.Request) bool {
+	c, err := r.Cookie("pg_highlight")
+	return err == nil && c.Value == "1"
+}
+
+// piecesOf marks the cells of grid holding p's pieces (the "Mine" grid the
+// board outlines when the highlight toggle is on).
+func piecesOf(grid [][]byte, p byte) [][]bool {
+	out := make([][]bool, len(grid))
+	for r, row := range grid {
+		out[r] = make([]bool, len(row))
+		for c, v := range row {
+			out[r][c] = v == p
+		}
+	}
+	return out
+}
+
+func themeForRequest(r *http.Request) theme {
+	if c, err := r.Cookie("pg_theme"); err == nil {
+		return themeByName(c.Value)
+	}
+	return themes[0]
+}
+
+// prefs is what the start form remembers about a visitor (pg_prefs), well
+// beyond the session's lifetime.
+type prefs struct {
+	Name       string
+	Difficulty string
+}
+
+// maxNameLen bounds a player name, typed or remembered, in runes.
+const maxNameLen = 24
+
+// validPrefName accepts a non-empty, printable, reasonably short name.
+func validPrefName(name string) bool {
+	return name != "" && utf8.ValidString(name) && utf8.RuneCountInString(name) <= maxNameLen &&
+		strings.IndexFunc(name, unicode.IsControl) == -1
+}
+
+// prefsForRequest reads pg_prefs ("difficulty.hex(name)"). Anything that
+// does not validate is dropped field by field, never echoed back.
+func prefsForRequest(r *http.Request) prefs {
+	var p prefs
+	c, err := r.Cookie("pg_prefs")
+	if err != nil {
+		return p
+	}
+	diff, hexName, _ := strings.Cut(c.Value, ".")
+	switch diff {
+	case "easy", "normal", "hard":
+		p.Difficulty = diff
+	}
+	if b, err := hex.DecodeString(hexName); err == nil && validPrefName(string(b)) {
+		p.Name = string(b)
+	}
+	return p
+}
+
+// savePrefs remembers p for a year; an invalid name is simply not kept.
+func (s *server) savePrefs(w http.ResponseWriter, r *http.Request, p prefs) {
+	if !validPrefName(p.Name) {
+		p.Name = ""
+	}
+	s.setCookie(w, r, &http.Cookie{
+		Name:     "pg_prefs",
+		Value:    p.Difficulty + "." + hex.EncodeToString([]byte(p.Name)),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   60 * 60 * 24 * 365,
+	})
+}
+
+// POST /theme  (form: theme, colorblind)
+func (s *server) handleTheme(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.redirect(w, r, "/")
+		return
+	}
+	if !parseForm(w, r) {
+		return
+	}
+	t := themeByName(strings.ToLower(strings.TrimSpace(r.FormValue("theme"))))
+	s.setCookie(w, r, &http.Cookie{
+		Name:     "pg_theme",
+		Value:    t.Name,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   60 * 60 * 24 * 365,
+	})
+	cb := "0"
+	if r.FormValue("colorblind") != "" {
+		cb = "1"
+	}
+	s.setCookie(w, r, &http.Cookie{
+		Name:     "pg_colorblind",
+		Value:    cb,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   60 * 60 * 24 * 365,
+	})
+	s.redirect(w, r, "/")
+}
+
+// POST /coords  (form: code, side for online games)
+// Toggles the row/column numbers drawn around the board (pg_coords cookie).
+func (s *server) handleCoords(w http.ResponseWriter, r *http.Request) {
+	s.toggleDisplay(w, r, "pg_coords", coordsForRequest(r))
+}
+
+// POST /highlight  (form: code, side for online games)
+// Toggles the outline on the pieces of the player to move, or on your own
+// online (pg_highlight cookie).
+func (s *server) handleHighlight(w http.ResponseWriter, r *http.Request) {
+	s.toggleDisplay(w, r, "pg_highlight", highlightForRequest(r))
+}
+
+// toggleDisplay flips the on/off display cookie name and goes back to the
+// game, or to the online seat given by the form.
+func (s *server) toggleDisplay(w http.ResponseWriter, r *http.Request, name string, on bool) {
+	if r.Method != http.MethodPost {
+		s.redirect(w, r, "/game")
+		return
+	}
+	if !parseForm(w, r) {
+		return
+	}
+	v := "1"
+	if on {
+		v = "0"
+	}
+	s.setCookie(w, r, &http.Cookie{
+		Name:     name,
+		Value:    v,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   60 * 60 * 24 * 365,
+	})
+	code := strings.ToUpper(strings.TrimSpace(r.FormValue("code")))
+	side := strings.ToUpper(strings.TrimSpace(r.FormValue("side")))
+	if validLobbyCode(code) && (side == "R" || side == "Y") {
+		s.redirect(w, r, "/online/wait?code="+code+"&side="+side)
+		return
+	}
+	s.redirect(w, r, "/game")
+}
+
+// setCookie adds the Secure flag when the request came over HTTPS, directly or
+// through a TLS-terminating proxy, or when forced by POWER4_SECURE_COOKIES.
+// SameSite stays Lax: shared lobby links arrive from other sites.
+// The cookie is scoped to the base path so instances don't clobber each other.
+func (s *server) setCookie(w http.ResponseWriter, r *http.Request, c *http.Cookie) {
+	c.Path = s.basePath + "/"
+	c.Secure = s.secureCookies || r.TLS != nil ||
+		strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+	http.SetCookie(w, c)
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	_, _ = crand.Read(b) // crypto-strong IDs for sessions
+	return hex.EncodeToString(b)
+}
+
+func securityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Referrer-Policy", "no-referrer-when-downgrade")
+		w.Header().Set("X-Frame-Options", "DENY")
+		// Allow inline JS (for tiny template scripts) and audio from self
+		w.Header().Set("Content-Security-Policy",
+			"default-src 'self'; script-src 'self' 'unsafe-inline'; style-src 'self'; img-src 'self' data:; media-src 'self';")
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// recoverPanics turns a panicking handler into a logged 500 so one broken
+// game never takes the in-memory state of every other game down with it.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if v := recover(); v != nil {
+				if v == http.ErrAbortHandler {
+					panic(v)
+				}
+				log.Printf("panic serving %s %s: %v\n%s", r.Method, r.URL.Path, v, debug.Stack())
+				http.Error(w, "500 — erreur interne du serveur", http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+/*** Rate limiting ***/
+
+// ipLimiter is a token bucket per client IP: rate tokens per second, up to
+// burst saved up. Buckets idle long enough to be full again are forgotten.
+type ipLimiter struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// limiterSweepEvery is how often allow drops idle buckets.
+const limiterSweepEvery = time.Minute
+
+func newIPLimiter(rate, burst int) *ipLimiter {
+	return &ipLimiter{rate: float64(rate), burst: float64(max(burst, 1)), buckets: make(map[string]*bucket)}
+}
+
+// allow spends one token of ip's bucket. When it is empty, wait is how long
+// until the next token.
+func (l *ipLimiter) allow(ip string, now time.Time) (ok bool, wait time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastSweep) > limiterSweepEvery {
+		full := time.Duration(l.burst / l.rate * float64(time.Second))
+		for k, b := range l.buckets {
+			if now.Sub(b.last) > full {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+	b, found := l.buckets[ip]
+	if !found {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[ip] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// clientIP is the peer address of r. Forwarded headers are ignored: they
+// are trivial to forge.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// limited answers 429 with Retry-After once the caller's IP is over budget.
+func (s *server) limited(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.apiLimiter != nil {
+			if ok, wait := s.apiLimiter.allow(clientIP(r), time.Now()); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				writeJSON(w, http.StatusTooManyRequests, map[string]string{"err": "too many requests"})
+				return
+			}
+		}
+		h(w, r)
+	}
+}
+
+/*** CORS ***/
+
+// parseOrigins reads POWER4_CORS_ORIGINS: comma-separated origins
+// ("https://arena.example.com"), or "*" for any. Empty = same origin only.
+func parseOrigins(list string) map[string]bool {
+	out := make(map[string]bool)
+	for _, o := range strings.Split(list, ",") {
+		if o = strings.TrimSuffix(strings.TrimSpace(o), "/"); o != "" {
+			out[o] = true
+		}
+	}
+	return out
+}
+
+// cors lets the allowed origins call h from a browser: it answers the
+// preflight itself and adds the Access-Control-* headers to the response.
+// Credentials (the session cookie) are only allowed for listed origins,
+// never with "*". Only the /api routes are wrapped, not the pages.
+func (s *server) cors(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			h(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		allowed := s.corsOrigins[origin] || s.corsOrigins["*"]
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if !allowed {
+			if preflight {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			h(w, r) // the browser withholds the response
+			return
+		}
+		if s.corsOrigins[origin] {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		}
+		if preflight {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Access-Control-Expose-Headers", "Retry-After")
+		h(w, r)
+	}
+}
+
+/*** AI helpers ***/
+
+// aiPersonality weights the AI's own k-in-a-row threats against the
+// opponent's. "Own3"/"Opp3" are lines one piece short of WinLen, "2" two short.
+// TieBreak picks among equally scored columns (see breakTie); Seed drives
+// the tieSeeded policy. IgnoreReplies skips the check of the opponent's
+// replies in chooseMove. Selective is how many of its own moves the AI
+// looks ahead along forcing lines (see forcedWin); 0 or 1 = one ply only.
+type aiPersonality struct {
+	Name          string
+	Label         string
+	Own3, Own2    int
+	Opp3, Opp2    int
+	TieBreak      string
+	Seed          int64
+	IgnoreReplies bool
+	Selective     int
+}
+
+// handOverPenalty is taken off a move after which the opponent can win.
+const handOverPenalty = 5000
+
+// Tie-break policies; "" behaves like tieLeftmost.
+const (
+	tieLeftmost = "leftmost"
+	tieCenter   = "center"
+	tieSeeded   = "seeded"
+)
+
+func validTieBreak(p string) bool {
+	return p == "" || p == tieLeftmost || p == tieCenter || p == tieSeeded
+}
+
+// The first entry is the default (the historical 50/10 symmetric weights).
+var aiPersonalities = []aiPersonality{
+	{Name: "balanced", Label: "Équilibrée", Own3: 50, Own2: 10, Opp3: 50, Opp2: 10},
+	{Name: "aggressive", Label: "Agressive", Own3: 90, Own2: 20, Opp3: 30, Opp2: 5},
+	{Name: "defensive", Label: "Défensive", Own3: 30, Own2: 5, Opp3: 90, Opp2: 20},
+}
+
+func aiPersonalityByName(name string) aiPersonality {
+	for _, p := range aiPersonalities {
+		if p.Name == name {
+			return p
+		}
+	}
+	return aiPersonalities[0]
+}
+
+func chooseAIMove(g *Game) int {
+	return chooseMove(g, cellY)
+}
+
+// aiDebug, when set (POWER4_AI_DEBUG=1), receives one line per AI move
+// with every candidate's score; see logAIMove.
+var aiDebug *log.Logger
+
+// candidate is one playable column as scored by chooseMove.
+type candidate struct {
+	Col, Eval, Score int
+	HandsOver        bool
+}
+
+// logAIMove writes a key=value line to aiDebug: cands is "col:score" for
+// each playable column (eval and final score when they differ, "!" when
+// the move hands over a win), reason is "win", "forced" or "score".
+func logAIMove(g *Game, me byte, cands []candidate, chosen int, reason string) {
+	if aiDebug == nil {
+		return
+	}
+	parts := make([]string, len(cands))
+	for i, c := range cands {
+		parts[i] = fmt.Sprintf("%d:%d", c.Col, c.Score)
+		if c.Eval != c.Score {
+			parts[i] = fmt.Sprintf("%d:%d/%d", c.Col, c.Eval, c.Score)
+		}
+		if c.HandsOver {
+			parts[i] += "!"
+		}
+	}
+	tie := g.AI.TieBreak
+	if tie == "" {
+		tie = tieLeftmost
+	}
+	aiDebug.Printf("ai move side=%c ai=%s turn=%d gravity_up=%t tiebreak=%s candidates=%s chosen=%d reason=%s",
+		me, g.AI.Name, g.Turns, g.GravityUp, tie, strings.Join(parts, ","), chosen, reason)
+}
+
+// chooseMove picks the column the AI would play for side me.
+func chooseMove(g *Game, me byte) int {
+	op := opponent(me)
+	var ties []int
+	var cands []candidate // only built for aiDebug
+	bestScore := -1_000_000
+	if g.AI.Selective > 1 && !hasWinningDrop(g, me) {
+		if c := forcedWin(g, me, g.AI.Selective); c >= 0 {
+			logAIMove(g, me, nil, c, "forced")
+			return c
+		}
+	}
+	for c := 0; c < g.Cols; c++ {
+		r, ok := landingRow(g, c)
+		if !ok {
+			continue
+		}
+
+		// try me
+		g.Grid[r][c] = me
+
+		// winning now?
+		if winningLine(g.Grid, r, c, me, g.lens()) != nil {
+			g.Grid[r][c] = cellEmpty
+			logAIMove(g, me, cands, c, "win")
+			return c
+		}
+
+		eval := evalBoard(g, me, g.AI)
+		score := eval
+		// does it hand op a win (left unblocked, or opened by the flip)?
+		handsOver := !g.AI.IgnoreReplies && replyWins(g, op)
+		if handsOver {
+			score -= handOverPenalty
+		}
+		center := g.Cols / 2
+		score -= abs(c - center)
+		if aiDebug != nil {
+			cands = append(cands, candidate{Col: c, Eval: eval, Score: score, HandsOver: handsOver})
+		}
+
+		g.Grid[r][c] = cellEmpty
+		switch {
+		case score > bestScore:
+			bestScore = score
+			ties = append(ties[:0], c)
+		case score == bestScore:
+			ties = append(ties, c)
+		}
+	}
+	best := breakTie(g, ties)
+	logAIMove(g, me, cands, best, "score")
+	return best
+}
+
+// breakTie picks one of the equally scored columns cols (left to right)
+// according to g.AI.TieBreak, or -1 when there is none. The seeded policy
+// mixes Seed with the turn number, so a replay with the same seed makes the
+// same choices.
+func breakTie(g *Game, cols []int) int {
+	if len(cols) == 0 {
+		return -1
+	}
+	switch g.AI.TieBreak {
+	case tieCenter:
+		best := cols[0]
+		for _, c := range cols[1:] {
+			if abs(c-g.Cols/2) < abs(best-g.Cols/2) {
+				best = c
+			}
+		}
+		return best
+	case tieSeeded:
+		rng := mrand.New(mrand.NewSource(g.AI.Seed*31 + int64(g.Turns)))
+		return cols[rng.Intn(len(cols))]
+	}
+	return cols[0]
+}
+
+// selectiveDepth is the default aiPersonality.Selective of the AI opponent
+// per difficulty; easy keeps the one-ply AI.
+var selectiveDepth = map[string]int{"normal": 2, "hard": 3}
+
+// forcedWin returns a column from which me wins by force within depth of
+// its own moves, the quickest one first, or -1. Only forcing lines are
+// searched: a move is followed further only if it leaves me a winning drop
+// the opponent has to block, so the cost stays close to the one-ply scan on
+// quiet boards.
+func forcedWin(g *Game, me byte, depth int) int {
+	if g.Endless || g.Players > 2 {
+		return -1
+	}
+	for d := 2; d <= depth; d++ {
+		for c := 0; c < g.Cols; c++ {
+			if winsByForce(g, c, me, d) {
+				return c
+			}
+		}
+	}
+	return -1
+}
+
+// winsByForce reports whether me dropping into col wins within depth of its
+// own moves whatever the opponent answers. The board is left as found.
+func winsByForce(g *Game, col int, me byte, depth int) bool {
+	if g.MaxTurns > 0 && g.Turns >= g.MaxTurns {
+		return false
+	}
+	win, undo, ok := simTurn(g, col, me)
+	if !ok {
+		return false
+	}
+	defer undo()
+	op := opponent(me)
+	// a quiet move ends the line: without a threat to answer, op is free
+	if win || depth <= 1 || !hasWinningDrop(g, me) || hasWinningDrop(g, op) {
+		return win
+	}
+	replies := 0
+	for c := 0; c < g.Cols; c++ {
+		_, undoOp, ok := simTurn(g, c, op) // cannot win: checked above
+		if !ok {
+			continue
+		}
+		replies++
+		found := false
+		for c2 := 0; c2 < g.Cols && !found; c2++ {
+			found = winsByForce(g, c2, me, depth-1)
+		}
+		undoOp()
+		if !found {
+			return false
+		}
+	}
+	return replies > 0 // no reply at all: the board is full, a draw
+}
+
+// simTurn plays p in col as a real turn would (the piece, the turn count,
+// then the flip scheduled for the next player) and returns how to take it
+// back. ok is false when col is not playable.
+func simTurn(g *Game, col int, p byte) (win bool, undo func(), ok bool) {
+	row, ok := landingRow(g, col)
+	if !ok {
+		return false, nil, false
+	}
+	up := g.GravityUp
+	g.Grid[row][col] = p
+	g.Turns++
+	win = winningLine(g.Grid, row, col, p, g.lens()) != nil
+	if !win && flipDue(g, opponent(p)) {
+		g.GravityUp = !g.GravityUp
+	}
+	return win, func() {
+		g.GravityUp = up
+		g.Turns--
+		g.Grid[row][col] = cellEmpty
+	}, true
+}
+
+// replyWins reports whether op, moving next, has a winning drop: one ply
+// ahead, under the gravity op will play with once the turn is counted and
+// a scheduled flip applied. The board is left as found.
+func replyWins(g *Game, op byte) bool {
+	up := g.GravityUp
+	g.Turns++
+	if flipDue(g, op) {
+		g.GravityUp = !g.GravityUp
+	}
+	win := hasWinningDrop(g, op)
+	g.Turns--
+	g.GravityUp = up
+	return win
+}
+
+// winsAt reports whether p would win right now by dropping into col.
+func winsAt(g *Game, col int, p byte) bool {
+	_, win, _, _ := dryDrop(g, col, p)
+	return win
+}
+
+// dryDrop tries p in col and takes it back, leaving g as it was: row is
+// where the piece lands, win and draw what the drop would end the game
+// with, decided in checkResult's order (a line on the last free cell is a
+// win). draw assumes p is the side to move. ok is false when col is full or
+// off the board.
+func dryDrop(g *Game, col int, p byte) (row int, win, draw, ok bool) {
+	row, ok = landingRow(g, col)
+	if !ok {
+		return -1, false, false, false
+	}
+	g.Grid[row][col] = p
+	g.Turns++
+	win = winningLine(g.Grid, row, col, p, g.lens()) != nil
+	draw = !win && !g.Endless && (noMoveLeft(g) || (g.MaxTurns > 0 && g.Turns >= g.MaxTurns))
+	g.Turns--
+	g.Grid[row][col] = cellEmpty
+	return row, win, draw, true
+}
+
+func evalBoard(g *Game, me byte, w aiPersonality) int {
+	op := cellR
+	if me == cellR {
+		op = cellY
+	}
+
+	// countK counts the open lines of p that are short pieces short of a
+	// win: a full line's worth of cells holding only p's pieces and empty
+	// cells. A drop into one of those empty cells closes the line for p,
+	// which is what gives the Opp weights a say.
+	countK := func(p byte, short int) int {
+		if len(g.Grid) == 0 {
+			return 0
+		}
+		h, w := len(g.Grid), len(g.Grid[0])
+		lens := g.lens()
+		total := 0
+		in := func(r, c int) bool { return r >= 0 && r < h && c >= 0 && c < w }
+		for r := 0; r < h; r++ {
+			for c := 0; c < w; c++ {
+				for di, d := range lineDirs {
+					n := lens[di]
+					cnt := 0
+					rr, cc := r, c
+					open := true
+					for i := 0; i < n; i++ {
+						if !in(rr, cc) {
+							open = false
+							break
+						}
+						if v := g.Grid[rr][cc]; v == p {
+							cnt++
+						} else if v != cellEmpty {
+							open = false // a block or another color
+							break
+						}
+						rr += d[0]
+						cc += d[1]
+					}
+					if open && cnt == n-short {
+						total++
+					}
+				}
+			}
+		}
+		return total
+	}
+
+	return w.Own3*countK(me, 1) + w.Own2*countK(me, 2) -
+		w.Opp3*countK(op, 1) - w.Opp2*countK(op, 2)
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+/*** Analysis ***/
+
+const (
+	// winRating rates a move that wins on the spot (and, negated, one that
+	// lets the opponent win on its next move)
+	winRating = 100_000
+	// blunderMargin is how far below the best rating a move must fall to be
+	// flagged: two open threes with the default weights
+	blunderMargin = 100
+)
+
+// rateMove rates side me dropping into col for the analysis: the AI's board
+// evaluation, a win on the spot, or a reply that wins for the opponent.
+// ok is false when col is not playable.
+func rateMove(g *Game, col int, me byte) (rating int, ok bool) {
+	r, ok := landingRow(g, col)
+	if !ok {
+		return 0, false
+	}
+	g.Grid[r][col] = me
+	defer func() { g.Grid[r][col] = cellEmpty }()
+	if winningLine(g.Grid, r, col, me, g.lens()) != nil {
+		return winRating, true
+	}
+	if replyWins(g, opponent(me)) {
+		return -winRating, true
+	}
+	return evalBoard(g, me, g.AI), true
+}
+
+// plyNote is one annotated move of an analysis. Power-ups are listed but not
+// rated (Best is -1).
+type plyNote struct {
+	Turn       int    `json:"turn"`
+	Side       string `json:"side"`
+	Kind       string `json:"kind,omitempty"`
+	Col        int    `json:"col"`
+	Best       int    `json:"best"`
+	Rating     int    `json:"rating"`
+	BestRating int    `json:"bestRating"`
+	Blunder    bool   `json:"blunder"`
+	Note       string `json:"note,omitempty"`
+}
+
+// analyzeGame replays g's history from g.Start and, before every drop, rates
+// each column with rateMove: the best one is what the AI recommends, and a
+// played move at least blunderMargin below it is a blunder.
+func analyzeGame(g *Game) ([]plyNote, error) {
+	if g.Players > 2 {
+		return nil, errors.New("analyse réservée aux parties à deux")
+	}
+	if g.Endless {
+		return nil, errors.New("analyse indisponible en mode sans fin")
+	}
+	sim, err := replayStart(g)
+	if err != nil {
+		return nil, err
+	}
+
+	notes := make([]plyNote, 0, len(g.Moves))
+	for i, m := range g.Moves {
+		n := plyNote{Turn: i + 1, Side: string(m.Side), Kind: m.Kind, Col: m.Col, Best: -1}
+		if m.Kind == "" {
+			n.BestRating = -winRating - 1
+			for c := 0; c < sim.Cols; c++ {
+				if rt, ok := rateMove(sim, c, m.Side); ok && rt > n.BestRating {
+					n.Best, n.BestRating = c, rt
+				}
+			}
+			rt, _ := rateMove(sim, m.Col, m.Side)
+			n.Rating = rt
+			n.Blunder = n.BestRating-rt >= blunderMargin
+			switch {
+			case n.BestRating == winRating && rt != winRating:
+				n.Note = "victoire immédiate manquée"
+			case rt == -winRating && n.BestRating > -winRating:
+				n.Note = "laisse gagner l’adversaire"
+			}
+		}
+		if !replayMove(sim, m) {
+			return nil, fmt.Errorf("coup %d incohérent avec le plateau", i+1)
+		}
+		notes = append(notes, n)
+	}
+	return notes, nil
+}
+
+// replayStart is g's board before its first recorded move, to be stepped
+// through with replayMove. Endless games clear their lines as they go, so
+// their history cannot be replayed.
+func replayStart(g *Game) (*Game, error) {
+	if g.Endless || g.Start == nil || g.Turns < len(g.Moves) {
+		return nil, errors.New("historique indisponible")
+	}
+	sim := &Game{
+		Rows: g.Rows, Cols: g.Cols, WinLen: g.WinLen, WinBy: g.WinBy, FlipEvery: g.FlipEvery,
+		FlipMode: g.FlipMode, Players: g.Players, AI: g.AI, FlipGuard: g.FlipGuard,
+		CenterOpening: g.CenterOpening,
+		Turns:         g.Turns - len(g.Moves),
+		Current:       g.Current,
+		GravityUp:     g.GravityUp,
+		Grid:          make([][]byte, g.Rows),
+	}
+	for r := range sim.Grid {
+		sim.Grid[r] = append([]byte(nil), g.Start[r]...)
+	}
+	if len(g.Moves) > 0 {
+		// a flip power-up records the gravity it produced
+		sim.GravityUp = g.Moves[0].GravityUp != (g.Moves[0].Kind == "flip")
+		sim.Current = g.Moves[0].Side
+	}
+	return sim, nil
+}
+
+// replayMove plays m on sim the way the game did: the drop or power-up, then
+// the turn and the scheduled flip for the next side. It reports false when
+// m does not fit the board (the history does not belong to it).
+func replayMove(sim *Game, m Move) bool {
+	switch m.Kind {
+	case "clear":
+		clearColumn(sim.Grid, m.Col, sim.GravityUp)
+	case "flip":
+		sim.GravityUp = !sim.GravityUp
+		resettleBoard(sim.Grid, sim.GravityUp)
+	default:
+		if r, ok := landingRow(sim, m.Col); !ok || r != m.Row {
+			return false
+		}
+		sim.Grid[m.Row][m.Col] = m.Side
+	}
+	sim.Turns++
+	sim.Current = nextPlayer(sim, m.Side)
+	if flipDue(sim, sim.Current) {
+		sim.GravityUp = !sim.GravityUp
+	}
+	return true
+}
+
+// positionAt is g as it stood after its first ply recorded moves (0 = the
+// starting board), rebuilt from g.Start and g.Moves.
+func positionAt(g *Game, ply int) (*Game, error) {
+	if ply < 0 || ply > len(g.Moves) {
+		return nil, fmt.Errorf("coup entre 0 et %d attendu", len(g.Moves))
+	}
+	sim, err := replayStart(g)
+	if err != nil {
+		return nil, err
+	}
+	for i, m := range g.Moves[:ply] {
+		if !replayMove(sim, m) {
+			return nil, fmt.Errorf("coup %d incohérent avec le plateau", i+1)
+		}
+	}
+	if ply == len(g.Moves) {
+		// a finished game ends before the flip its last move would have
+		// been followed by: the live game is the last position
+		sim.GravityUp, sim.Current = g.GravityUp, g.Current
+	}
+	return sim, nil
+}
+
+// reviewedGame is the game a review endpoint looks at: the lobby's for
+// ?code=, else the session's. It answers 404 itself for an unknown lobby.
+func (s *server) reviewedGame(w http.ResponseWriter, r *http.Request) (*Game, bool) {
+	code := strings.ToUpper(strings.TrimSpace(r.URL.Query().Get("code")))
+	if code == "" {
+		return s.gameForRequest(w, r, false), true
+	}
+	var g *Game
+	s.mu.Lock()
+	if lb, ok := s.lobby(r, code); ok && lb.Game != nil {
+		g = cloneGame(lb.Game)
+	}
+	s.mu.Unlock()
+	if g == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"err": "not found"})
+		return nil, false
+	}
+	return g, true
+}
+
+// GET /analyze[?code=XXXX]  →  {"moves":[plyNote...],"blunders":N}
+// Annotates a finished game (the session's, or a lobby's) for coaching.
+func (s *server) handleAnalyze(w http.ResponseWriter, r *http.Request) {
+	g, ok := s.reviewedGame(w, r)
+	if !ok {
+		return
+	}
+	if !g.GameOver {
+		writeJSON(w, http.StatusConflict, map[string]string{"err": "la partie n’est pas terminée"})
+		return
+	}
+	notes, err := analyzeGame(g)
+	if err != nil {
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"err": err.Error()})
+		return
+	}
+	blunders := 0
+	for _, n := range notes {
+		if n.Blunder {
+			blunders++
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"moves": notes, "blunders": blunders})
+}
+
+// GET /game/history/state?ply=N[&code=XXXX]
+// → {"ply":N,"plies":M,"turns":T,"grid":[...],"gravityUp":false,"toMove":"Y","move":{...}}
+// The board of the session's (or a lobby's) game after its first N moves,
+// with the gravity and side to move at that point; move is the Nth one.
+func (s *server) handleHistoryState(w http.ResponseWriter, r *http.Request) {
+	g, ok := s.reviewedGame(w, r)
+	if !ok {
+		return
+	}
+	ply, err := strconv.Atoi(r.URL.Query().Get("ply"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"err": "ply attendu"})
+		return
+	}
+	if ply < 0 || ply > len(g.Moves) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"err": fmt.Sprintf("ply entre 0 et %d attendu", len(g.Moves))})
+		return
+	}
+	pos, err := positionAt(g, ply)
+	if err != nil {
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"err": err.Error()})
+		return
+	}
+	out := map[string]any{
+		"ply":       ply,
+		"plies":     len(g.Moves),
+		"turns":     pos.Turns,
+		"grid":      formatGrid(pos.Grid),
+		"gravityUp": pos.GravityUp,
+		"toMove":    string(pos.Current),
+	}
+	if ply > 0 {
+		out["move"] = moveLog(g)[ply-1]
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+/*** Share previews ***/
+
+// pngCell is the side of one cell of /result/board.png, in pixels.
+const pngCell = 48
+
+// pngFrame is the board color behind the cells of /result/board.png.
+var pngFrame = color.RGBA{30, 58, 138, 255}
+
+// pngFills are the /result/board.png colors of each cell value.
+var pngFills = map[byte]color.RGBA{
+	cellEmpty: {11, 15, 26, 255},
+	cellR:     {239, 68, 68, 255},
+	cellY:     {250, 204, 21, 255},
+	cellG:     {34, 197, 94, 255},
+	cellB:     {59, 130, 246, 255},
+	cellBlk:   {100, 116, 139, 255},
+	cellSolid: {51, 65, 85, 255},
+}
+
+// writeBoardPNG draws g's board as a PNG: a disc per cell (a square for
+// solid blocks), the discs of the winning line ringed in white.
+func writeBoardPNG(w io.Writer, g *Game) error {
+	img := image.NewRGBA(image.Rect(0, 0, g.Cols*pngCell, g.Rows*pngCell))
+	draw.Draw(img, img.Bounds(), &image.Uniform{pngFrame}, image.Point{}, draw.Src)
+	white := color.RGBA{255, 255, 255, 255}
+	mid, rad := float64(pngCell-1)/2, float64(pngCell)/2-4
+	for r, row := range g.Grid {
+		for c, v := range row {
+			win := r < len(g.Winning) && c < len(g.Winning[r]) && g.Winning[r][c]
+			for y := 0; y < pngCell; y++ {
+				for x := 0; x < pngCell; x++ {
+					dx, dy := float64(x)-mid, float64(y)-mid
+					d := math.Hypot(dx, dy)
+					if v == cellSolid {
+						d = math.Max(math.Abs(dx), math.Abs(dy))
+					}
+					fill := pngFills[v]
+					switch {
+					case d > rad:
+						continue
+					case win && d > rad-4:
+						fill = white
+					}
+					img.SetRGBA(c*pngCell+x, r*pngCell+y, fill)
+				}
+			}
+		}
+	}
+	return png.Encode(w, img)
+}
+
+// GET /result/board.png[?code=XXXX]
+// The board of the session's (or a lobby's) game, for link previews.
+func (s *server) handleBoardPNG(w http.ResponseWriter, r *http.Request) {
+	g, ok := s.reviewedGame(w, r)
+	if !ok {
+		return
+	}
+	var buf bytes.Buffer
+	if err := writeBoardPNG(&buf, g); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-cache")
+	_, _ = w.Write(buf.Bytes())
+}
+
+// shareTitle is the outcome line of a shared result, "Rouge a gagné 4-2":
+// the winner's score comes first.
+func shareTitle(g *Game) string {
+	var names []string
+	for _, p := range turnOrder[:max(g.Players, 2)] {
+		names = append(names, playerName(g, p))
+	}
+	score := ""
+	if g.Players <= 2 {
+		a, b := g.Scores.R, g.Scores.Y
+		if g.LastPlayed == cellY {
+			a, b = b, a
+		}
+		score = fmt.Sprintf(" %d-%d", a, b)
+	}
+	switch {
+	case !g.GameOver:
+		return "Partie en cours : " + strings.Join(names, " contre ")
+	case g.GameOverReason == reasonAborted:
+		return "Partie interrompue : " + strings.Join(names, " contre ")
+	case g.GameOverReason == reasonDraw:
+		return "Match nul" + score
+	}
+	return playerName(g, g.LastPlayed) + " a gagné" + score
+}
+
+// absURL is p (a path under the base path) as an absolute URL on the host
+// the request came to, for the tags link previews read.
+func (s *server) absURL(r *http.Request, p string) string {
+	scheme := "http"
+	if r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https") {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + s.basePath + p
+}
+
+// GET /result/og?code=XXXX
+// A small page carrying Open Graph tags for a shared result: the outcome as
+// og:title and the board PNG as og:image. Only a lobby can be shared: a
+// link preview has no session cookie, so without a code there is no game.
+func (s *server) handleResultOG(w http.ResponseWriter, r *http.Request) {
+	if strings.TrimSpace(r.URL.Query().Get("code")) == "" {
+		http.NotFound(w, r)
+		return
+	}
+	g, ok := s.reviewedGame(w, r)
+	if !ok {
+		return
+	}
+	query := "?code=" + g.LobbyCode
+	link := "/online/watch" + query
+	data := map[string]any{
+		"Title":  shareTitle(g),
+		"Desc":   fmt.Sprintf("Puissance 4 à gravité variable : %d coups sur une grille %d×%d", g.Turns, g.Rows, g.Cols),
+		"Image":  s.absURL(r, "/result/board.png"+query),
+		"Width":  g.Cols * pngCell,
+		"Height": g.Rows * pngCell,
+		"URL":    s.absURL(r, "/result/og"+query),
+		"Link":   link,
+	}
+	s.renderPartial(w, r, "og", data)
+}
+
+/*** Daily board ***/
+
+// The daily board is the same for everyone on a given UTC day: an AI game
+// on the normal preset whose block layout is seeded from the date.
+const dailyDifficulty = "normal"
+
+// dailyResult is the best win against a daily board: fewest turns, the
+// earliest one on a tie.
+type dailyResult struct {
+	Date   string `json:"date"`
+	Player string `json:"player"`
+	Turns  int    `json:"turns"`
+}
+
+// dailyDate is the UTC day of t, so the board changes at the same instant
+// for every visitor whatever their timezone.
+func dailyDate(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// dailySeed turns a dailyDate into the layout seed (20261015 for
+// "2026-10-15"); never 0, which would ask for a random layout.
+func dailySeed(date string) int64 {
+	t, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		return 1
+	}
+	return int64(t.Year()*10000 + int(t.Month())*100 + t.Day())
+}
+
+// dailyBoard is the config of date's daily game for a player named p1.
+func dailyBoard(date, p1 string) GameConfig {
+	sr := startRequest{Mode: "ai", P1: p1, Difficulty: dailyDifficulty}
+	v, _ := sr.normalize() // fixed, valid settings
+	cfg := sr.config(v)
+	cfg.Seed, cfg.Daily = dailySeed(date), date
+	return cfg
+}
+
+// recordDaily keeps res if it beats the best of its day. The caller holds
+// st.mu.
+func (st *serverStats) recordDaily(date string, res dailyResult) {
+	res.Date = date
+	if date != st.dailyDate {
+		st.dailyDate, st.dailyBest = date, res
+		return
+	}
+	if res.Turns < st.dailyBest.Turns {
+		st.dailyBest = res
+	}
+}
+
+// dailyBestOn returns the best result of date, if one was recorded. The
+// caller holds st.mu.
+func (st *serverStats) dailyBestOn(date string) (dailyResult, bool) {
+	if st.dailyDate != date {
+		return dailyResult{}, false
+	}
+	return st.dailyBest, true
+}
+
+// GET /daily  →  a new game on today's board, in the caller's session
+func (s *server) handleDaily(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method", http.StatusMethodNotAllowed)
+		return
+	}
+	name := prefsForRequest(r).Name
+	g := s.gameForRequest(w, r, true)
+	*g = *NewGameFromConfig(dailyBoard(dailyDate(time.Now()), name))
+	s.redirect(w, r, "/game")
+}
+
+/*** Achievements ***/
+
+// achievement is a trophy a player unlocks once, under their name, by
+// winning a game in a particular way (see earnedAchievements).
+type achievement struct {
+	ID    string
+	Label string
+	Desc  string
+}
+
+var achievements = []achievement{
+	{ID: "first-win", Label: "🥇 Première victoire", Desc: "Gagner une partie"},
+	{ID: "unshaken", Label: "⚓ Inébranlable", Desc: "Gagner après une inversion de gravité sans qu’aucun de ses pions n’ait bougé"},
+	{ID: "comeback", Label: "🔥 Remontada", Desc: "Passer devant dans la série après avoir été mené 0–2"},
+	{ID: "upside-down", Label: "🙃 La tête en bas", Desc: "Gagner d’un coup joué en gravité inversée"},
+}
+
+// achievementByID returns the achievement with that ID.
+func achievementByID(id string) (achievement, bool) {
+	for _, a := range achievements {
+		if a.ID == id {
+			return a, true
+		}
+	}
+	return achievement{}, false
+}
+
+// achievementKey is the name achievements are kept under: player names are
+// free text, so case and surrounding spaces do not make another player.
+func achievementKey(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// earnedAchievements lists what p's win in g qualifies for, already held or
+// not. Only lines count: forfeits, draws, the AI's wins and unranked online
+// games earn nothing.
+func earnedAchievements(g *Game, p byte) []string {
+	if g.GameOverReason != reasonConnect || g.LastPlayed != p || g.isAISide(p) || g.Unranked {
+		return nil
+	}
+	ids := []string{"first-win"}
+	if g.Players == 2 && cameBack(g.Series, p) {
+		ids = append(ids, "comeback")
+	}
+	if g.Endless || len(g.Moves) == 0 {
+		// endless mode clears lines and moves pieces by design
+		return ids
+	}
+	if g.Moves[len(g.Moves)-1].GravityUp {
+		ids = append(ids, "upside-down")
+	}
+	flipped, kept := false, true
+	for i, m := range g.Moves {
+		if i > 0 && m.GravityUp != g.Moves[i-1].GravityUp {
+			flipped = true
+		}
+		// a drop of p whose cell no longer holds p was moved by a flip
+		// power-up or emptied by a column clear
+		if m.Kind == "" && m.Side == p && g.Grid[m.Row][m.Col] != p {
+			kept = false
 		}
-		g.Message = ""
-		return true
 	}
-	if isDraw(g.Grid) {
-		g.GameOver = true
-		g.Message = "🤝 Égalité !"
-		return true
+	if flipped && kept {
+		ids = append(ids, "unshaken")
 	}
-	return false
+	return ids
 }
 
-/*** helpers ***/
-
-func configByDifficulty(d string) (rows, cols, blocks int) {
-	switch d {
-	case "hard":
-		return 6, 9, 7
-	case "normal":
-		return 6, 8, 5
-	default: // easy
-		return 6, 7, 3
+// cameBack reports whether p leads series after having trailed 0–2 (or
+// worse) in it.
+func cameBack(series string, p byte) bool {
+	mine, theirs, trailed := 0, 0, false
+	for i := 0; i < len(series); i++ {
+		if series[i] == p {
+			mine++
+		} else {
+			theirs++
+		}
+		if mine == 0 && theirs >= 2 {
+			trailed = true
+		}
 	}
+	return trailed && mine > theirs
 }
 
-func newGame(rows, cols, blocks int) *Game {
-	g := &Game{
-		Rows:      rows,
-		Cols:      cols,
-		Grid:      make([][]byte, rows),
-		Winning:   make([][]bool, rows),
-		Current:   cellR,
-		Mode:      "local",
-		CreatedAt: time.Now(),
+// unlockAchievements records what p earned with g under p's name and
+// returns the IDs unlocked for the first time. The caller holds st.mu.
+func (st *serverStats) unlockAchievements(g *Game, p byte) []string {
+	key := achievementKey(playerName(g, p))
+	if key == "" {
+		return nil
 	}
-	for i := range g.Grid {
-		g.Grid[i] = make([]byte, cols)
-		g.Winning[i] = make([]bool, cols)
+	var fresh []string
+	for _, id := range earnedAchievements(g, p) {
+		if st.trophies[key][id] {
+			continue
+		}
+		if st.trophies == nil {
+			st.trophies = make(map[string]map[string]bool)
+		}
+		if st.trophies[key] == nil {
+			st.trophies[key] = make(map[string]bool)
+		}
+		st.trophies[key][id] = true
+		fresh = append(fresh, id)
 	}
-	placeBlocks(g.Grid, blocks)
-	return g
+	return fresh
 }
 
-func placeBlocks(grid [][]byte, n int) {
-	h, w := len(grid), len(grid[0])
-	tries := n * 10
-	for n > 0 && tries > 0 {
-		tries--
-		r := mrand.Intn(h)
-		c := mrand.Intn(w)
-		if grid[r][c] == cellEmpty {
-			grid[r][c] = cellBlk
-			n--
+// trophiesOf is what g's winner unlocked, for the result page.
+func trophiesOf(g *Game) []achievement {
+	var out []achievement
+	for _, id := range g.Trophies {
+		if a, ok := achievementByID(id); ok {
+			out = append(out, a)
 		}
 	}
+	return out
 }
 
-// dropRow choisit la case d'arrivée dans la colonne col.
-// Règle custom : rien ne bloque le chemin (ni R/Y ni X).
-// On atterrit sur la case VIDE la plus éloignée dans le sens de la gravité.
-// - Gravité normale (down)  : la case vide la PLUS BASSE
-// - Gravité inversée (up)   : la case vide la PLUS HAUTE
-// On ne peut pas atterrir sur une case 'X' (mais on peut "passer à travers").
-func dropRow(grid [][]byte, col int, gravityUp bool) int {
-	h := len(grid)
-	if h == 0 || col < 0 || col >= len(grid[0]) {
-		return -1
+/*** Results log ***/
+
+// gameSummary is the line appended to the results log for a finished game.
+type gameSummary struct {
+	At         time.Time `json:"at"`
+	Mode       string    `json:"mode"`
+	Difficulty string    `json:"difficulty"`
+	Variant    string    `json:"variant,omitempty"`
+	Lobby      string    `json:"lobby,omitempty"`
+	Players    []string  `json:"players"`
+	Winner     string    `json:"winner,omitempty"` // "" on a draw
+	WinnerSide string    `json:"winnerSide,omitempty"`
+	Reason     string    `json:"reason"`
+	Turns      int       `json:"turns"`
+	Seconds    float64   `json:"seconds"` // since the game was created
+}
+
+func summaryOf(g *Game, now time.Time) gameSummary {
+	sum := gameSummary{
+		At:         now.UTC(),
+		Mode:       g.Mode,
+		Difficulty: g.Difficulty,
+		Variant:    g.Variant,
+		Lobby:      g.LobbyCode,
+		Reason:     string(g.GameOverReason),
+		Turns:      g.Turns,
+		Seconds:    math.Round(now.Sub(g.CreatedAt).Seconds()*10) / 10,
+	}
+	for _, p := range turnOrder[:max(g.Players, 2)] {
+		sum.Players = append(sum.Players, playerName(g, p))
 	}
+	if g.GameOverReason != reasonDraw {
+		sum.Winner, sum.WinnerSide = playerName(g, g.LastPlayed), string(g.LastPlayed)
+	}
+	return sum
+}
 
-	if !gravityUp {
-		// vers le BAS : première case vide en partant du bas
-		for r := h - 1; r >= 0; r-- {
-			if grid[r][col] == cellEmpty {
-				return r
-			}
-		}
-		return -1 // aucune case vide
+// resultsLog appends gameSummary lines to a file opened once at startup.
+// Games end from many handlers at once, hence the lock.
+type resultsLog struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+}
+
+func openResultsLog(path string) (*resultsLog, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("POWER4_RESULTS_LOG: %w", err)
 	}
+	return &resultsLog{path: path, f: f}, nil
+}
 
-	// vers le HAUT : première case vide en partant du haut
-	for r := 0; r < h; r++ {
-		if grid[r][col] == cellEmpty {
-			return r
-		}
+// record appends g's summary as one write, so a line is never interleaved
+// with another. A failed write is logged: the game has ended either way.
+// A nil log records nothing.
+func (l *resultsLog) record(g *Game, now time.Time) {
+	if l == nil {
+		return
+	}
+	line, err := json.Marshal(summaryOf(g, now))
+	if err != nil {
+		log.Printf("results log: %v", err)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.f.Write(append(line, '\n')); err != nil {
+		log.Printf("results log %s: %v", l.path, err)
 	}
-	return -1
 }
 
-func winningLine(grid [][]byte, r, c int, p byte) [][2]int {
-	h, w := len(grid), len(grid[0])
-	in := func(rr, cc int) bool { return rr >= 0 && rr < h && cc >= 0 && cc < w }
-	dirs := [][2]int{{0, 1}, {1, 0}, {1, 1}, {1, -1}}
-	for _, d := range dirs {
-		line := [][2]int{{r, c}}
-		rr, cc := r+d[0], c+d[1]
-		for in(rr, cc) && grid[rr][cc] == p {
-			line = append(line, [2]int{rr, cc})
-			rr += d[0]
-			cc += d[1]
+/*** Storage ***/
+
+// Store keeps the session games (by pg_sid) and the lobbies (by code).
+// Callers hold s.mu, except for Len, which /api/stats reads without it.
+// Handlers go through s.lobby / s.session, which record what a request
+// loaded so s.persisting can write it back once the request is done: the
+// in-memory store hands out its live objects, the Redis one decoded copies.
+type Store interface {
+	Game(id string) (*Game, bool)
+	PutGame(id string, g *Game)
+	Lobby(code string) (*lobby, bool)
+	PutLobby(code string, lb *lobby)
+	DeleteLobby(code string)
+	LobbyCodes() []string
+	Len() (games, lobbies int)
+}
+
+// newStore picks the backend from POWER4_STORE: "memory" (default) or
+// "redis" (POWER4_REDIS_ADDR, POWER4_REDIS_PASSWORD, POWER4_REDIS_PREFIX).
+func newStore() (Store, error) {
+	switch kind := os.Getenv("POWER4_STORE"); kind {
+	case "", "memory":
+		return newMemStore(), nil
+	case "redis":
+		addr := os.Getenv("POWER4_REDIS_ADDR")
+		if addr == "" {
+			addr = "localhost:6379"
 		}
-		rr, cc = r-d[0], c-d[1]
-		for in(rr, cc) && grid[rr][cc] == p {
-			line = append([][2]int{{rr, cc}}, line...)
-			rr -= d[0]
-			cc -= d[1]
+		prefix := os.Getenv("POWER4_REDIS_PREFIX")
+		if prefix == "" {
+			prefix = "power4:"
 		}
-		if len(line) >= 4 {
-			return line
+		rs := &redisStore{addr: addr, password: os.Getenv("POWER4_REDIS_PASSWORD"), prefix: prefix, ttl: storeTTL}
+		if _, err := rs.do("PING"); err != nil {
+			return nil, fmt.Errorf("redis %s: %w", addr, err)
 		}
+		return rs, nil
+	default:
+		return nil, fmt.Errorf("POWER4_STORE inconnu %q (memory ou redis)", kind)
 	}
-	return nil
 }
 
-func isDraw(grid [][]byte) bool {
-	for c := 0; c < len(grid[0]); c++ {
-		if grid[0][c] == cellEmpty {
-			return false
-		}
+// memStore keeps everything in two maps. Their sizes are also counted on
+// every insert and delete, so Len can be read without s.mu while the maps
+// are being written to.
+type memStore struct {
+	games   map[string]*Game
+	lobbies map[string]*lobby
+
+	nGames, nLobbies atomic.Int64
+}
+
+func newMemStore() *memStore {
+	return &memStore{games: make(map[string]*Game), lobbies: make(map[string]*lobby)}
+}
+
+func (m *memStore) Game(id string) (*Game, bool) {
+	g, ok := m.games[id]
+	return g, ok
+}
+
+func (m *memStore) PutGame(id string, g *Game) {
+	if _, ok := m.games[id]; !ok {
+		m.nGames.Add(1)
+	}
+	m.games[id] = g
+}
+
+func (m *memStore) Lobby(code string) (*lobby, bool) {
+	lb, ok := m.lobbies[code]
+	return lb, ok
+}
+
+func (m *memStore) PutLobby(code string, lb *lobby) {
+	if _, ok := m.lobbies[code]; !ok {
+		m.nLobbies.Add(1)
+	}
+	m.lobbies[code] = lb
+}
+
+func (m *memStore) DeleteLobby(code string) {
+	if _, ok := m.lobbies[code]; ok {
+		delete(m.lobbies, code)
+		m.nLobbies.Add(-1)
+	}
+}
+
+func (m *memStore) LobbyCodes() []string {
+	codes := make([]string, 0, len(m.lobbies))
+	for code := range m.lobbies {
+		codes = append(codes, code)
+	}
+	return codes
+}
+
+func (m *memStore) Len() (games, lobbies int) {
+	return int(m.nGames.Load()), int(m.nLobbies.Load())
+}
+
+// storeTTL is how long Redis keeps a game or lobby nobody writes to, the
+// same day as the session cookie.
+const storeTTL = 24 * time.Hour
+
+// redisStore keeps games and lobbies as JSON under prefix+"game:<id>" and
+// prefix+"lobby:<code>", so several instances can serve the same players.
+// Writes are last-one-wins: the instances do not lock a lobby between them.
+// It speaks just enough RESP for GET/SET/DEL/SCAN over one connection,
+// redialled after any error; failures are logged and read as "not found".
+type redisStore struct {
+	addr, password, prefix string
+	ttl                    time.Duration
+
+	mu   sync.Mutex
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+func (rs *redisStore) Game(id string) (*Game, bool) {
+	var g Game
+	if !rs.get("game:"+id, &g) {
+		return nil, false
+	}
+	return &g, true
+}
+
+func (rs *redisStore) PutGame(id string, g *Game) { rs.set("game:"+id, g) }
+
+func (rs *redisStore) Lobby(code string) (*lobby, bool) {
+	var lb lobby
+	if !rs.get("lobby:"+code, &lb) {
+		return nil, false
+	}
+	return &lb, true
+}
+
+func (rs *redisStore) PutLobby(code string, lb *lobby) { rs.set("lobby:"+code, lb) }
+
+func (rs *redisStore) DeleteLobby(code string) {
+	if _, err := rs.do("DEL", rs.prefix+"lobby:"+code); err != nil {
+		log.Printf("redis: del lobby %s: %v", code, err)
+	}
+}
+
+func (rs *redisStore) LobbyCodes() []string {
+	keys := rs.scan("lobby:*")
+	codes := make([]string, len(keys))
+	for i, k := range keys {
+		codes[i] = strings.TrimPrefix(k, rs.prefix+"lobby:")
+	}
+	return codes
+}
+
+// Len counts the keys in Redis itself: they expire on their own (storeTTL),
+// so a count kept here would drift. The connection has its own lock.
+func (rs *redisStore) Len() (games, lobbies int) {
+	return len(rs.scan("game:*")), len(rs.scan("lobby:*"))
+}
+
+func (rs *redisStore) get(key string, v any) bool {
+	reply, err := rs.do("GET", rs.prefix+key)
+	if err != nil {
+		log.Printf("redis: get %s: %v", key, err)
+		return false
+	}
+	b, ok := reply.(string)
+	if !ok {
+		return false // nil bulk: no such key
+	}
+	if err := json.Unmarshal([]byte(b), v); err != nil {
+		log.Printf("redis: decode %s: %v", key, err)
+		return false
 	}
 	return true
 }
 
-func (s *server) viewModel(g *Game) map[string]any {
-	// indices
-	colsIdx := make([]int, g.Cols)
-	rowsIdx := make([]int, g.Rows)
-	for i := 0; i < g.Cols; i++ {
-		colsIdx[i] = i
+func (rs *redisStore) set(key string, v any) {
+	b, err := json.Marshal(v)
+	if err == nil {
+		_, err = rs.do("SET", rs.prefix+key, string(b), "EX", strconv.Itoa(int(rs.ttl.Seconds())))
 	}
-	for i := 0; i < g.Rows; i++ {
-		rowsIdx[i] = i
+	if err != nil {
+		log.Printf("redis: set %s: %v", key, err)
 	}
+}
 
-	// whose turn (only matters online)
-	myTurn := true
-	if g.Mode == "online" {
-		if g.ThisIsRed {
-			myTurn = (g.Current == cellR)
-		} else {
-			myTurn = (g.Current == cellY)
+// scan lists the keys matching prefix+pattern.
+func (rs *redisStore) scan(pattern string) []string {
+	var keys []string
+	cursor := "0"
+	for {
+		reply, err := rs.do("SCAN", cursor, "MATCH", rs.prefix+pattern, "COUNT", "500")
+		if err != nil {
+			log.Printf("redis: scan %s: %v", pattern, err)
+			return keys
+		}
+		page, _ := reply.([]any)
+		if len(page) != 2 {
+			return keys
+		}
+		batch, _ := page[1].([]any)
+		for _, k := range batch {
+			if s, ok := k.(string); ok {
+				keys = append(keys, s)
+			}
+		}
+		if cursor, _ = page[0].(string); cursor == "0" || cursor == "" {
+			return keys
 		}
 	}
+}
 
-	// which columns are disabled?
-	disabled := make([]bool, g.Cols)
-	for c := 0; c < g.Cols; c++ {
-		if !myTurn || g.GameOver {
-			disabled[c] = true
-			continue
+// do sends one command and reads its reply: string for simple and bulk
+// strings, nil for a nil bulk, int64 for integers, []any for arrays.
+func (rs *redisStore) do(args ...string) (any, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.conn == nil {
+		conn, err := net.DialTimeout("tcp", rs.addr, 2*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		rs.conn, rs.rd = conn, bufio.NewReader(conn)
+		if rs.password != "" {
+			if _, err := rs.roundTrip("AUTH", rs.password); err != nil {
+				rs.close()
+				return nil, err
+			}
+		}
+	}
+	reply, err := rs.roundTrip(args...)
+	if err != nil {
+		if _, isReply := err.(redisError); !isReply {
+			rs.close()
 		}
-		disabled[c] = (dropRow(g.Grid, c, g.GravityUp) == -1)
 	}
+	return reply, err
+}
 
-	return map[string]any{
-		"Grid":       g.Grid,
-		"PlayStart":  g.Turns == 0 && !g.GameOver,
-		"Winning":    g.Winning,
-		"Rows":       rowsIdx,
-		"Cols":       colsIdx,
-		"Disabled":   disabled,
-		"CurrentStr": string(g.Current),
-		"LastPlayed": string(g.LastPlayed), // requires: LastPlayed byte in Game
-		"P1":         g.Player1,
-		"P2":         g.Player2,
-		"Scores":     g.Scores,
-		"Message":    g.Message,
-		"GravityUp":  g.GravityUp,
-		"Turns":      g.Turns,
-		"Difficulty": g.Difficulty,
-		"GameOver":   g.GameOver,
-		"IsOnline":   g.Mode == "online",
-		"LobbyCode":  g.LobbyCode, // requires: LobbyCode string in Game
-		"ThisIsRed":  g.ThisIsRed, // requires: ThisIsRed bool in Game
-	}
-}
-
-func (s *server) render(w http.ResponseWriter, page string, data map[string]any) {
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	if data == nil {
-		data = map[string]any{}
+func (rs *redisStore) close() {
+	rs.conn.Close()
+	rs.conn, rs.rd = nil, nil
+}
+
+func (rs *redisStore) roundTrip(args ...string) (any, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
 	}
-	data["Page"] = page // "start", "game", or "result"
-	if err := s.tpl.ExecuteTemplate(w, "base", data); err != nil {
-		http.Error(w, err.Error(), 500)
+	_ = rs.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(rs.conn, b.String()); err != nil {
+		return nil, err
 	}
+	return readRESP(rs.rd)
 }
 
-func (s *server) gameForRequest(w http.ResponseWriter, r *http.Request, reset bool) *Game {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// redisError is an error reply ("-ERR ..."): the connection is still fine.
+type redisError string
 
-	cookie, err := r.Cookie("pg_sid")
-	if err != nil || cookie.Value == "" || reset {
-		id := newID()
-		g := newGame(6, 7, 3) // default (easy)
-		s.sessions[id] = g
-		http.SetCookie(w, &http.Cookie{
-			Name:     "pg_sid",
-			Value:    id,
-			Path:     "/",
-			HttpOnly: true,
-			SameSite: http.SameSiteLaxMode,
-			MaxAge:   60 * 60 * 24,
-		})
-		return g
+func (e redisError) Error() string { return string(e) }
+
+func readRESP(rd *bufio.Reader) (any, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
 	}
-	if g, ok := s.sessions[cookie.Value]; ok {
-		return g
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
 	}
-	g := newGame(6, 7, 3)
-	s.sessions[cookie.Value] = g
-	return g
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = readRESP(rd); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
 }
 
-func newID() string {
-	b := make([]byte, 16)
-	_, _ = crand.Read(b) // crypto-strong IDs for sessions
-	return hex.EncodeToString(b)
+// touched is what one request loaded from the store, written back by
+// persisting when it returns.
+type touched struct {
+	games   map[string]*Game
+	lobbies map[string]*lobby
 }
 
-func securityHeaders(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("X-Content-Type-Options", "nosniff")
-		w.Header().Set("Referrer-Policy", "no-referrer-when-downgrade")
-		w.Header().Set("X-Frame-Options", "DENY")
-		// Allow inline JS (for tiny template scripts) and audio from self
-		w.Header().Set("Content-Security-Policy",
-			"default-src 'self'; script-src 'self' 'unsafe-inline'; style-src 'self'; img-src 'self' data:; media-src 'self';")
+type touchedKey struct{}
 
-		next.ServeHTTP(w, r)
+// persisting writes back the games and lobbies h loaded (see Store).
+func (s *server) persisting(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t := &touched{games: map[string]*Game{}, lobbies: map[string]*lobby{}}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), touchedKey{}, t)))
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for id, g := range t.games {
+			s.store.PutGame(id, g)
+		}
+		for code, lb := range t.lobbies {
+			s.store.PutLobby(code, lb)
+		}
 	})
 }
 
-/*** AI helpers ***/
+func touchedBy(r *http.Request) *touched {
+	t, _ := r.Context().Value(touchedKey{}).(*touched)
+	return t
+}
 
-func chooseAIMove(g *Game) int {
-	bestCol := -1
-	bestScore := -1_000_000
-	for c := 0; c < g.Cols; c++ {
-		r := dropRow(g.Grid, c, g.GravityUp)
-		if r == -1 || g.Grid[r][c] != cellEmpty {
-			continue
+// lobby returns the lobby code for the rest of r, loading it once. The
+// caller holds s.mu.
+func (s *server) lobby(r *http.Request, code string) (*lobby, bool) {
+	t := touchedBy(r)
+	if t != nil {
+		if lb, ok := t.lobbies[code]; ok {
+			return lb, true
 		}
+	}
+	lb, ok := s.store.Lobby(code)
+	if ok && t != nil {
+		t.lobbies[code] = lb
+	}
+	return lb, ok
+}
 
-		// try Y
-		g.Grid[r][c] = cellY
-
-		// winning now?
-		if len(winningLine(g.Grid, r, c, cellY)) >= 4 {
-			g.Grid[r][c] = cellEmpty
-			return c
-		}
+// putLobby stores a new lobby. The caller holds s.mu.
+func (s *server) putLobby(r *http.Request, code string, lb *lobby) {
+	s.store.PutLobby(code, lb)
+	if t := touchedBy(r); t != nil {
+		t.lobbies[code] = lb
+	}
+}
 
-		// block R immediate win?
-		needBlock := false
-		for cc := 0; cc < g.Cols && !needBlock; cc++ {
-			rr := dropRow(g.Grid, cc, g.GravityUp)
-			if rr == -1 || g.Grid[rr][cc] != cellEmpty {
-				continue
-			}
-			g.Grid[rr][cc] = cellR
-			if len(winningLine(g.Grid, rr, cc, cellR)) >= 4 {
-				needBlock = true
-			}
-			g.Grid[rr][cc] = cellEmpty
-		}
+// deleteLobby drops the lobby, and keeps persisting from writing it back.
+// The caller holds s.mu.
+func (s *server) deleteLobby(r *http.Request, code string) {
+	s.store.DeleteLobby(code)
+	if t := touchedBy(r); t != nil {
+		delete(t.lobbies, code)
+	}
+}
 
-		score := evalBoard(g, cellY)
-		if needBlock {
-			score += 5000
+// sessionGame is lobby for session games.
+func (s *server) sessionGame(r *http.Request, id string) (*Game, bool) {
+	t := touchedBy(r)
+	if t != nil {
+		if g, ok := t.games[id]; ok {
+			return g, true
 		}
-		center := g.Cols / 2
-		score -= abs(c - center)
+	}
+	g, ok := s.store.Game(id)
+	if ok && t != nil {
+		t.games[id] = g
+	}
+	return g, ok
+}
 
-		g.Grid[r][c] = cellEmpty
-		if score > bestScore {
-			bestScore = score
-			bestCol = c
-		}
+// putSessionGame stores g as session id's game. The caller holds s.mu.
+func (s *server) putSessionGame(r *http.Request, id string, g *Game) {
+	s.store.PutGame(id, g)
+	if t := touchedBy(r); t != nil {
+		t.games[id] = g
 	}
-	return bestCol
 }
 
-func evalBoard(g *Game, me byte) int {
-	op := cellR
-	if me == cellR {
-		op = cellY
+/*** Online handlers (MVP, in-memory) ***/
+
+// Lobby codes: 4 characters, no look-alikes (no I, O, 0, 1).
+const (
+	lobbyCodeLetters = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	lobbyCodeLen     = 4
+)
+
+// defaultBlockedCodes are offensive or confusing codes; reservedCodes are kept
+// for internal use. Both are refused everywhere a code is chosen.
+var (
+	defaultBlockedCodes = []string{"FUCK", "CUNT", "DAMN", "PUTE", "CACA", "CUL2", "NULL", "NAN2"}
+	reservedCodes       = []string{"TEST", "DEMO", "ADMN", "ROOT", "API2"}
+)
+
+// loadBlockedCodes merges the built-in lists with a comma-separated list
+// (POWER4_BLOCKED_CODES) and a file with one code per line
+// (POWER4_BLOCKED_CODES_FILE, '#' starts a comment).
+func loadBlockedCodes(list, file string) map[string]bool {
+	out := make(map[string]bool)
+	add := func(c string) {
+		if c = strings.ToUpper(strings.TrimSpace(c)); c != "" {
+			out[c] = true
+		}
+	}
+	for _, c := range defaultBlockedCodes {
+		add(c)
+	}
+	for _, c := range reservedCodes {
+		add(c)
+	}
+	for _, c := range strings.Split(list, ",") {
+		add(c)
 	}
-
-	countK := func(p byte, k int) int {
-		h, w := len(g.Grid), len(g.Grid[0])
-		dirs := [][2]int{{0, 1}, {1, 0}, {1, 1}, {1, -1}}
-		total := 0
-		in := func(r, c int) bool { return r >= 0 && r < h && c >= 0 && c < w }
-		for r := 0; r < h; r++ {
-			for c := 0; c < w; c++ {
-				for _, d := range dirs {
-					cnt := 0
-					rr, cc := r, c
-					clear := true
-					for i := 0; i < k; i++ {
-						if !in(rr, cc) || g.Grid[rr][cc] == cellBlk {
-							clear = false
-							break
-						}
-						if g.Grid[rr][cc] == p {
-							cnt++
-						}
-						rr += d[0]
-						cc += d[1]
-					}
-					if clear && cnt == k {
-						total++
-					}
-				}
+	if file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			log.Printf("blocked codes: %v", err)
+		}
+		for _, line := range strings.Split(string(b), "\n") {
+			if i := strings.IndexByte(line, '#'); i >= 0 {
+				line = line[:i]
 			}
+			add(line)
 		}
-		return total
 	}
-
-	return 50*countK(me, 3) + 10*countK(me, 2) -
-		50*countK(op, 3) - 10*countK(op, 2)
+	return out
 }
 
-func abs(x int) int {
-	if x < 0 {
-		return -x
+// validLobbyCode reports whether code could have been generated by newLobbyCode.
+func validLobbyCode(code string) bool {
+	if len(code) != lobbyCodeLen {
+		return false
 	}
-	return x
+	for i := 0; i < len(code); i++ {
+		if strings.IndexByte(lobbyCodeLetters, code[i]) < 0 {
+			return false
+		}
+	}
+	return true
 }
 
-/*** Online handlers (MVP, in-memory) ***/
+// codeRandomTries is how many random codes newLobbyCode draws before
+// walking the whole code space.
+const codeRandomTries = 64
+
+// newLobbyCode returns a code that is neither blocked nor in use, so creating
+// a lobby never fails on a random collision. ok is false only when the whole
+// code space is taken. Must be called with s.mu held.
+func (s *server) newLobbyCode() (code string, ok bool) {
+	free := func(c string) bool {
+		_, used := s.store.Lobby(c)
+		return !used && !s.blockedCodes[c]
+	}
+	for i := 0; i < codeRandomTries; i++ {
+		b := make([]byte, lobbyCodeLen)
+		for i := range b {
+			b[i] = lobbyCodeLetters[mrand.Intn(len(lobbyCodeLetters))]
+		}
+		if c := string(b); free(c) {
+			return c, true
+		}
+	}
 
-func (s *server) newLobbyCode() string {
-	const letters = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
-	b := make([]byte, 4)
-	for i := range b {
-		b[i] = letters[mrand.Intn(len(letters))]
+	// crowded: walk every code once, from a random starting point
+	n := 1
+	for i := 0; i < lobbyCodeLen; i++ {
+		n *= len(lobbyCodeLetters)
+	}
+	start := mrand.Intn(n)
+	b := make([]byte, lobbyCodeLen)
+	for i := 0; i < n; i++ {
+		x := (start + i) % n
+		for j := lobbyCodeLen - 1; j >= 0; j-- {
+			b[j] = lobbyCodeLetters[x%len(lobbyCodeLetters)]
+			x /= len(lobbyCodeLetters)
+		}
+		if c := string(b); free(c) {
+			return c, true
+		}
 	}
-	return string(b)
+	return "", false
 }
 
 func (s *server) handleOnlineCreate(w http.ResponseWriter, r *http.Request) {
@@ -737,6 +5406,14 @@ func (s *server) handleOnlineCreate(w http.ResponseWriter, r *http.Request) {
 	if cols <= 0 {
 		cols = 7
 	}
+	if rows < minBoardSide || rows > maxBoardSide || cols < minBoardSide || cols > maxBoardSide {
+		http.Error(w, fmt.Sprintf("grille entre %d et %d de côté", minBoardSide, maxBoardSide), http.StatusBadRequest)
+		return
+	}
+	if blocks < 0 || blocks > maxBlocks(rows, cols) {
+		http.Error(w, fmt.Sprintf("entre 0 et %d blocs", maxBlocks(rows, cols)), http.StatusBadRequest)
+		return
+	}
 
 	p1 := r.URL.Query().Get("p1")
 	if p1 == "" {
@@ -750,74 +5427,341 @@ func (s *server) handleOnlineCreate(w http.ResponseWriter, r *http.Request) {
 	if diff == "" {
 		diff = "easy"
 	}
+	v := variant{Rows: rows, Cols: cols, Blocks: blocks, WinLen: 4, FlipEvery: 5}
+	if pv, ok := variantConfig(r.URL.Query().Get("variant")); ok {
+		v = pv
+	}
+	if d := r.URL.Query().Get("density"); d != "" {
+		n, err := strconv.Atoi(d)
+		if err != nil || n < 0 || n > maxBlockDensity {
+			http.Error(w, fmt.Sprintf("densité entre 0 et %d %%", maxBlockDensity), http.StatusBadRequest)
+			return
+		}
+		v.Blocks = blocksForDensity(v.Rows, v.Cols, n)
+	}
+	if r.URL.Query().Get("no_blocks") == "1" {
+		v.Blocks = 0
+	}
+	// gravity is easy to misread with a network in between: the creator
+	// can keep it fixed whatever the variant says
+	if r.URL.Query().Get("no_flip") == "1" {
+		v.FlipEvery = 0
+	}
+	earlyDraw := r.URL.Query().Get("early_draw") == "1"
+	center := r.URL.Query().Get("center_opening") == "1"
+	randomStart := r.URL.Query().Get("random_start") == "1"
+	solid := r.URL.Query().Get("solid") == "1"
+	flipGuard := r.URL.Query().Get("flip_guard") == "1"
+	flipMode := r.URL.Query().Get("flip_mode")
+	if flipMode != flipPerRound {
+		flipMode = ""
+	}
 
-	// NEW: allow custom code if provided
+	// NEW: allow custom code if provided (same rules as generated ones)
+	// (lower case is accepted and upper-cased; look-alikes are refused)
 	code := strings.ToUpper(strings.TrimSpace(r.URL.Query().Get("code")))
-	if len(code) < 4 {
-		code = s.newLobbyCode()
+	if code != "" && !validLobbyCode(code) {
+		http.Error(w, fmt.Sprintf("code de salle invalide : %d caractères parmi %s (ni I, ni O, ni 0, ni 1)", lobbyCodeLen, lobbyCodeLetters), http.StatusBadRequest)
+		return
+	}
+	if s.blockedCodes[code] {
+		http.Error(w, "code de salle invalide", http.StatusBadRequest)
+		return
 	}
 
+	sid := s.sessionID(w, r)
+	now := time.Now()
+
 	// avoid collisions
 	s.mu.Lock()
-	if _, exists := s.lobbies[code]; exists {
+	if prev, ok := s.recentLobbyOf(r, sid, code, now); ok {
+		s.mu.Unlock()
+		s.redirect(w, r, "/online/wait?code="+prev+"&side=R")
+		return
+	}
+	if code == "" {
+		var ok bool
+		if code, ok = s.newLobbyCode(); !ok {
+			s.mu.Unlock()
+			http.Error(w, "plus aucun code de salle disponible", http.StatusServiceUnavailable)
+			return
+		}
+	} else if _, exists := s.store.Lobby(code); exists {
 		s.mu.Unlock()
-		// simple UX: send back to start if code taken (you can render a page instead)
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		// simple UX: send back to start if a custom code is taken (you can render a page instead)
+		s.redirect(w, r, "/")
 		return
 	}
 
-	g := newGame(rows, cols, blocks)
-	g.Player1, g.Player2 = p1, p2
-	g.Difficulty = diff
-	g.Mode = "online"
-	g.LobbyCode = code
+	cfg := v.config()
+	cfg.Player1, cfg.Player2 = p1, p2
+	cfg.Difficulty = diff
+	cfg.Mode = "online"
+	cfg.EarlyDraw = earlyDraw
+	cfg.CenterOpening = center
+	cfg.RandomStart = randomStart
+	cfg.SolidBlocks = solid
+	cfg.FlipGuard = flipGuard
+	cfg.FlipMode = flipMode
+	cfg.LobbyCode = code
+	s.putLobby(r, code, newLobby(cfg, sid))
+	s.rememberCreate(sid, code, now)
+	s.mu.Unlock()
+
+	s.redirect(w, r, "/online/wait?code="+code+"&side=R")
+}
+
+// createDebounce is how long a lobby a session just created is handed back
+// instead of a new one, so a double click on "Créer" makes a single lobby.
+const createDebounce = 5 * time.Second
+
+type recentLobby struct {
+	code string
+	at   time.Time
+}
+
+// recentLobbyOf returns the lobby sid created less than createDebounce ago,
+// if it is still waiting for its guest and matches the custom code asked
+// for (if any). The caller holds s.mu.
+func (s *server) recentLobbyOf(r *http.Request, sid, code string, now time.Time) (string, bool) {
+	rc, ok := s.recentCreates[sid]
+	if !ok || now.Sub(rc.at) >= createDebounce || (code != "" && code != rc.code) {
+		return "", false
+	}
+	lb, ok := s.lobby(r, rc.code)
+	if !ok || lb.CreatorSID != sid || lb.HasYellow {
+		return "", false
+	}
+	return rc.code, true
+}
+
+// rememberCreate records that sid created code, forgetting the entries too
+// old to matter. The caller holds s.mu.
+func (s *server) rememberCreate(sid, code string, now time.Time) {
+	if s.recentCreates == nil {
+		s.recentCreates = make(map[string]recentLobby)
+	}
+	for k, rc := range s.recentCreates {
+		if now.Sub(rc.at) >= createDebounce {
+			delete(s.recentCreates, k)
+		}
+	}
+	s.recentCreates[sid] = recentLobby{code: code, at: now}
+}
+
+// newLobby is a lobby for cfg whose Red seat is held by session sid.
+func newLobby(cfg GameConfig, sid string) *lobby {
+	g := NewGameFromConfig(cfg)
 	g.ThisIsRed = true
+	now := time.Now()
+	return &lobby{Game: g, UpdatedAt: now, HasRed: true, CreatorSID: sid, LastSeenR: now, MoveToken: newID()}
+}
+
+// /online/{code}  — one shareable link for everyone. A GET only looks: a
+// session holding a seat goes back to it, anyone else gets a landing page
+// whose "Rejoindre" button posts to the same URL, or watches when both
+// seats are taken. The POST binds the seat, in this order: the session's
+// own seat; the free Yellow seat; nothing (they watch). An unknown code
+// creates the lobby with the default rules, the visitor holding Red.
+// Link previews and prefetchers only ever GET, so they never take a seat.
+func (s *server) handleOnlineLink(w http.ResponseWriter, r *http.Request) {
+	code := strings.ToUpper(strings.TrimPrefix(r.URL.Path, "/online/"))
+	if !validLobbyCode(code) || s.blockedCodes[code] {
+		s.renderNotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		s.onlineLinkLanding(w, r, code)
+	case http.MethodPost:
+		s.onlineLinkJoin(w, r, code)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, "method", http.StatusMethodNotAllowed)
+	}
+}
+
+// onlineLinkLanding is the GET side of handleOnlineLink: nothing is
+// created or bound.
+func (s *server) onlineLinkLanding(w http.ResponseWriter, r *http.Request, code string) {
+	sid := s.sessionID(w, r)
+
+	s.mu.Lock()
+	side, full := "", false
+	data := map[string]any{"LobbyCode": code, "Exists": false, "Host": ""}
+	if lb, ok := s.lobby(r, code); ok {
+		switch {
+		case lb.seatOwnedBy("R", sid):
+			side = "R"
+		case lb.seatOwnedBy("Y", sid):
+			side = "Y"
+		case lb.HasYellow:
+			full = true
+		}
+		data["Exists"] = true
+		if lb.Game != nil {
+			data["Host"] = lb.Game.Player1
+		}
+	}
+	s.mu.Unlock()
+
+	switch {
+	case side != "":
+		s.redirect(w, r, "/online/wait?code="+code+"&side="+side)
+	case full:
+		s.redirect(w, r, "/online/watch?code="+code)
+	default:
+		s.render(w, r, "invite", data)
+	}
+}
+
+// onlineLinkJoin is the POST side of handleOnlineLink.
+func (s *server) onlineLinkJoin(w http.ResponseWriter, r *http.Request, code string) {
+	if !parseForm(w, r) {
+		return
+	}
+	sid := s.sessionID(w, r)
 
-	lb := &lobby{Game: g, UpdatedAt: time.Now(), HasRed: true}
-	s.lobbies[code] = lb
+	s.mu.Lock()
+	side := ""
+	lb, ok := s.lobby(r, code)
+	switch {
+	case !ok:
+		cfg := rulesFor("easy", "").config()
+		cfg.Player1, cfg.Player2 = "Rouge", "Jaune"
+		if name := prefsForRequest(r).Name; name != "" {
+			cfg.Player1 = name
+		}
+		cfg.Difficulty = "easy"
+		cfg.Mode = "online"
+		cfg.LobbyCode = code
+		s.putLobby(r, code, newLobby(cfg, sid))
+		side = "R"
+	case lb.seatOwnedBy("R", sid):
+		side = "R"
+	case lb.seatOwnedBy("Y", sid):
+		side = "Y"
+	case !lb.HasYellow:
+		now := time.Now()
+		lb.HasYellow, lb.Joined = true, true
+		lb.YellowSID = sid
+		lb.UpdatedAt = now
+		lb.LastSeenY = now
+		side = "Y"
+	}
 	s.mu.Unlock()
 
-	http.Redirect(w, r, "/online/wait?code="+code+"&side=R", http.StatusSeeOther)
+	if side == "" {
+		s.redirect(w, r, "/online/watch?code="+code)
+		return
+	}
+	s.redirect(w, r, "/online/wait?code="+code+"&side="+side)
+}
+
+// GET /online/watch?code=XXXX
+// The game page without a seat: the board follows the game, nothing can be
+// played and the chat is read-only.
+func (s *server) handleOnlineWatch(w http.ResponseWriter, r *http.Request) {
+	code := strings.ToUpper(strings.TrimSpace(r.URL.Query().Get("code")))
+
+	s.mu.Lock()
+	lb, ok := s.lobby(r, code)
+	var data map[string]any
+	if ok && lb.Game != nil {
+		data = s.lobbyViewModel(lb, code, "")
+	}
+	s.mu.Unlock()
+	if !ok {
+		s.redirect(w, r, "/")
+		return
+	}
+	if data == nil {
+		s.renderNotReady(w, r, code, "")
+		return
+	}
+	s.render(w, r, "game", data)
 }
 
 func (s *server) handleOnlineJoin(w http.ResponseWriter, r *http.Request) {
 	code := strings.ToUpper(strings.TrimSpace(r.URL.Query().Get("code")))
 	if code == "" {
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		s.redirect(w, r, "/")
 		return
 	}
 
+	sid := s.sessionID(w, r)
+
 	s.mu.Lock()
-	lb, ok := s.lobbies[code]
+	lb, ok := s.lobby(r, code)
 	if ok && !lb.HasYellow {
-		lb.HasYellow = true
+		lb.HasYellow, lb.Joined = true, true
+		lb.YellowSID = sid
 		lb.UpdatedAt = time.Now()
+		lb.LastSeenY = time.Now()
+		// same browser on both seats (second tab): allowed, but unranked
+		if lb.Game != nil {
+			lb.Game.Unranked = sid == lb.CreatorSID
+		}
+	}
+	side := ""
+	switch {
+	case !ok:
+	case lb.seatOwnedBy("Y", sid):
+		side = "Y"
+	case lb.seatOwnedBy("R", sid):
+		side = "R"
 	}
 	s.mu.Unlock()
 
-	if !ok {
-		http.Redirect(w, r, "/", http.StatusSeeOther)
-		return
+	switch {
+	case !ok:
+		s.redirect(w, r, "/")
+	case side == "":
+		// Yellow is taken by someone else
+		s.redirect(w, r, "/online/watch?code="+code)
+	default:
+		s.redirect(w, r, "/online/wait?code="+code+"&side="+side)
 	}
-	http.Redirect(w, r, "/online/wait?code="+code+"&side=Y", http.StatusSeeOther)
 }
 
 func (s *server) handleOnlineWait(w http.ResponseWriter, r *http.Request) {
 	code := strings.ToUpper(strings.TrimSpace(r.URL.Query().Get("code")))
 	side := strings.ToUpper(strings.TrimSpace(r.URL.Query().Get("side")))
 	if code == "" || (side != "R" && side != "Y") {
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		s.redirect(w, r, "/")
 		return
 	}
+	sid := s.sessionID(w, r)
 
 	s.mu.Lock()
-	lb, ok := s.lobbies[code]
+	lb, ok := s.lobby(r, code)
+	if ok && !lb.seatOwnedBy(side, sid) {
+		s.mu.Unlock()
+		http.Error(w, "cette place ne vous appartient pas", http.StatusForbidden)
+		return
+	}
+	var data map[string]any
+	if ok {
+		lb.seen(side, time.Now())
+	}
+	if ok && lb.Game != nil {
+		data = s.lobbyViewModel(lb, code, side)
+	}
 	s.mu.Unlock()
 	if !ok {
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		s.redirect(w, r, "/")
+		return
+	}
+	if data == nil {
+		s.renderNotReady(w, r, code, side)
 		return
 	}
+	s.render(w, r, "game", data)
+}
 
+// lobbyViewModel is the game page data of lb seen from side. The caller
+// holds s.mu; the game is copied so rendering can happen after unlocking.
+func (s *server) lobbyViewModel(lb *lobby, code, side string) map[string]any {
 	gcopy := *lb.Game
 	gcopy.LobbyCode = code
 	gcopy.Mode = "online"
@@ -826,44 +5770,434 @@ func (s *server) handleOnlineWait(w http.ResponseWriter, r *http.Request) {
 	data := s.viewModel(&gcopy)
 	data["LobbyCode"] = code
 	data["IsOnline"] = true
-	s.render(w, "game", data)
+	data["HasYellow"] = lb.HasYellow
+	data["SeatGen"] = lb.SeatGen
+	data["MoveToken"] = lb.MoveToken
+	data["ReadyR"] = lb.ReadyR
+	data["ReadyY"] = lb.ReadyY
+	data["BothReady"] = lb.ReadyR && lb.ReadyY
+	data["MeReady"] = (side == "R" && lb.ReadyR) || (side == "Y" && lb.ReadyY)
+	data["PausedBy"] = lb.PausedBy
+	data["MePaused"] = lb.PausedBy != "" && lb.PausedBy == side
+	data["PausedByName"] = ""
+	if lb.PausedBy != "" {
+		data["PausedByName"] = playerName(lb.Game, lb.PausedBy[0])
+	}
+	data["Side"] = side
+	data["Spectator"] = side == ""
+	if side != "" {
+		data["Mine"] = piecesOf(lb.Game.Grid, side[0])
+	}
+	if !(lb.ReadyR && lb.ReadyY) || lb.PausedBy != "" || side == "" {
+		disabled := data["Disabled"].([]bool)
+		for c := range disabled {
+			disabled[c] = true
+		}
+	}
+	return data
+}
+
+// renderNotReady is shown when a lobby exists but has no game attached yet
+// (e.g. half-restored); the page refreshes itself until the game appears.
+func (s *server) renderNotReady(w http.ResponseWriter, r *http.Request, code, side string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Retry-After", "2")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	s.render(w, r, "notready", map[string]any{
+		"LobbyCode": code,
+		"Side":      side,
+	})
+}
+
+// renderNotFound answers unknown paths with the themed 404 page.
+func (s *server) renderNotFound(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusNotFound)
+	s.render(w, r, "notfound", map[string]any{"Path": r.URL.Path})
+}
+
+// staticFiles serves regular files from dir; missing files and directories
+// (no listings) get the themed 404 instead of the file server's plain one.
+func (s *server) staticFiles(dir string) http.Handler {
+	fs := http.FileServer(http.Dir(dir))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := filepath.Join(dir, filepath.FromSlash(path.Clean("/"+r.URL.Path)))
+		if fi, err := os.Stat(name); err != nil || fi.IsDir() {
+			s.renderNotFound(w, r)
+			return
+		}
+		fs.ServeHTTP(w, r)
+	})
+}
+
+// lobbyState is what /online/state reports, whatever the representation.
+type lobbyState struct {
+	OK           bool      `json:"ok"`
+	Event        string    `json:"event"`
+	Unranked     bool      `json:"unranked"`
+	GameOver     bool      `json:"gameOver"`
+	Current      string    `json:"current"`
+	CurrentName  string    `json:"currentName"`
+	YouAreRed    bool      `json:"youAreRed"`
+	YouAreYellow bool      `json:"youAreYellow"`
+	GravityUp    bool      `json:"gravityUp"`
+	Gravity      string    `json:"gravity"` // "down" | "up", the same as gravityUp
+	FlipIn       int       `json:"flipIn"`  // turns to the next scheduled flip, 0 = never
+	Turns        int       `json:"turns"`
+	RematchR     bool      `json:"rematchR"`
+	RematchY     bool      `json:"rematchY"`
+	HasYellow    bool      `json:"hasYellow"`
+	SeatGen      int       `json:"seatGen"`
+	ReadyR       bool      `json:"readyR"`
+	ReadyY       bool      `json:"readyY"`
+	LastMove     *dropInfo `json:"lastMove"` // null before the first move
+	WinLine      *winLine  `json:"winLine"`  // null until a line is completed
+	AwayR        bool      `json:"awayR"`
+	AwayY        bool      `json:"awayY"`
+	PausedBy     string    `json:"pausedBy"` // "R", "Y" or "" while running
+	PausedSecs   int       `json:"pausedSeconds"`
+	Grid         []string  `json:"-"` // compact form only: JSON clients get it from the page
+
+	// the caller's opponent is to move, see opponentThinking
+	OpponentThinking bool `json:"opponentThinking"`
+}
+
+// lobbyStateOf snapshots lb for side ("R", "Y" or ""). The caller holds s.mu.
+func lobbyStateOf(lb *lobby, side string, now time.Time) lobbyState {
+	g := lb.Game
+	gravity, flipIn := "down", 0
+	if g.GravityUp {
+		gravity = "up"
+	}
+	if n := g.flipPeriod(); n > 0 {
+		flipIn = n - g.Turns%n
+	}
+	return lobbyState{
+		OK:           true,
+		Event:        lastEvent(g),
+		WinLine:      winLineOf(g),
+		Unranked:     g.Unranked,
+		GameOver:     g.GameOver,
+		Current:      string(g.Current),
+		CurrentName:  playerName(g, g.Current),
+		YouAreRed:    side == "R",
+		YouAreYellow: side == "Y",
+		GravityUp:    g.GravityUp,
+		Gravity:      gravity,
+		FlipIn:       flipIn,
+		Turns:        g.Turns,
+		RematchR:     lb.RematchR,
+		RematchY:     lb.RematchY,
+		HasYellow:    lb.HasYellow,
+		SeatGen:      lb.SeatGen,
+		ReadyR:       lb.ReadyR,
+		ReadyY:       lb.ReadyY,
+		LastMove:     lastDrop(g),
+		AwayR:        now.Sub(lb.LastSeenR) > awayAfter,
+		AwayY:        lb.HasYellow && now.Sub(lb.LastSeenY) > awayAfter,
+		PausedBy:     lb.PausedBy,
+		PausedSecs:   int(lb.pausedFor(now).Seconds()),
+		Grid:         formatGrid(g.Grid),
+	}
+}
+
+// opponentThinking reports whether side has been waiting on the other seat
+// for at least after: a running game (both seats ready, neither paused nor
+// over) where the opponent is to move, timed from the last move (from the
+// game's creation before the first one), so chat or pings do not restart
+// the clock. Spectators ("" side) never wait on anyone.
+func opponentThinking(lb *lobby, side string, now time.Time, after time.Duration) bool {
+	g := lb.Game
+	if (side != "R" && side != "Y") || g.GameOver || !lb.HasYellow || !(lb.ReadyR && lb.ReadyY) || lb.PausedBy != "" {
+		return false
+	}
+	since := g.CreatedAt
+	if len(g.Moves) > 0 {
+		since = g.Moves[len(g.Moves)-1].At
+	}
+	return string(g.Current) != side && now.Sub(since) >= after
+}
+
+// Representations of /online/state, picked from the Accept header.
+const (
+	stateJSON    = "json"    // application/json, the default
+	stateHTML    = "html"    // text/html: the rendered board, for htmx-style swaps
+	stateCompact = "compact" // text/plain: see writeCompactState
+)
+
+// stateFormat picks the representation with the highest q in accept, the
+// first one listed winning ties. Anything unsupported falls back to JSON.
+func stateFormat(accept string) string {
+	best, bestQ := stateJSON, 0.0
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		q := 1.0
+		for _, p := range fields[1:] {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(p), "q="); ok {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+		}
+		var format string
+		switch strings.ToLower(strings.TrimSpace(fields[0])) {
+		case "application/json", "application/*", "*/*":
+			format = stateJSON
+		case "text/html", "text/*":
+			format = stateHTML
+		case "text/plain":
+			format = stateCompact
+		default:
+			continue
+		}
+		if q > bestQ {
+			best, bestQ = format, q
+		}
+	}
+	return best
+}
+
+// writeCompactState writes st as one line of key=value pairs (booleans as
+// 0/1) followed by the grid rows in /start/position notation.
+func writeCompactState(w io.Writer, st lobbyState) {
+	b := func(v bool) int {
+		if v {
+			return 1
+		}
+		return 0
+	}
+	fmt.Fprintf(w, "turns=%d current=%s gravityUp=%d flipIn=%d gameOver=%d event=%s hasYellow=%d readyR=%d readyY=%d seatGen=%d awayR=%d awayY=%d rematchR=%d rematchY=%d pausedBy=%s opponentThinking=%d\n",
+		st.Turns, st.Current, b(st.GravityUp), st.FlipIn, b(st.GameOver), st.Event, b(st.HasYellow), b(st.ReadyR), b(st.ReadyY),
+		st.SeatGen, b(st.AwayR), b(st.AwayY), b(st.RematchR), b(st.RematchY), st.PausedBy, b(st.OpponentThinking))
+	for _, row := range st.Grid {
+		fmt.Fprintln(w, row)
+	}
 }
 
+// GET /online/state?code=XXXX[&side=R|Y]
+// The same snapshot as JSON, as the rendered board (text/html) or in the
+// compact text form (text/plain), depending on Accept.
 func (s *server) handleOnlineState(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	// prevent any caching of the JSON response
+	// prevent any caching of the response; it also depends on Accept
 	w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate")
 	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Vary", "Accept")
+	format := stateFormat(r.Header.Get("Accept"))
 
 	code := strings.ToUpper(strings.TrimSpace(r.URL.Query().Get("code")))
 	if code == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		_, _ = w.Write([]byte(`{"err":"missing code"}`))
+		writeJSON(w, http.StatusBadRequest, map[string]string{"err": "missing code"})
 		return
 	}
+	// optional: lets the response say which seat the caller holds
+	side := strings.ToUpper(strings.TrimSpace(r.URL.Query().Get("side")))
 
 	s.mu.Lock()
-	lb, ok := s.lobbies[code]
-	if !ok || lb.Game == nil {
+	lb, ok := s.lobby(r, code)
+	if !ok {
 		s.mu.Unlock()
-		w.WriteHeader(http.StatusNotFound)
-		_, _ = w.Write([]byte(`{"err":"not found"}`))
+		writeJSON(w, http.StatusNotFound, map[string]string{"err": "not found"})
 		return
 	}
-	g := lb.Game
-	remR := lb.RematchR
-	remY := lb.RematchY
+	if lb.Game == nil {
+		s.mu.Unlock()
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"err": "not ready"})
+		return
+	}
+	now := time.Now()
+	st := lobbyStateOf(lb, side, now)
+	st.OpponentThinking = opponentThinking(lb, side, now, s.thinkingAfter)
+	var board map[string]any
+	if format == stateHTML {
+		board = s.lobbyViewModel(lb, code, side)
+	}
 	s.mu.Unlock()
 
-	_, _ = w.Write([]byte(fmt.Sprintf(
-		`{"ok":true,"gameOver":%t,"current":"%s","gravityUp":%t,"turns":%d,"rematchR":%t,"rematchY":%t}`,
-		g.GameOver, string(g.Current), g.GravityUp, g.Turns, remR, remY,
-	)))
+	switch format {
+	case stateHTML:
+		s.renderPartial(w, r, "board", board)
+	case stateCompact:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		writeCompactState(w, st)
+	default:
+		writeJSON(w, http.StatusOK, st)
+	}
+}
+
+// lobbyConfig is the immutable setup of a lobby's game, served once by
+// /online/config so /online/state can stay small.
+type lobbyConfig struct {
+	OK             bool     `json:"ok"`
+	Rows           int      `json:"rows"`
+	Cols           int      `json:"cols"`
+	Blocks         [][2]int `json:"blocks"` // [row, col]
+	SolidBlocks    bool     `json:"solidBlocks"`
+	Fairness       float64  `json:"fairness"` // see boardFairness
+	WinLen         int      `json:"winLen"`
+	WinLens        lineLens `json:"winLens"`
+	FlipEvery      int      `json:"flipEvery"`
+	FlipMode       string   `json:"flipMode"`
+	FlipGuard      bool     `json:"flipGuard"`
+	CenterOpening  bool     `json:"centerOpening"`
+	RandomStart    bool     `json:"randomStart"`
+	Starter        string   `json:"starter"` // "R" or "Y": who moves first
+	GravityStartUp bool     `json:"gravityStartUp"`
+	Variant        string   `json:"variant"`
+	Difficulty     string   `json:"difficulty"`
+	Player1        string   `json:"player1"`
+	Player2        string   `json:"player2"`
+}
+
+func configOf(g *Game) lobbyConfig {
+	blocks := [][2]int{}
+	layout := make([][]byte, g.Rows) // the board at turn 0
+	for r := range g.Grid {
+		layout[r] = make([]byte, g.Cols)
+		for c, v := range g.Grid[r] {
+			if isBlock(v) {
+				blocks = append(blocks, [2]int{r, c})
+				layout[r][c] = v
+			}
+		}
+	}
+	// gravity at turn 0, as recorded with the first move (flips may have
+	// been held back, so the count of turns alone does not tell)
+	startUp := g.GravityUp
+	if len(g.Moves) > 0 {
+		// a flip power-up records the gravity it produced
+		startUp = g.Moves[0].GravityUp != (g.Moves[0].Kind == "flip")
+	}
+	return lobbyConfig{
+		OK:             true,
+		Rows:           g.Rows,
+		Cols:           g.Cols,
+		Blocks:         blocks,
+		SolidBlocks:    g.SolidBlocks,
+		Fairness:       math.Round(boardFairness(layout, g.lens().shortest(), startUp)*100) / 100,
+		WinLen:         g.WinLen,
+		WinLens:        g.lens(),
+		FlipEvery:      g.FlipEvery,
+		FlipMode:       g.flipMode(),
+		FlipGuard:      g.FlipGuard,
+		CenterOpening:  g.CenterOpening,
+		RandomStart:    g.RandomStart,
+		Starter:        string(g.starter()),
+		GravityStartUp: startUp,
+		Variant:        g.Variant,
+		Difficulty:     g.Difficulty,
+		Player1:        g.Player1,
+		Player2:        g.Player2,
+	}
+}
+
+// GET /online/config?code=ABCD
+func (s *server) handleOnlineConfig(w http.ResponseWriter, r *http.Request) {
+	code := strings.ToUpper(strings.TrimSpace(r.URL.Query().Get("code")))
+	if code == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"err": "missing code"})
+		return
+	}
+
+	s.mu.Lock()
+	lb, ok := s.lobby(r, code)
+	var cfg lobbyConfig
+	ready := ok && lb.Game != nil
+	if ready {
+		cfg = configOf(lb.Game)
+	}
+	s.mu.Unlock()
+
+	switch {
+	case !ok:
+		writeJSON(w, http.StatusNotFound, map[string]string{"err": "not found"})
+	case !ready:
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"err": "not ready"})
+	default:
+		writeJSON(w, http.StatusOK, cfg)
+	}
+}
+
+// logEntry is one line of the public move log.
+type logEntry struct {
+	Turn         int    `json:"turn"`
+	Side         string `json:"side"`
+	Kind         string `json:"kind,omitempty"` // "" for a drop, else the power-up
+	Col          int    `json:"col"`
+	Row          int    `json:"row"` // resulting cell, -1 for power-ups
+	GravityUp    bool   `json:"gravityUp"`
+	FlippedAfter bool   `json:"flippedAfter"`
+	Hash         string `json:"hash"` // see chainLink
+}
+
+// moveLog turns g.Moves into log entries. A flip power-up records the
+// gravity it produced, so the gravity before it is the opposite one.
+func moveLog(g *Game) []logEntry {
+	out := make([]logEntry, len(g.Moves))
+	for i, m := range g.Moves {
+		next := g.GravityUp
+		if i+1 < len(g.Moves) {
+			n := g.Moves[i+1]
+			next = n.GravityUp != (n.Kind == "flip")
+		}
+		out[i] = logEntry{
+			Turn:         i + 1,
+			Side:         string(m.Side),
+			Kind:         m.Kind,
+			Col:          m.Col,
+			Row:          m.Row,
+			GravityUp:    m.GravityUp,
+			FlippedAfter: next != m.GravityUp,
+			Hash:         m.Hash,
+		}
+	}
+	return out
+}
+
+// GET /online/moves?code=XXXX  →  {"code":"XXXX","start":[...],"moves":[...],"chainHead":"…"}
+// Ordered history for spectators and reconnecting players. With the
+// starting board it is enough to check the hash chain (verifyChain).
+func (s *server) handleOnlineMoves(w http.ResponseWriter, r *http.Request) {
+	code := strings.ToUpper(strings.TrimSpace(r.URL.Query().Get("code")))
+	if code == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"err": "missing code"})
+		return
+	}
+
+	s.mu.Lock()
+	lb, ok := s.lobby(r, code)
+	var moves []logEntry
+	var start []string
+	var head string
+	if ok && lb.Game != nil {
+		moves = moveLog(lb.Game)
+		start, head = formatGrid(lb.Game.Start), lb.Game.chainHead()
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"err": "not found"})
+		return
+	}
+	if moves == nil {
+		moves = []logEntry{}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"code": code, "start": start, "moves": moves, "chainHead": head})
+}
+
+// writeJSON sends v as an uncached JSON response.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
 }
 
 func (s *server) handleOnlinePlay(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		s.redirect(w, r, "/")
+		return
+	}
+	if !parseForm(w, r) {
 		return
 	}
 
@@ -871,38 +6205,57 @@ func (s *server) handleOnlinePlay(w http.ResponseWriter, r *http.Request) {
 	side := strings.ToUpper(strings.TrimSpace(r.FormValue("side")))
 	colStr := r.FormValue("col")
 	c, _ := strconv.Atoi(colStr)
+	token := r.FormValue("token")
+	sid := s.sessionID(w, r)
 
 	s.mu.Lock()
-	lb, ok := s.lobbies[code]
-	if !ok || lb.Game == nil {
+	lb, ok := s.lobby(r, code)
+	if !ok {
+		s.mu.Unlock()
+		s.redirect(w, r, "/")
+		return
+	}
+	// the form's side is only a claim: the session must hold that seat
+	if !lb.seatOwnedBy(side, sid) {
+		s.mu.Unlock()
+		http.Error(w, "cette place ne vous appartient pas", http.StatusForbidden)
+		return
+	}
+	if lb.Game == nil {
+		s.mu.Unlock()
+		s.renderNotReady(w, r, code, side)
+		return
+	}
+	g := lb.Game
+
+	// stale or reused form: ignore, just show the current position
+	if token == "" || token != lb.MoveToken {
 		s.mu.Unlock()
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		s.redirect(w, r, "/online/wait?code="+code+"&side="+side)
 		return
 	}
-	g := lb.Game
 
 	// whose turn should it be?
 	expect := cellR
 	if side == "Y" {
 		expect = cellY
 	}
-	if g.Current != expect || g.GameOver {
+	if g.Current != expect || g.GameOver || !(lb.ReadyR && lb.ReadyY) || lb.PausedBy != "" {
 		s.mu.Unlock()
-		http.Redirect(w, r, "/online/wait?code="+code+"&side="+side, http.StatusSeeOther)
+		s.redirect(w, r, "/online/wait?code="+code+"&side="+side)
 		return
 	}
 
-	// drop the piece with current gravity
-	row := dropRow(g.Grid, c, g.GravityUp)
-	if row == -1 || g.Grid[row][c] != cellEmpty {
+	// drop the piece with current gravity (LastPlayed tells /result who
+	// just played)
+	row, ok := tryPlace(g, c, g.Current)
+	if !ok {
 		s.mu.Unlock()
-		http.Redirect(w, r, "/online/wait?code="+code+"&side="+side, http.StatusSeeOther)
+		s.redirect(w, r, "/online/wait?code="+code+"&side="+side)
 		return
 	}
-
-	g.Grid[row][c] = g.Current
-	g.Turns++
-	g.LastPlayed = g.Current // so /result knows who just played
+	lb.seen(side, time.Now())
+	lb.MoveToken = newID()
 
 	// win / draw?
 	if s.checkResult(g, row, c, g.Current) {
@@ -910,13 +6263,16 @@ func (s *server) handleOnlinePlay(w http.ResponseWriter, r *http.Request) {
 		lb.RematchR = false
 		lb.RematchY = false
 		lb.UpdatedAt = time.Now()
-		s.mu.Unlock()
 
 		// copy final state into session so /result has names, scores & LastPlayed
-		gs := s.gameForRequest(w, r, true)
-		*gs = *g
+		// (wins and draws alike; the player keeps their session cookie)
+		final := cloneGame(g)
+		final.ThisIsRed = side == "R"
+		s.mu.Unlock()
+		gs := s.gameForRequest(w, r, false)
+		*gs = *final
 
-		http.Redirect(w, r, "/result?code="+code+"&side="+side, http.StatusSeeOther)
+		s.redirect(w, r, "/result?code="+code+"&side="+side)
 		return
 	}
 
@@ -927,8 +6283,8 @@ func (s *server) handleOnlinePlay(w http.ResponseWriter, r *http.Request) {
 		g.Current = cellR
 	}
 
-	// flip gravity every 5 turns
-	if g.Turns%5 == 0 {
+	// flip gravity on schedule (see flipPeriod)
+	if flipDue(g, g.Current) {
 		g.GravityUp = !g.GravityUp
 		g.Message = ""
 	}
@@ -936,27 +6292,42 @@ func (s *server) handleOnlinePlay(w http.ResponseWriter, r *http.Request) {
 	lb.UpdatedAt = time.Now()
 	s.mu.Unlock()
 
-	http.Redirect(w, r, "/online/wait?code="+code+"&side="+side, http.StatusSeeOther)
+	s.redirect(w, r, "/online/wait?code="+code+"&side="+side)
 }
 
 func (s *server) handleOnlineReplay(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		s.redirect(w, r, "/")
+		return
+	}
+	if !parseForm(w, r) {
 		return
 	}
 	code := strings.ToUpper(strings.TrimSpace(r.FormValue("code")))
 	side := strings.ToUpper(strings.TrimSpace(r.FormValue("side"))) // "R" or "Y"
 
 	if code == "" || (side != "R" && side != "Y") {
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		s.redirect(w, r, "/")
 		return
 	}
+	sid := s.sessionID(w, r)
 
 	s.mu.Lock()
-	lb, ok := s.lobbies[code]
+	lb, ok := s.lobby(r, code)
 	if !ok || lb.Game == nil {
 		s.mu.Unlock()
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		s.redirect(w, r, "/")
+		return
+	}
+	if !lb.seatOwnedBy(side, sid) {
+		s.mu.Unlock()
+		http.Error(w, "cette place ne vous appartient pas", http.StatusForbidden)
+		return
+	}
+	// a vote only makes sense once the game is over
+	if !lb.Game.GameOver {
+		s.mu.Unlock()
+		s.redirect(w, r, "/online/wait?code="+code+"&side="+side)
 		return
 	}
 
@@ -970,30 +6341,326 @@ func (s *server) handleOnlineReplay(w http.ResponseWriter, r *http.Request) {
 	// 2) if both voted, start a new match with same settings + scores
 	if lb.RematchR && lb.RematchY {
 		old := lb.Game
-		diff := old.Difficulty
-		rows, cols, blocks := configByDifficulty(diff)
-
-		scoreR, scoreY := old.Scores.R, old.Scores.Y
-		p1, p2 := old.Player1, old.Player2
-
-		ng := newGame(rows, cols, blocks)
-		ng.Player1, ng.Player2 = p1, p2
-		ng.Scores.R, ng.Scores.Y = scoreR, scoreY
-		ng.Difficulty = diff
-		ng.Mode = "online"
-		ng.LobbyCode = code
+		ng := NewGameFromConfig(old.rematchConfig())
+		ng.Scores, ng.Series = old.Scores, old.Series
+		ng.Unranked = old.Unranked
 
 		lb.Game = ng
 		// reset votes for next game
 		lb.RematchR = false
 		lb.RematchY = false
+		lb.PausedBy, lb.PausedTotal = "", 0
 	}
 
 	lb.UpdatedAt = time.Now()
 	s.mu.Unlock()
 
 	// Stay on result screen; JS will see new game via /online/state and redirect to /online/wait
-	http.Redirect(w, r, "/result?code="+code+"&side="+side, http.StatusSeeOther)
+	s.redirect(w, r, "/result?code="+code+"&side="+side)
+}
+
+// POST /online/pause  (form: code, side)
+// Either seat may pause a running game: moves are refused and the forfeit
+// clock stops until /online/resume (or maxPause).
+func (s *server) handleOnlinePause(w http.ResponseWriter, r *http.Request) {
+	s.pauseOrResume(w, r, true)
+}
+
+// POST /online/resume  (form: code, side)
+// Only the seat that paused may resume.
+func (s *server) handleOnlineResume(w http.ResponseWriter, r *http.Request) {
+	s.pauseOrResume(w, r, false)
+}
+
+func (s *server) pauseOrResume(w http.ResponseWriter, r *http.Request, pause bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method", http.StatusMethodNotAllowed)
+		return
+	}
+	if !parseForm(w, r) {
+		return
+	}
+	code := strings.ToUpper(strings.TrimSpace(r.FormValue("code")))
+	side := strings.ToUpper(strings.TrimSpace(r.FormValue("side")))
+	sid := s.sessionID(w, r)
+
+	s.mu.Lock()
+	lb, ok := s.lobby(r, code)
+	if !ok {
+		s.mu.Unlock()
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if !lb.seatOwnedBy(side, sid) {
+		s.mu.Unlock()
+		http.Error(w, "cette place ne vous appartient pas", http.StatusForbidden)
+		return
+	}
+	now := time.Now()
+	switch {
+	case pause && !lb.pause(side, now):
+		s.mu.Unlock()
+		http.Error(w, "aucune partie en cours à mettre en pause", http.StatusConflict)
+		return
+	case !pause && lb.PausedBy != side:
+		s.mu.Unlock()
+		http.Error(w, "seul le joueur qui a mis en pause peut reprendre", http.StatusConflict)
+		return
+	case !pause:
+		lb.resume(now)
+	}
+	lb.seen(side, now)
+	lb.UpdatedAt = now
+	s.mu.Unlock()
+
+	s.redirect(w, r, "/online/wait?code="+code+"&side="+side)
+}
+
+// POST /online/kick  (form or query: code)
+// Frees the Yellow seat. Only the session that created the lobby may do it.
+func (s *server) handleOnlineKick(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method", http.StatusMethodNotAllowed)
+		return
+	}
+	if !parseForm(w, r) {
+		return
+	}
+	code := strings.ToUpper(strings.TrimSpace(r.FormValue("code")))
+	if code == "" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	sid := s.sessionID(w, r)
+
+	s.mu.Lock()
+	lb, ok := s.lobby(r, code)
+	if !ok {
+		s.mu.Unlock()
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if lb.CreatorSID == "" || lb.CreatorSID != sid {
+		s.mu.Unlock()
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if lb.HasYellow {
+		lb.resume(time.Now())
+		lb.HasYellow = false
+		lb.YellowSID = ""
+		lb.ReadyY = false
+		lb.SeatGen++
+		lb.RematchR = false
+		lb.RematchY = false
+		lb.UpdatedAt = time.Now()
+	}
+	s.mu.Unlock()
+
+	s.redirect(w, r, "/online/wait?code="+code+"&side=R")
+}
+
+// POST /online/fork?code=XXXX
+// Copies the lobby's current position into the caller's session as a local
+// two-player game, to try out variations; the live game is left untouched.
+func (s *server) handleOnlineFork(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method", http.StatusMethodNotAllowed)
+		return
+	}
+	if !parseForm(w, r) {
+		return
+	}
+	code := strings.ToUpper(strings.TrimSpace(r.FormValue("code")))
+
+	s.mu.Lock()
+	lb, ok := s.lobby(r, code)
+	var fork *Game
+	if ok && lb.Game != nil {
+		fork = cloneGame(lb.Game)
+	}
+	s.mu.Unlock()
+	if fork == nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	fork.Mode = "local"
+	fork.LobbyCode = ""
+	fork.ThisIsRed = false
+	fork.Unranked = true
+	fork.ConfirmMoves = false
+	fork.PendingCol = -1
+	fork.LastSeen, fork.Expired = time.Time{}, false
+	fork.Message = "🔀 Copie de la salle " + code + " : vos coups ici n’affectent pas la partie en ligne"
+
+	g := s.gameForRequest(w, r, false)
+	*g = *fork
+	s.redirect(w, r, "/game")
+}
+
+// POST /online/ready  (form: code, side)
+func (s *server) handleOnlineReady(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.redirect(w, r, "/")
+		return
+	}
+	if !parseForm(w, r) {
+		return
+	}
+	code := strings.ToUpper(strings.TrimSpace(r.FormValue("code")))
+	side := strings.ToUpper(strings.TrimSpace(r.FormValue("side")))
+	if code == "" || (side != "R" && side != "Y") {
+		s.redirect(w, r, "/")
+		return
+	}
+	sid := s.sessionID(w, r)
+
+	s.mu.Lock()
+	lb, ok := s.lobby(r, code)
+	if ok && !lb.seatOwnedBy(side, sid) {
+		s.mu.Unlock()
+		http.Error(w, "cette place ne vous appartient pas", http.StatusForbidden)
+		return
+	}
+	if ok {
+		if side == "R" {
+			lb.ReadyR = true
+		} else {
+			lb.ReadyY = true
+		}
+		lb.UpdatedAt = time.Now()
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		s.redirect(w, r, "/")
+		return
+	}
+	s.redirect(w, r, "/online/wait?code="+code+"&side="+side)
+}
+
+// POST /online/ping  (form or query: code, side)
+// Heartbeat sent by the online page; see sweepLobbies.
+func (s *server) handleOnlinePing(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method", http.StatusMethodNotAllowed)
+		return
+	}
+	if !parseForm(w, r) {
+		return
+	}
+	code := strings.ToUpper(strings.TrimSpace(r.FormValue("code")))
+	side := strings.ToUpper(strings.TrimSpace(r.FormValue("side")))
+	if code == "" || (side != "R" && side != "Y") {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	sid := s.sessionID(w, r)
+	s.mu.Lock()
+	lb, ok := s.lobby(r, code)
+	if ok && !lb.seatOwnedBy(side, sid) {
+		s.mu.Unlock()
+		http.Error(w, "cette place ne vous appartient pas", http.StatusForbidden)
+		return
+	}
+	if ok {
+		lb.seen(side, time.Now())
+	}
+	s.mu.Unlock()
+	if !ok {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*** Lobby sweeper ***/
+
+const (
+	// sweepEvery is how often the background sweeper runs.
+	sweepEvery = 5 * time.Second
+	// awayAfter without a heartbeat flags a seat as disconnected in /online/state.
+	awayAfter = 12 * time.Second
+	// maxPause is how long a pause lasts before the sweeper resumes the game.
+	maxPause = 5 * time.Minute
+	// lobbyIdleTTL without any change drops a lobby, as storeTTL does in Redis.
+	lobbyIdleTTL = storeTTL
+)
+
+func (s *server) runSweeper(every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for now := range t.C {
+		s.sweepLobbies(now)
+	}
+}
+
+// sweepLobbies drops expired lobbies (see lobbyExpired) and forfeits running
+// games whose player to move has sent no heartbeat for forfeitGrace. A ping
+// before that cancels the forfeit, and paused games are spared until
+// maxPause resumes them.
+func (s *server) sweepLobbies(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, code := range s.store.LobbyCodes() {
+		lb, ok := s.store.Lobby(code)
+		switch {
+		case !ok:
+		case s.lobbyExpired(lb, now):
+			s.store.DeleteLobby(code)
+		case s.sweepLobby(lb, now):
+			s.store.PutLobby(code, lb)
+		}
+	}
+}
+
+// lobbyExpired reports whether lb has been left alone for too long: an
+// invite nobody answered (no guest ever, no move) after unjoinedTTL, any
+// other lobby after lobbyIdleTTL. Both count from the last change.
+func (s *server) lobbyExpired(lb *lobby, now time.Time) bool {
+	idle := now.Sub(lb.UpdatedAt)
+	unjoined := !lb.Joined && !lb.HasYellow && (lb.Game == nil || len(lb.Game.Moves) == 0)
+	if unjoined && s.unjoinedTTL > 0 {
+		return idle > s.unjoinedTTL
+	}
+	return idle > lobbyIdleTTL
+}
+
+// sweepLobby applies sweepLobbies to one lobby and reports whether it
+// changed it.
+func (s *server) sweepLobby(lb *lobby, now time.Time) (changed bool) {
+	if lb.PausedBy != "" && now.Sub(lb.PausedAt) > maxPause {
+		lb.resume(now)
+		lb.UpdatedAt = now
+		changed = true
+	}
+	g := lb.Game
+	if s.forfeitGrace <= 0 || g == nil || g.GameOver || !lb.HasYellow || !(lb.ReadyR && lb.ReadyY) || lb.PausedBy != "" {
+		return changed
+	}
+	seen := lb.LastSeenR
+	if g.Current == cellY {
+		seen = lb.LastSeenY
+	}
+	if now.Sub(seen) <= s.forfeitGrace {
+		return changed
+	}
+	forfeit(g, g.Current)
+	s.countGameOver(g)
+	lb.RematchR, lb.RematchY = false, false
+	lb.UpdatedAt = now
+	return true
+}
+
+// forfeit ends g with a win for loser's opponent.
+func forfeit(g *Game, loser byte) {
+	winner := opponent(loser)
+	g.GameOver = true
+	g.GameOverReason = reasonTimeout
+	g.LastPlayed = winner
+	addScore(g, winner)
+	g.Message = "🔌 " + playerName(g, loser) + " s’est déconnecté — victoire par forfait"
 }
 
 // POST /chat/post  (form: code, side, name, text)
@@ -1002,6 +6669,9 @@ func (s *server) handleChatPost(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "method", http.StatusMethodNotAllowed)
 		return
 	}
+	if !parseForm(w, r) {
+		return
+	}
 
 	code := strings.ToUpper(strings.TrimSpace(r.FormValue("code")))
 	side := strings.ToUpper(strings.TrimSpace(r.FormValue("side"))) // "R" ou "Y"
@@ -1012,33 +6682,41 @@ func (s *server) handleChatPost(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "bad request", http.StatusBadRequest)
 		return
 	}
-	if len(text) > 240 { // petite limite
-		text = text[:240]
+	if utf8.RuneCountInString(text) > s.chatMaxLen {
+		http.Error(w, fmt.Sprintf("message trop long (%d caractères max)", s.chatMaxLen), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if s.chatLimiter != nil {
+		// a single bucket: spam spread over many lobbies still adds up
+		if ok, wait := s.chatLimiter.allow("", time.Now()); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "trop de messages, réessayez dans un instant", http.StatusTooManyRequests)
+			return
+		}
 	}
 	if name == "" {
 		name = "Joueur"
 	}
+	sid := s.sessionID(w, r)
 
 	s.mu.Lock()
-	lb, ok := s.lobbies[code]
+	lb, ok := s.lobby(r, code)
 	if !ok {
 		s.mu.Unlock()
 		http.Error(w, "not found", http.StatusNotFound)
 		return
 	}
-	lb.NextChatID++
-	msg := ChatMessage{
-		ID:   lb.NextChatID,
-		When: time.Now(),
-		Side: side,
-		Name: name,
-		Text: text,
+	if !lb.seatOwnedBy(side, sid) {
+		s.mu.Unlock()
+		http.Error(w, "cette place ne vous appartient pas", http.StatusForbidden)
+		return
 	}
-	lb.Chat = append(lb.Chat, msg)
-	// cap à ~200 messages
-	if len(lb.Chat) > 200 {
-		lb.Chat = lb.Chat[len(lb.Chat)-200:]
+	if lb.Game == nil {
+		s.mu.Unlock()
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
 	}
+	lb.addChat(ChatMessage{When: time.Now(), Side: side, Name: name, Text: text}, s.chatCap)
 	lb.UpdatedAt = time.Now()
 	s.mu.Unlock()
 
@@ -1066,9 +6744,10 @@ func (s *server) handleChatFeed(w http.ResponseWriter, r *http.Request) {
 	}
 
 	s.mu.Lock()
-	lb, ok := s.lobbies[code]
+	lb, ok := s.lobby(r, code)
+	ready := ok && lb.Game != nil
 	var out []ChatMessage
-	if ok {
+	if ready {
 		for _, m := range lb.Chat {
 			if m.ID > since {
 				out = append(out, m)
@@ -1081,6 +6760,11 @@ func (s *server) handleChatFeed(w http.ResponseWriter, r *http.Request) {
 		_, _ = w.Write([]byte(`{"err":"not found"}`))
 		return
 	}
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(`{"err":"not ready"}`))
+		return
+	}
 
 	// petite réponse JSON
 	builder := strings.Builder{}
@@ -1097,3 +6781,244 @@ func (s *server) handleChatFeed(w http.ResponseWriter, r *http.Request) {
 	builder.WriteString(`]}`)
 	_, _ = w.Write([]byte(builder.String()))
 }
+
+/*** Admin ***/
+
+// requireAdmin lets a request through only with "Authorization: Bearer
+// <POWER4_ADMIN_TOKEN>", compared in constant time.
+func (s *server) requireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || s.adminToken == "" || subtle.ConstantTimeCompare([]byte(got), []byte(s.adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"err": "unauthorized"})
+			return
+		}
+		h(w, r)
+	}
+}
+
+// adminLobbyView is everything /admin/lobby shows about a lobby. Session
+// ids stay out of it: they are credentials, only whether a seat is bound.
+type adminLobbyView struct {
+	Code       string      `json:"code"`
+	State      gameState   `json:"state"`
+	Config     lobbyConfig `json:"config"`
+	Moves      []logEntry  `json:"moves"`
+	Reason     overReason  `json:"reason"`
+	UpdatedAt  time.Time   `json:"updatedAt"`
+	HasRed     bool        `json:"hasRed"`
+	HasYellow  bool        `json:"hasYellow"`
+	YellowSeat bool        `json:"yellowSeatBound"`
+	SeatGen    int         `json:"seatGen"`
+	ReadyR     bool        `json:"readyR"`
+	ReadyY     bool        `json:"readyY"`
+	RematchR   bool        `json:"rematchR"`
+	RematchY   bool        `json:"rematchY"`
+	LastSeenR  time.Time   `json:"lastSeenR"`
+	LastSeenY  time.Time   `json:"lastSeenY"`
+	Chat       int         `json:"chatMessages"`
+}
+
+// GET /admin/lobby?code=XXXX  →  adminLobbyView
+func (s *server) handleAdminLobby(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"err": "GET only"})
+		return
+	}
+	code := strings.ToUpper(strings.TrimSpace(r.URL.Query().Get("code")))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lb, ok := s.lobby(r, code)
+	if !ok || lb.Game == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"err": "not found"})
+		return
+	}
+	g := lb.Game
+	writeJSON(w, http.StatusOK, adminLobbyView{
+		Code:       code,
+		State:      stateOf(g),
+		Config:     configOf(g),
+		Moves:      moveLog(g),
+		Reason:     g.GameOverReason,
+		UpdatedAt:  lb.UpdatedAt,
+		HasRed:     lb.HasRed,
+		HasYellow:  lb.HasYellow,
+		YellowSeat: lb.YellowSID != "",
+		SeatGen:    lb.SeatGen,
+		ReadyR:     lb.ReadyR,
+		ReadyY:     lb.ReadyY,
+		RematchR:   lb.RematchR,
+		RematchY:   lb.RematchY,
+		LastSeenR:  lb.LastSeenR,
+		LastSeenY:  lb.LastSeenY,
+		Chat:       len(lb.Chat),
+	})
+}
+
+// POST /admin/lobby/terminate?code=XXXX
+// Ends a stuck game and forgets the lobby; its players land back on the
+// start page at their next poll.
+func (s *server) handleAdminTerminate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"err": "POST only"})
+		return
+	}
+	code := strings.ToUpper(strings.TrimSpace(r.URL.Query().Get("code")))
+
+	s.mu.Lock()
+	lb, ok := s.lobby(r, code)
+	if ok {
+		if g := lb.Game; g != nil && !g.GameOver {
+			g.GameOver = true
+			g.GameOverReason = reasonAborted
+			g.Message = "⛔ Partie interrompue par un administrateur"
+		}
+		s.deleteLobby(r, code)
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"err": "not found"})
+		return
+	}
+	log.Printf("admin: lobby %s terminated", code)
+	writeJSON(w, http.StatusOK, map[string]any{"ok": true, "code": code})
+}
+
+/*** Bot tournament (CLI) ***/
+
+// tournamentSide is one bot's tally in a tournament summary.
+type tournamentSide struct {
+	AI      string  `json:"ai"`
+	Wins    int     `json:"wins"`
+	WinRate float64 `json:"winRate"`
+}
+
+// tournamentResult is printed as JSON by `tournament`.
+type tournamentResult struct {
+	Games      int            `json:"games"`
+	Difficulty string         `json:"difficulty"`
+	Variant    string         `json:"variant,omitempty"`
+	TieBreak   string         `json:"tieBreak"`
+	Seed       int64          `json:"seed,omitempty"`
+	A          tournamentSide `json:"a"`
+	B          tournamentSide `json:"b"`
+	Draws      int            `json:"draws"`
+	DrawRate   float64        `json:"drawRate"`
+	AvgTurns   float64        `json:"avgTurns"`
+}
+
+// runTournament parses the subcommand flags, plays the games and writes the
+// summary to out. It returns the process exit code.
+func runTournament(args []string, out, errOut io.Writer) int {
+	fs := flag.NewFlagSet("tournament", flag.ContinueOnError)
+	fs.SetOutput(errOut)
+	games := fs.Int("games", 100, "number of games (colors alternate)")
+	a := fs.String("a", "balanced", "AI personality of bot A")
+	b := fs.String("b", "aggressive", "AI personality of bot B")
+	diff := fs.String("difficulty", "easy", "board preset: easy, normal, hard")
+	variantName := fs.String("variant", "", "variant (overrides difficulty)")
+	tieBreak := fs.String("tiebreak", tieLeftmost, "tie-break among equal moves: leftmost, center, seeded")
+	seed := fs.Int64("seed", 0, "seed for the block layouts and the seeded tie-break (0 = random layouts)")
+	ignoreReplies := fs.Bool("ignore-replies", false, "skip the AI's check of the opponent's winning replies")
+	selective := fs.Int("selective", 0, "own moves searched ahead along forcing lines (0 or 1 = one ply)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	pa, okA := lookupAIPersonality(*a)
+	pb, okB := lookupAIPersonality(*b)
+	if !okA || !okB || *games <= 0 {
+		fmt.Fprintln(errOut, "tournament: unknown personality or non-positive -games")
+		return 2
+	}
+	if !validTieBreak(*tieBreak) {
+		fmt.Fprintln(errOut, "tournament: unknown -tiebreak")
+		return 2
+	}
+	pa.TieBreak, pb.TieBreak = *tieBreak, *tieBreak
+	pa.Seed, pb.Seed = *seed, *seed
+	pa.IgnoreReplies, pb.IgnoreReplies = *ignoreReplies, *ignoreReplies
+	pa.Selective, pb.Selective = *selective, *selective
+
+	res := playTournament(*games, rulesFor(*diff, *variantName), pa, pb)
+	res.Difficulty, res.Variant = *diff, *variantName
+	res.TieBreak, res.Seed = *tieBreak, *seed
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(res); err != nil {
+		return 1
+	}
+	return 0
+}
+
+func lookupAIPersonality(name string) (aiPersonality, bool) {
+	for _, p := range aiPersonalities {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return aiPersonality{}, false
+}
+
+// playTournament plays n headless games between a and b on boards built
+// from v, a taking Red in even games. With a non-zero a.Seed, game i uses
+// layout seed a.Seed+i, so the whole run can be replayed.
+func playTournament(n int, v variant, a, b aiPersonality) tournamentResult {
+	res := tournamentResult{Games: n, A: tournamentSide{AI: a.Name}, B: tournamentSide{AI: b.Name}}
+	turns := 0
+	for i := 0; i < n; i++ {
+		red, yellow := a, b
+		if i%2 == 1 {
+			red, yellow = b, a
+		}
+		cfg := v.config()
+		if a.Seed != 0 {
+			cfg.Seed = a.Seed + int64(i)
+		}
+		g := playHeadless(NewGameFromConfig(cfg), red, yellow)
+		turns += g.Turns
+		switch {
+		case g.GameOverReason != reasonConnect:
+			res.Draws++
+		case (g.LastPlayed == cellR) == (i%2 == 0):
+			res.A.Wins++
+		default:
+			res.B.Wins++
+		}
+	}
+	res.A.WinRate = float64(res.A.Wins) / float64(n)
+	res.B.WinRate = float64(res.B.Wins) / float64(n)
+	res.DrawRate = float64(res.Draws) / float64(n)
+	res.AvgTurns = float64(turns) / float64(n)
+	return res
+}
+
+// playHeadless runs g to the end with the same rules as /play: landing,
+// win/draw check, turn switch and scheduled gravity flips.
+func playHeadless(g *Game, red, yellow aiPersonality) *Game {
+	var s server // checkResult needs no server state
+	for !g.GameOver {
+		g.AI = red
+		if g.Current == cellY {
+			g.AI = yellow
+		}
+		c := chooseMove(g, g.Current)
+		if c < 0 {
+			// nowhere to play: call it a draw
+			g.GameOver = true
+			g.GameOverReason = reasonDraw
+			break
+		}
+		row, _ := tryPlace(g, c, g.Current)
+		if s.checkResult(g, row, c, g.Current) {
+			break
+		}
+		g.Current = nextPlayer(g, g.Current)
+		if flipDue(g, g.Current) {
+			g.GravityUp = !g.GravityUp
+		}
+	}
+	return g
+}
@@ -0,0 +1,3628 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	mrand "math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestServer is a server with the embedded templates, an in-memory store
+// and the defaults main applies when no environment variable is set.
+func newTestServer() *server {
+	return &server{
+		tpl:          template.Must(template.New("base").Parse(baseTpl + startTpl + gameTpl + resultTpl)),
+		store:        newMemStore(),
+		cookieName:   "pg_sid",
+		blockedCodes: loadBlockedCodes("", ""),
+		chatCap:      defaultChatCap,
+		chatMaxLen:   defaultChatMaxLen,
+		startedAt:    time.Now(),
+	}
+}
+
+// newSession stores g (a default game when nil) under a fresh session and
+// returns the cookie that selects it.
+func newSession(s *server, g *Game) *http.Cookie {
+	if g == nil {
+		g = NewGameFromConfig(defaultConfig())
+	}
+	id := newID()
+	s.store.PutGame(id, g)
+	return &http.Cookie{Name: s.cookieName, Value: id}
+}
+
+// sessionOf is the game stored for the session of c.
+func sessionOf(t *testing.T, s *server, c *http.Cookie) *Game {
+	t.Helper()
+	g, ok := s.store.Game(c.Value)
+	if !ok {
+		t.Fatalf("no game for session %s", c.Value)
+	}
+	return g
+}
+
+// get calls h with a GET of target carrying cookies.
+func get(h http.HandlerFunc, target string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rec := httptest.NewRecorder()
+	h(rec, req)
+	return rec
+}
+
+// post calls h with form url-encoded in the body of a POST to target.
+func post(h http.HandlerFunc, target string, form url.Values, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rec := httptest.NewRecorder()
+	h(rec, req)
+	return rec
+}
+
+// issuedSession is the game of the session cookie rec hands out, for
+// handlers that start a fresh session.
+func issuedSession(t *testing.T, s *server, rec *httptest.ResponseRecorder) *Game {
+	t.Helper()
+	return sessionOf(t, s, issuedCookie(t, s, rec))
+}
+
+// issuedCookie is the session cookie rec sets.
+func issuedCookie(t *testing.T, s *server, rec *httptest.ResponseRecorder) *http.Cookie {
+	t.Helper()
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == s.cookieName {
+			return c
+		}
+	}
+	t.Fatalf("no %s cookie issued", s.cookieName)
+	return nil
+}
+
+// redirectQuery is the query string of rec's redirect.
+func redirectQuery(t *testing.T, rec *httptest.ResponseRecorder) url.Values {
+	t.Helper()
+	u, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil || u.Path == "" {
+		t.Fatalf("status %d, no redirect (%q)", rec.Code, rec.Header().Get("Location"))
+	}
+	return u.Query()
+}
+
+// seatedLobby stores an online lobby playing cfg whose two seats are held
+// by fresh sessions, both ready, and returns its code and their cookies.
+func seatedLobby(s *server, cfg GameConfig) (code string, red, yellow *http.Cookie) {
+	red, yellow = newSession(s, nil), newSession(s, nil)
+	code, _ = s.newLobbyCode()
+	cfg.Mode, cfg.LobbyCode = "online", code
+	lb := newLobby(cfg, red.Value)
+	lb.HasYellow, lb.Joined, lb.YellowSID = true, true, yellow.Value
+	lb.LastSeenY = lb.LastSeenR
+	lb.ReadyR, lb.ReadyY = true, true
+	s.store.PutLobby(code, lb)
+	return code, red, yellow
+}
+
+// everyLobbyCode calls fn with each code newLobbyCode could return.
+func everyLobbyCode(fn func(code string)) {
+	for _, a := range lobbyCodeLetters {
+		for _, b := range lobbyCodeLetters {
+			for _, c := range lobbyCodeLetters {
+				for _, d := range lobbyCodeLetters {
+					fn(string([]rune{a, b, c, d}))
+				}
+			}
+		}
+	}
+}
+
+// classic is the config of a plain 6×7 board: no blocks, no flips.
+func classic() GameConfig {
+	return rulesFor("", "classic").config()
+}
+
+// gridOf parses a /start/position board, failing the test on error.
+func gridOf(t *testing.T, rows ...string) [][]byte {
+	t.Helper()
+	grid, err := parsePosition(strings.Join(rows, "/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return grid
+}
+
+func TestThinkStatsAggregatesPerSide(t *testing.T) {
+	g := NewGameFromConfig(GameConfig{Rows: 6, Cols: 7})
+	g.CreatedAt = time.Now().Add(-3 * time.Second)
+	recordMove(g, 5, 0, cellR)
+	if th := g.Moves[0].Think; th < 3*time.Second || th > 4*time.Second {
+		t.Fatalf("first move think = %s, want about 3s since creation", th)
+	}
+
+	moves := []Move{
+		{Side: cellR, Think: 2 * time.Second},
+		{Side: cellY, Think: 1500 * time.Millisecond},
+		{Side: cellR, Think: 4 * time.Second},
+		{Side: cellY, Think: 500 * time.Millisecond},
+		{Side: cellR, Think: 3 * time.Second},
+	}
+	if got, want := thinkStats(moves, cellR), (thinkStat{Moves: 3, Avg: "3.0s", Max: "4.0s"}); got != want {
+		t.Errorf("red = %+v, want %+v", got, want)
+	}
+	if got, want := thinkStats(moves, cellY), (thinkStat{Moves: 2, Avg: "1.0s", Max: "1.5s"}); got != want {
+		t.Errorf("yellow = %+v, want %+v", got, want)
+	}
+	if got := thinkStats(moves, cellG); got != (thinkStat{}) {
+		t.Errorf("no moves = %+v, want zero", got)
+	}
+}
+
+func TestUnknownThemeFallsBackToDefault(t *testing.T) {
+	if got := themeByName("<script>"); got.Name != themes[0].Name {
+		t.Fatalf("themeByName = %q, want the default %q", got.Name, themes[0].Name)
+	}
+	s := newTestServer()
+	rec := get(s.handleStart, "/", &http.Cookie{Name: "pg_theme", Value: "nope\"><b>"}, newSession(s, nil))
+	body := rec.Body.String()
+	if !strings.Contains(body, `class="theme-`+themes[0].Name+` `) {
+		t.Errorf("body class does not use the default theme")
+	}
+	if strings.Contains(body, "nope") {
+		t.Errorf("unknown theme name echoed into the page")
+	}
+}
+
+func TestOnlyTheCreatorCanKick(t *testing.T) {
+	s := newTestServer()
+	code, red, yellow := seatedLobby(s, classic())
+	lb, _ := s.store.Lobby(code)
+
+	for name, c := range map[string]*http.Cookie{"guest": yellow, "stranger": newSession(s, nil)} {
+		if rec := post(s.handleOnlineKick, "/online/kick", url.Values{"code": {code}}, c); rec.Code != http.StatusForbidden {
+			t.Errorf("%s kick: status %d, want 403", name, rec.Code)
+		}
+	}
+	if !lb.HasYellow || lb.YellowSID != yellow.Value {
+		t.Fatal("a refused kick freed the Yellow seat")
+	}
+
+	if rec := post(s.handleOnlineKick, "/online/kick", url.Values{"code": {code}}, red); rec.Code != http.StatusSeeOther {
+		t.Fatalf("creator kick: status %d, want 303", rec.Code)
+	}
+	if lb.HasYellow || lb.YellowSID != "" || lb.SeatGen != 1 {
+		t.Errorf("after kick: HasYellow=%t YellowSID=%q SeatGen=%d", lb.HasYellow, lb.YellowSID, lb.SeatGen)
+	}
+}
+
+func TestVariantPresets(t *testing.T) {
+	want := map[string]variant{
+		"classic":   {Rows: 6, Cols: 7, Blocks: 0, WinLen: 4, FlipEvery: 0},
+		"chaos":     {Rows: 6, Cols: 8, Blocks: 10, WinLen: 4, FlipEvery: 3},
+		"marathon":  {Rows: 8, Cols: 10, Blocks: 6, WinLen: 5, FlipEvery: 5},
+		"diagonals": {Rows: 7, Cols: 8, Blocks: 4, WinLen: 4, WinBy: dirLens{D: 5}, FlipEvery: 5},
+	}
+	if len(variants) != len(want) {
+		t.Fatalf("%d variants, want %d", len(variants), len(want))
+	}
+	for name, w := range want {
+		v, ok := variantConfig(name)
+		if !ok {
+			t.Errorf("%s: missing", name)
+			continue
+		}
+		v.Name, v.Label = "", ""
+		if v != w {
+			t.Errorf("%s = %+v, want %+v", name, v, w)
+		}
+
+		// the same preset reaches a local game and an online lobby
+		sr := startRequest{Variant: name}
+		sv, err := sr.normalize()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		g := NewGameFromConfig(sr.config(sv))
+		if g.Rows != w.Rows || g.Cols != w.Cols || g.WinLen != w.WinLen || g.FlipEvery != w.FlipEvery || g.Variant != name {
+			t.Errorf("%s local game: %dx%d align %d flip %d variant %q", name, g.Rows, g.Cols, g.WinLen, g.FlipEvery, g.Variant)
+		}
+		s := newTestServer()
+		rec := get(s.handleOnlineCreate, "/online/create?variant="+name, newSession(s, nil))
+		lb, ok := s.store.Lobby(redirectQuery(t, rec).Get("code"))
+		if !ok {
+			t.Fatalf("%s: no lobby created", name)
+		}
+		if og := lb.Game; og.Rows != w.Rows || og.Cols != w.Cols || og.WinLen != w.WinLen || og.FlipEvery != w.FlipEvery || og.Blocks != w.Blocks {
+			t.Errorf("%s online game: %dx%d align %d flip %d blocks %d", name, og.Rows, og.Cols, og.WinLen, og.FlipEvery, og.Blocks)
+		}
+	}
+}
+
+func TestLobbyWithoutGameIsNotReady(t *testing.T) {
+	s := newTestServer()
+	red := newSession(s, nil)
+	s.store.PutLobby("NGME", &lobby{HasRed: true, CreatorSID: red.Value, UpdatedAt: time.Now(), MoveToken: "tok"})
+	// a panic would come back as recoverPanics' 500
+	safe := func(h http.HandlerFunc) http.HandlerFunc { return recoverPanics(h).ServeHTTP }
+	form := url.Values{"code": {"NGME"}, "side": {"R"}, "col": {"0"}, "token": {"tok"}, "text": {"salut"}}
+
+	for _, tc := range []struct {
+		name string
+		rec  *httptest.ResponseRecorder
+		want int
+	}{
+		{"wait", get(safe(s.handleOnlineWait), "/online/wait?code=NGME&side=R", red), http.StatusServiceUnavailable},
+		{"watch", get(safe(s.handleOnlineWatch), "/online/watch?code=NGME"), http.StatusServiceUnavailable},
+		{"play", post(safe(s.handleOnlinePlay), "/online/play", form, red), http.StatusServiceUnavailable},
+		{"state", get(safe(s.handleOnlineState), "/online/state?code=NGME&side=R"), http.StatusServiceUnavailable},
+		{"config", get(safe(s.handleOnlineConfig), "/online/config?code=NGME"), http.StatusServiceUnavailable},
+		{"chat post", post(safe(s.handleChatPost), "/chat/post", form, red), http.StatusServiceUnavailable},
+		{"chat feed", get(safe(s.handleChatFeed), "/chat/feed?code=NGME"), http.StatusServiceUnavailable},
+		{"moves", get(safe(s.handleOnlineMoves), "/online/moves?code=NGME"), http.StatusOK},
+		{"result", get(safe(s.handleResult), "/result?code=NGME&side=R", red), http.StatusOK},
+	} {
+		if tc.rec.Code != tc.want {
+			t.Errorf("%s: status %d, want %d", tc.name, tc.rec.Code, tc.want)
+		}
+	}
+	s.sweepLobbies(time.Now()) // must not panic either
+}
+
+func TestSecureCookies(t *testing.T) {
+	secure := func(s *server, header string) bool {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if header != "" {
+			req.Header.Set("X-Forwarded-Proto", header)
+		}
+		rec := httptest.NewRecorder()
+		s.sessionID(rec, req)
+		cookies := rec.Result().Cookies()
+		if len(cookies) != 1 || cookies[0].Name != s.cookieName {
+			t.Fatalf("cookies = %v, want one session cookie", cookies)
+		}
+		return cookies[0].Secure
+	}
+	s := newTestServer()
+	if secure(s, "") {
+		t.Error("plain HTTP: Secure set without POWER4_SECURE_COOKIES")
+	}
+	if !secure(s, "https") {
+		t.Error("behind a TLS proxy: Secure missing")
+	}
+	s.secureCookies = true // POWER4_SECURE_COOKIES=1
+	if !secure(s, "") {
+		t.Error("POWER4_SECURE_COOKIES=1: Secure missing")
+	}
+}
+
+func TestAIPersonalitiesDiverge(t *testing.T) {
+	// Yellow can build on its pair or spoil Red's two open lines
+	g := NewGameFromConfig(GameConfig{Grid: gridOf(t,
+		".......",
+		".......",
+		".......",
+		".......",
+		"......Y",
+		"R..RRYY",
+	)})
+	g.AI = aiPersonalityByName("aggressive")
+	attack := chooseMove(g, cellY)
+	g.AI = aiPersonalityByName("defensive")
+	defend := chooseMove(g, cellY)
+	if attack != 6 || defend != 2 {
+		t.Errorf("aggressive plays %d, defensive %d; want 6 and 2", attack, defend)
+	}
+}
+
+func TestConfirmMoves(t *testing.T) {
+	s := newTestServer()
+	cfg := classic()
+	cfg.ConfirmMoves = true
+	c := newSession(s, NewGameFromConfig(cfg))
+	g := sessionOf(t, s, c)
+	play := func(col string) { post(s.handlePlay, "/play", url.Values{"col": {col}}, c) }
+
+	// set, then confirm with a second tap on the same column
+	play("3")
+	if g.PendingCol != 3 || g.Turns != 0 {
+		t.Fatalf("first tap: pending %d, turns %d; want 3 and 0", g.PendingCol, g.Turns)
+	}
+	if data := s.viewModel(g); data["PendingCol"] != 3 {
+		t.Errorf("view model PendingCol = %v, want 3", data["PendingCol"])
+	}
+	play("3")
+	if g.PendingCol != -1 || g.Turns != 1 || g.Grid[5][3] != cellR {
+		t.Fatalf("confirm: pending %d, turns %d, cell %q", g.PendingCol, g.Turns, g.Grid[5][3])
+	}
+
+	// set, then change column: only the selection moves
+	play("1")
+	play("5")
+	if g.PendingCol != 5 || g.Turns != 1 {
+		t.Fatalf("change: pending %d, turns %d; want 5 and 1", g.PendingCol, g.Turns)
+	}
+	play("5")
+	if g.Turns != 2 || g.Grid[5][5] != cellY || g.Grid[5][1] != cellEmpty {
+		t.Errorf("after changing column: turns %d, col 5 %q, col 1 %q", g.Turns, g.Grid[5][5], g.Grid[5][1])
+	}
+}
+
+func TestOnlineConfigMatchesLobbyGame(t *testing.T) {
+	s := newTestServer()
+	cfg := rulesFor("", "chaos").config()
+	cfg.Player1, cfg.Player2 = "Ana", "Bo"
+	code, _, _ := seatedLobby(s, cfg)
+	lb, _ := s.store.Lobby(code)
+	g := lb.Game
+
+	rec := get(s.handleOnlineConfig, "/online/config?code="+code)
+	var got lobbyConfig
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %v", rec.Code, err)
+	}
+	if got.Rows != g.Rows || got.Cols != g.Cols || got.WinLen != g.WinLen || got.FlipEvery != g.FlipEvery ||
+		got.Variant != "chaos" || got.Player1 != "Ana" || got.Player2 != "Bo" || got.Starter != "R" || got.GravityStartUp {
+		t.Errorf("config = %+v, game %dx%d align %d flip %d", got, g.Rows, g.Cols, g.WinLen, g.FlipEvery)
+	}
+	if len(got.Blocks) != g.Blocks {
+		t.Fatalf("%d blocks listed, the game rolled %d", len(got.Blocks), g.Blocks)
+	}
+	for _, b := range got.Blocks {
+		if !isBlock(g.Grid[b[0]][b[1]]) {
+			t.Errorf("listed block %v is %q on the board", b, g.Grid[b[0]][b[1]])
+		}
+	}
+}
+
+func TestRollBlocksRegeneratesBoardsWithoutALine(t *testing.T) {
+	if hasWinnableLine(gridOf(t, "X...", "..X.", "...X", ".X.."), 4) {
+		t.Fatal("every line of this board holds a block")
+	}
+	if !hasWinnableLine(gridOf(t, "X...", "..X.", "....", ".X.."), 4) {
+		t.Fatal("row 3 is free")
+	}
+
+	// find a seed whose first layout closes every line, then roll with it
+	cfg := GameConfig{Rows: 4, Cols: 4}
+	n := maxBlocks(cfg.Rows, cfg.Cols)
+	for seed := int64(1); seed < 10_000; seed++ {
+		grid := make([][]byte, cfg.Rows)
+		for r := range grid {
+			grid[r] = make([]byte, cfg.Cols)
+		}
+		placeBlocks(grid, n, cellBlk, mrand.New(mrand.NewSource(seed)))
+		if hasWinnableLine(grid, 4) {
+			continue
+		}
+		cfg.Blocks, cfg.Seed = n, seed
+		if g := NewGameFromConfig(cfg); !hasWinnableLine(g.Grid, 4) {
+			t.Fatalf("seed %d: the layout was kept without any open line:\n%s", seed, strings.Join(formatGrid(g.Grid), "\n"))
+		}
+		return
+	}
+	t.Fatal("no pathological seed found")
+}
+
+func TestOnlineMovesWaitForBothReady(t *testing.T) {
+	s := newTestServer()
+	code, red, yellow := seatedLobby(s, classic())
+	lb, _ := s.store.Lobby(code)
+	lb.ReadyR, lb.ReadyY = false, false
+	play := func() {
+		post(s.handleOnlinePlay, "/online/play", url.Values{"code": {code}, "side": {"R"}, "col": {"3"}, "token": {lb.MoveToken}}, red)
+	}
+	ready := func(side string, c *http.Cookie) {
+		post(s.handleOnlineReady, "/online/ready", url.Values{"code": {code}, "side": {side}}, c)
+	}
+
+	play()
+	ready("R", red)
+	play()
+	if lb.Game.Turns != 0 {
+		t.Fatalf("a move was accepted before Yellow was ready (turns %d)", lb.Game.Turns)
+	}
+	ready("Y", yellow)
+	if !lb.ReadyR || !lb.ReadyY {
+		t.Fatalf("ready flags R=%t Y=%t", lb.ReadyR, lb.ReadyY)
+	}
+	play()
+	if lb.Game.Turns != 1 {
+		t.Errorf("the move was refused once both seats were ready (turns %d)", lb.Game.Turns)
+	}
+}
+
+func TestLastDropFallsThroughBlocks(t *testing.T) {
+	g, err := gameFromGrid(GameConfig{Difficulty: "custom", Grid: gridOf(t,
+		".......",
+		".......",
+		"X......",
+		".......",
+		"X......",
+		"R......",
+	)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if row, ok := tryPlace(g, 0, cellY); !ok || row != 3 {
+		t.Fatalf("landed on row %d (ok %t), want 3", row, ok)
+	}
+	d := lastDrop(g)
+	if d == nil {
+		t.Fatal("no drop info after a drop")
+	}
+	wantPath := [][2]int{{0, 0}, {1, 0}, {2, 0}, {3, 0}}
+	if d.From != "top" || d.Side != "Y" || d.Row != 3 || d.Col != 0 || d.Turn != len(g.Moves) {
+		t.Errorf("drop = %+v", d)
+	}
+	if len(d.Path) != len(wantPath) {
+		t.Fatalf("path %v, want %v", d.Path, wantPath)
+	}
+	for i := range wantPath {
+		if d.Path[i] != wantPath[i] {
+			t.Fatalf("path %v, want %v", d.Path, wantPath)
+		}
+	}
+	if len(d.Through) != 1 || d.Through[0] != [2]int{2, 0} {
+		t.Errorf("through %v, want only the block at [2 0]", d.Through)
+	}
+}
+
+func TestEarlyDrawOnADeadBoard(t *testing.T) {
+	dead := func() [][]byte {
+		return gridOf(t,
+			"XXXXXXX",
+			"XXXXXXX",
+			"XXXXXXX",
+			"XXXXXXX",
+			"XXXXXXX",
+			"..X..X.",
+		)
+	}
+	if isDeadPosition(NewGameFromConfig(classic()).Grid, lensFor(4, dirLens{}), cellR) {
+		t.Fatal("an empty classic board is reported dead")
+	}
+	if !isDeadPosition(dead(), lensFor(4, dirLens{}), cellR) {
+		t.Fatal("a board with no room for four is not reported dead")
+	}
+
+	for _, early := range []bool{false, true} {
+		s := newTestServer()
+		cfg := classic()
+		cfg.EarlyDraw = early
+		g := NewGameFromConfig(cfg)
+		g.Grid = dead()
+		row, ok := tryPlace(g, 0, cellR)
+		if !ok {
+			t.Fatal("column 0 not playable")
+		}
+		over := s.checkResult(g, row, 0, cellR)
+		if over != early {
+			t.Errorf("EarlyDraw %t: game over = %t", early, over)
+		}
+		if early && (g.GameOverReason != reasonDraw || isDraw(g.Grid)) {
+			t.Errorf("reason %q on a board full=%t, want a draw before the board fills", g.GameOverReason, isDraw(g.Grid))
+		}
+	}
+}
+
+func TestRecoverPanicsKeepsServing(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/boom", func(http.ResponseWriter, *http.Request) {
+		var grid [][]byte
+		_ = grid[3][0]
+	})
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	srv := httptest.NewServer(recoverPanics(mux))
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/boom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("panicking handler: status %d, want 500", res.StatusCode)
+	}
+	res, err = http.Get(srv.URL + "/ok")
+	if err != nil {
+		t.Fatalf("server gone after a panic: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("next request: status %d, want 200", res.StatusCode)
+	}
+}
+
+func TestStartPosition(t *testing.T) {
+	s := newTestServer()
+	c := newSession(s, nil)
+	rec := post(s.handleStartPosition, "/start/position", url.Values{
+		"position": {"......./......./......./......./RYR.RY./YYY.RRR"},
+		"mode":     {"ai"},
+	}, c)
+	if loc := rec.Header().Get("Location"); loc != "/result" {
+		t.Fatalf("Yellow's winning move in AI mode: redirected to %q, want /result", loc)
+	}
+	g := issuedSession(t, s, rec)
+	if g.Turns != 12 || g.Grid[5][3] != cellY || !g.GameOver || g.LastPlayed != cellY {
+		t.Errorf("turns %d, [5][3] %q, over %t: the AI did not take its win", g.Turns, g.Grid[5][3], g.GameOver)
+	}
+
+	c = newSession(s, nil)
+	rec = post(s.handleStartPosition, "/start/position", url.Values{
+		"position": {"......./......./......./......./......./RY....."},
+	}, c)
+	if loc := rec.Header().Get("Location"); loc != "/game" {
+		t.Fatalf("valid position: redirected to %q, want /game", loc)
+	}
+	if g := issuedSession(t, s, rec); g.Turns != 2 || g.Current != cellR || g.Grid[5][1] != cellY {
+		t.Errorf("turns %d, current %q: the layout was not loaded", g.Turns, g.Current)
+	}
+
+	rec = post(s.handleStartPosition, "/start/position", url.Values{
+		"position": {"......./......./......./......./......./RYY...."},
+	}, c)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("two Yellows for one Red: status %d, want 400", rec.Code)
+	}
+}
+
+func TestHintFindsTheWinningMove(t *testing.T) {
+	s := newTestServer()
+	g, err := gameFromGrid(GameConfig{Difficulty: "custom", Grid: gridOf(t,
+		".......",
+		".......",
+		".......",
+		".......",
+		"....YY.",
+		".RRR.Y.",
+	)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.Mode = "ai"
+	c := newSession(s, g)
+	before := strings.Join(formatGrid(g.Grid), "/")
+
+	if rec := get(s.handleHint, "/hint", c); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /hint: status %d, want 405", rec.Code)
+	}
+	rec := post(s.handleHint, "/hint", nil, c)
+	var hint struct {
+		Col    int    `json:"col"`
+		Reason string `json:"reason"`
+		Left   int    `json:"left"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &hint); err != nil {
+		t.Fatalf("status %d: %v", rec.Code, err)
+	}
+	if hint.Col != 0 && hint.Col != 4 {
+		t.Errorf("hint col %d, want 0 or 4 (Red completes four)", hint.Col)
+	}
+	if hint.Reason != "coup gagnant" || hint.Left != maxHints-1 {
+		t.Errorf("reason %q, left %d", hint.Reason, hint.Left)
+	}
+	if strings.Join(formatGrid(g.Grid), "/") != before || g.Current != cellR || g.Turns != 6 {
+		t.Error("asking for a hint changed the game")
+	}
+}
+
+func TestRedirectsCarryTheBasePath(t *testing.T) {
+	for in, want := range map[string]string{"": "", "/": "", "p4": "/p4", "/p4/": "/p4", " /a/b ": "/a/b"} {
+		if got := normalizeBasePath(in); got != want {
+			t.Errorf("normalizeBasePath(%q) = %q, want %q", in, got, want)
+		}
+	}
+
+	s := newTestServer()
+	s.basePath, s.cookieName = "/p4", "p4_sid"
+	rec := post(s.handleStartPosition, "/start/position", url.Values{
+		"position": {"......./......./......./......./......./RY....."},
+	})
+	if loc := rec.Header().Get("Location"); loc != "/p4/game" {
+		t.Errorf("redirected to %q, want /p4/game", loc)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "p4_sid" || cookies[0].Path != "/p4/" {
+		t.Errorf("cookies %v, want one p4_sid scoped to /p4/", cookies)
+	}
+}
+
+func TestClearColumnPowerUp(t *testing.T) {
+	grid := gridOf(t, "R......", ".......", "X......", ".......", "S......", ".......")
+	resettleColumn(grid, 0, false)
+	if got := strings.Join(formatGrid(grid), "/"); got != strings.Join(formatGrid(gridOf(t, ".......", ".......", "X......", "R......", "S......", ".......")), "/") {
+		t.Errorf("resettled to %s: the piece should cross the X and rest on the S", got)
+	}
+
+	s := newTestServer()
+	cfg := classic()
+	cfg.PowerUps = true
+	g := NewGameFromConfig(cfg)
+	g.Grid = gridOf(t, ".......", ".......", ".......", "Y......", "X......", "RY.....")
+	g.Turns = 3
+	g.Current = cellY
+	c := newSession(s, g)
+
+	post(s.handleClearCol, "/play/clearcol", url.Values{"col": {"0"}}, c)
+	if g.Grid[3][0] != cellEmpty || g.Grid[5][0] != cellEmpty || g.Grid[4][0] != cellBlk {
+		t.Errorf("column 0 after the clear: %q %q %q, want only the block left", g.Grid[3][0], g.Grid[4][0], g.Grid[5][0])
+	}
+	if g.ClearsLeft.Y != 0 || g.Current != cellR || g.Turns != 4 {
+		t.Errorf("clears left %d, current %q, turns %d: the clear should spend Yellow's power-up and turn", g.ClearsLeft.Y, g.Current, g.Turns)
+	}
+
+	post(s.handleClearCol, "/play/clearcol", url.Values{"col": {"1"}}, c)
+	if g.Grid[5][1] != cellEmpty || g.ClearsLeft.R != 0 || g.Current != cellY {
+		t.Fatalf("Red's clear: [5][1] %q, left %d, current %q", g.Grid[5][1], g.ClearsLeft.R, g.Current)
+	}
+	tryPlace(g, 1, cellY)
+	post(s.handleClearCol, "/play/clearcol", url.Values{"col": {"1"}}, c)
+	if g.Grid[5][1] != cellY || g.Current != cellY {
+		t.Error("Yellow cleared a column with no power-up left")
+	}
+}
+
+func TestManualFlipResettlesAndScansTheBoard(t *testing.T) {
+	s := newTestServer()
+	cfg := classic()
+	cfg.PowerUps = true
+	g := NewGameFromConfig(cfg)
+	g.Grid = gridOf(t,
+		".......",
+		".......",
+		".......",
+		".Y.Y...",
+		"YRYR...",
+		"RYRR...",
+	)
+	g.Turns = 10
+	c := newSession(s, g)
+
+	rec := post(s.handleFlip, "/play/flip", nil, c)
+	want := gridOf(t,
+		"YYYY...",
+		"RRRR...",
+		".Y.R...",
+		".......",
+		".......",
+		".......",
+	)
+	if got, w := strings.Join(formatGrid(g.Grid), "/"), strings.Join(formatGrid(want), "/"); got != w {
+		t.Fatalf("after the flip:\n%s\nwant\n%s", got, w)
+	}
+	if !g.GravityUp || g.FlipsLeft.R != 0 {
+		t.Errorf("gravity up %t, flips left %d", g.GravityUp, g.FlipsLeft.R)
+	}
+	if findWin(g.Grid, cellY, g.lens()) == nil {
+		t.Error("Yellow's line on row 0 was not found")
+	}
+	if loc := rec.Header().Get("Location"); loc != "/result" || !g.GameOver || g.LastPlayed != cellR || g.Scores.R != 1 || g.Scores.Y != 0 {
+		t.Fatalf("redirect %q, over %t, winner %q, score %+v: the flipper's line should win", loc, g.GameOver, g.LastPlayed, g.Scores)
+	}
+	for _, rc := range g.WinLine {
+		if rc[0] != 1 {
+			t.Errorf("win line %v, want Red's row 1", g.WinLine)
+			break
+		}
+	}
+}
+
+func TestOnlineDrawResult(t *testing.T) {
+	s := newTestServer()
+	code, _, yellow := seatedLobby(s, classic())
+	lb, _ := s.store.Lobby(code)
+	g := lb.Game
+	g.Grid = gridOf(t, ".RRYYYR", "RYYRRRY", "YYYRYRY", "RRYRYYY", "RYRYRRR", "RRYYRYR")
+	g.Turns, g.Current = 41, cellY
+
+	rec := post(s.handleOnlinePlay, "/online/play", url.Values{"code": {code}, "side": {"Y"}, "col": {"0"}, "token": {lb.MoveToken}}, yellow)
+	if q := redirectQuery(t, rec); q.Get("code") != code || !g.GameOver || g.GameOverReason != reasonDraw {
+		t.Fatalf("redirect %v, over %t, reason %q: the last cell should draw", q, g.GameOver, g.GameOverReason)
+	}
+	if own := sessionOf(t, s, yellow); own.GameOverReason != reasonDraw || own.Message != g.Message {
+		t.Errorf("session copy: reason %q, message %q", own.GameOverReason, own.Message)
+	}
+
+	rec = get(s.handleResult, "/result?code="+code+"&side=Y", yellow)
+	body := rec.Body.String()
+	if !strings.Contains(body, "Égalité") || strings.Contains(body, "Victoire de") {
+		t.Errorf("result page does not show the draw:\n%s", body)
+	}
+	if g.Scores.R != 0 || g.Scores.Y != 0 || g.Series != "" {
+		t.Errorf("scores %+v, series %q after a draw", g.Scores, g.Series)
+	}
+}
+
+func TestBlockedLobbyCodes(t *testing.T) {
+	file := t.TempDir() + "/codes.txt"
+	if err := os.WriteFile(file, []byte("# house list\nzzzz\nBEEF # too easy\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	blocked := loadBlockedCodes(" meh2 ,HUHU", file)
+	for _, c := range []string{"FUCK", "ROOT", "MEH2", "HUHU", "ZZZZ", "BEEF"} {
+		if !blocked[c] {
+			t.Errorf("%s is not blocked", c)
+		}
+	}
+
+	s := newTestServer()
+	s.blockedCodes = blocked
+	for _, c := range []string{"fuck", "ROOT", "BEEF", "AB0D", "ABC"} {
+		if rec := get(s.handleOnlineCreate, "/online/create?code="+c); rec.Code != http.StatusBadRequest {
+			t.Errorf("custom code %s: status %d, want 400", c, rec.Code)
+		}
+	}
+
+	// everything blocked but one code: generation has to find it
+	s.blockedCodes = map[string]bool{}
+	everyLobbyCode(func(c string) { s.blockedCodes[c] = true })
+	delete(s.blockedCodes, "K7PQ")
+	if code, ok := s.newLobbyCode(); !ok || code != "K7PQ" {
+		t.Errorf("newLobbyCode = %q, %t; want the only unblocked code", code, ok)
+	}
+}
+
+func TestLobbyCreationSurvivesACrowdedCodeSpace(t *testing.T) {
+	s := newTestServer()
+	s.blockedCodes = map[string]bool{}
+	taken := newLobby(classic(), "someone")
+	everyLobbyCode(func(c string) {
+		switch {
+		case !strings.HasPrefix(c, "AB"):
+			s.blockedCodes[c] = true
+		case c != "AB7K":
+			s.store.PutLobby(c, taken)
+		}
+	})
+
+	rec := get(s.handleOnlineCreate, "/online/create")
+	if q := redirectQuery(t, rec); q.Get("code") != "AB7K" {
+		t.Fatalf("created %q, want the last free code AB7K", q.Get("code"))
+	}
+	if lb, ok := s.store.Lobby("AB7K"); !ok || lb == taken {
+		t.Fatal("AB7K was not created")
+	}
+	if rec := get(s.handleOnlineCreate, "/online/create"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("no code left: status %d, want 503", rec.Code)
+	}
+}
+
+func TestBlockOnlyColumnIsNeverPlayable(t *testing.T) {
+	s := newTestServer()
+	g := NewGameFromConfig(classic())
+	g.Grid = gridOf(t, "XRRYYY.", "XYYRRRY", "XYYRYRY", "XRYRYYY", "XYRYRRR", "XRYYRYR")
+	g.Turns = 35
+	c := newSession(s, g)
+
+	if _, ok := landingRow(g, 0); ok {
+		t.Error("landingRow accepts the block-only column")
+	}
+	disabled := s.viewModel(g)["Disabled"].([]bool)
+	for col, d := range disabled {
+		if d != (col != 6) {
+			t.Errorf("column %d disabled = %t", col, d)
+		}
+	}
+	if col := chooseAIMove(g); col != 6 {
+		t.Errorf("AI plays column %d, want 6 (the only open one)", col)
+	}
+	post(s.handlePlay, "/play", url.Values{"col": {"0"}}, c)
+	if g.Turns != 35 || g.Current != cellR {
+		t.Errorf("a move into the block-only column was played (turns %d)", g.Turns)
+	}
+}
+
+func TestForfeitOnMissedHeartbeats(t *testing.T) {
+	s := newTestServer()
+	s.forfeitGrace = time.Minute
+	gone, _, _ := seatedLobby(s, classic())
+	back, red, _ := seatedLobby(s, classic())
+	for _, code := range []string{gone, back} {
+		lb, _ := s.store.Lobby(code)
+		lb.LastSeenR = time.Now().Add(-2 * time.Minute)
+	}
+	if rec := post(s.handleOnlinePing, "/online/ping", url.Values{"code": {back}, "side": {"R"}}, red); rec.Code != http.StatusNoContent {
+		t.Fatalf("ping: status %d", rec.Code)
+	}
+
+	s.sweepLobbies(time.Now())
+	lb, _ := s.store.Lobby(gone)
+	if g := lb.Game; !g.GameOver || g.GameOverReason != reasonTimeout || g.LastPlayed != cellY || g.Scores.Y != 1 {
+		t.Errorf("silent Red to move: over %t, reason %q, winner %q", g.GameOver, g.GameOverReason, g.LastPlayed)
+	}
+	lb, _ = s.store.Lobby(back)
+	if lb.Game.GameOver {
+		t.Error("a ping within the grace period did not cancel the forfeit")
+	}
+}
+
+func TestScoreAnnouncements(t *testing.T) {
+	for _, c := range []struct {
+		lang string
+		r, y int
+		want string
+	}{
+		{"fr", 0, 0, "Aucun point marqué"},
+		{"fr", 1, 1, "Égalité de score : 1 point partout"},
+		{"fr", 2, 2, "Égalité de score : 2 points partout"},
+		{"fr", 3, 2, "Rouge mène 3 à 2"},
+		{"fr", 0, 1, "Jaune mène 1 à 0"},
+		{"en", 0, 0, "No points scored yet"},
+		{"en", 1, 1, "Scores level: 1 point each"},
+		{"en", 2, 2, "Scores level: 2 points each"},
+		{"en", 2, 3, "Jaune leads 3 to 2"},
+	} {
+		if got := scoreAnnouncement(c.lang, "Rouge", "Jaune", c.r, c.y); got != c.want {
+			t.Errorf("%s %d-%d: %q, want %q", c.lang, c.r, c.y, got, c.want)
+		}
+	}
+
+	for header, want := range map[string]string{
+		"":                          "fr",
+		"en-GB,en;q=0.9":            "en",
+		"de-DE,en;q=0.5,fr;q=0.8":   "fr",
+		"de,es":                     "fr",
+		"EN":                        "en",
+		"fr-CA;q=0.2,en-US;q=bogus": "fr",
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/result", nil)
+		req.Header.Set("Accept-Language", header)
+		if got := langFor(req); got != want {
+			t.Errorf("Accept-Language %q: %s, want %s", header, got, want)
+		}
+	}
+
+	s := newTestServer()
+	g := NewGameFromConfig(classic())
+	g.Player1, g.Player2 = "Ana", "Bo"
+	g.Scores.R, g.Scores.Y = 3, 1
+	req := httptest.NewRequest(http.MethodGet, "/result", nil)
+	req.Header.Set("Accept-Language", "en-US,en;q=0.9")
+	req.AddCookie(newSession(s, g))
+	rec := httptest.NewRecorder()
+	s.handleResult(rec, req)
+	if !strings.Contains(rec.Body.String(), "Ana leads 3 to 1") {
+		t.Error("the result page does not announce the score in the browser's language")
+	}
+}
+
+func TestOnlineMoveLog(t *testing.T) {
+	s := newTestServer()
+	cfg := classic()
+	cfg.FlipEvery = 2
+	code, red, yellow := seatedLobby(s, cfg)
+	lb, _ := s.store.Lobby(code)
+	seats := map[string]*http.Cookie{"R": red, "Y": yellow}
+	script := []struct {
+		side     string
+		col, row int
+	}{{"R", 3, 5}, {"Y", 3, 4}, {"R", 4, 0}, {"Y", 4, 1}, {"R", 2, 5}}
+	for _, m := range script {
+		post(s.handleOnlinePlay, "/online/play", url.Values{"code": {code}, "side": {m.side}, "col": {strconv.Itoa(m.col)}, "token": {lb.MoveToken}}, seats[m.side])
+	}
+
+	rec := get(s.handleOnlineMoves, "/online/moves?code="+code)
+	var body struct {
+		Moves []logEntry `json:"moves"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("status %d: %v", rec.Code, err)
+	}
+	if len(body.Moves) != len(script) {
+		t.Fatalf("%d log entries for %d plays", len(body.Moves), len(script))
+	}
+	for i, m := range script {
+		e := body.Moves[i]
+		up := i >= 2 && i < 4
+		if e.Turn != i+1 || e.Side != m.side || e.Col != m.col || e.Row != m.row || e.GravityUp != up || e.FlippedAfter != (i%2 == 1) {
+			t.Errorf("entry %d = %+v, want %s in column %d landing on row %d, gravity up %t", i, e, m.side, m.col, m.row, up)
+		}
+	}
+}
+
+func TestDevModeReloadsTemplates(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range templateFiles {
+		b, err := os.ReadFile("templates/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(dir+"/"+name, b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := newTestServer()
+	s.devTemplates = dir
+	const marker = "ce pion-là s’est perdu"
+	if body := get(s.renderNotFound, "/nowhere").Body.String(); strings.Contains(body, marker) {
+		t.Fatal("marker already in the page")
+	}
+
+	b, _ := os.ReadFile(dir + "/base.html")
+	b = []byte(strings.Replace(string(b), "n’existe pas", marker, 1))
+	if err := os.WriteFile(dir+"/base.html", b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if body := get(s.renderNotFound, "/nowhere").Body.String(); !strings.Contains(body, marker) {
+		t.Error("dev mode served the old template after the file changed")
+	}
+	s.devTemplates = ""
+	if body := get(s.renderNotFound, "/nowhere").Body.String(); strings.Contains(body, marker) {
+		t.Error("without dev mode the page should come from the templates parsed at startup")
+	}
+}
+
+func TestUnknownPathsGetThe404Page(t *testing.T) {
+	s := newTestServer()
+	static := http.StripPrefix("/static/", s.staticFiles("static"))
+	for _, c := range []struct {
+		h      http.HandlerFunc
+		target string
+		status int
+	}{
+		{s.handleStart, "/nope", http.StatusNotFound},
+		{static.ServeHTTP, "/static/missing.png", http.StatusNotFound},
+		{static.ServeHTTP, "/static/css/", http.StatusNotFound},
+		{static.ServeHTTP, "/static/bg.png", http.StatusOK},
+		{s.handleStart, "/", http.StatusOK},
+	} {
+		rec := get(c.h, c.target)
+		if rec.Code != c.status {
+			t.Errorf("%s: status %d, want %d", c.target, rec.Code, c.status)
+			continue
+		}
+		if c.status == http.StatusNotFound {
+			body := rec.Body.String()
+			if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/html") || !strings.Contains(body, "<html") || !strings.Contains(body, "n’existe pas") {
+				t.Errorf("%s: not the themed 404 page:\n%s", c.target, body)
+			}
+		}
+	}
+}
+
+func TestReusedMoveTokenIsIgnored(t *testing.T) {
+	s := newTestServer()
+	code, red, yellow := seatedLobby(s, classic())
+	lb, _ := s.store.Lobby(code)
+	form := url.Values{"code": {code}, "side": {"R"}, "col": {"3"}, "token": {lb.MoveToken}}
+
+	post(s.handleOnlinePlay, "/online/play", form, red)
+	if lb.Game.Turns != 1 || lb.MoveToken == form.Get("token") {
+		t.Fatalf("first submit: turns %d, token renewed %t", lb.Game.Turns, lb.MoveToken != form.Get("token"))
+	}
+	// Yellow moves, so it is Red's turn again when the old form comes back
+	post(s.handleOnlinePlay, "/online/play", url.Values{"code": {code}, "side": {"Y"}, "col": {"0"}, "token": {lb.MoveToken}}, yellow)
+	rec := post(s.handleOnlinePlay, "/online/play", form, red)
+	if lb.Game.Turns != 2 || lb.Game.Grid[4][3] != cellEmpty {
+		t.Errorf("the resubmitted form played again (turns %d)", lb.Game.Turns)
+	}
+	if q := redirectQuery(t, rec); q.Get("code") != code || q.Get("side") != "R" {
+		t.Errorf("resubmit redirected to %v, want the waiting page", q)
+	}
+}
+
+func TestOpeningThreatsAreRolledAgain(t *testing.T) {
+	if hasOpeningThreat(NewGameFromConfig(classic())) {
+		t.Fatal("the empty classic board reports an opening threat")
+	}
+
+	// seed 35 first draws a wall down the middle column: with gravity
+	// flipping every two moves, the first player lines up three by force
+	cfg := GameConfig{Rows: 4, Cols: 5, WinLen: 3, FlipEvery: 2, SolidBlocks: true, Seed: 35}
+	first := NewGameFromConfig(cfg)
+	first.Grid = gridOf(t, "..S..", "..S..", "..S..", ".....")
+	if !hasOpeningThreat(first) {
+		t.Fatal("no threat found on the walled board")
+	}
+	if got := strings.Join(formatGrid(first.Grid), "/"); got != "..S../..S../..S../....." {
+		t.Fatalf("the search left the board as %s", got)
+	}
+
+	cfg.Blocks = 3
+	g := NewGameFromConfig(cfg)
+	if got := strings.Join(formatGrid(g.Grid), "/"); got == "..S../..S../..S../....." || hasOpeningThreat(g) {
+		t.Errorf("seed 35 kept a threatening layout: %s", got)
+	}
+}
+
+func TestAPINew(t *testing.T) {
+	s := newTestServer()
+	call := func(method, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/new", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		s.handleAPINew(rec, req)
+		return rec
+	}
+
+	rec := call(http.MethodPost, `{"mode":"local","rows":7,"cols":8,"blocks":2,"winLen":5,"flipEvery":3,"p1":"Ana","p2":"Bo"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("valid config: status %d (%s)", rec.Code, rec.Body)
+	}
+	var st gameState
+	if err := json.Unmarshal(rec.Body.Bytes(), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Rows != 7 || st.Cols != 8 || st.WinLen != 5 || st.FlipEvery != 3 || st.P1 != "Ana" || st.P2 != "Bo" || st.Turns != 0 || st.Current != "R" {
+		t.Errorf("state %+v does not match the request", st)
+	}
+	g := issuedSession(t, s, rec)
+	blocks := 0
+	for _, row := range g.Grid {
+		for _, v := range row {
+			if isBlock(v) {
+				blocks++
+			}
+		}
+	}
+	if g.Rows != 7 || g.Cols != 8 || blocks != 2 {
+		t.Errorf("session game %d×%d with %d blocks", g.Rows, g.Cols, blocks)
+	}
+
+	for _, body := range []string{
+		`{"rows":99,"cols":7}`,
+		`{"rows":6,"cols":7,"winLen":2}`,
+		`{"rows":6,"cols":7,"blocks":-1}`,
+		`{"mode":"online"}`,
+		`{"rows":6,"colz":7}`,
+		`{"rows":`,
+	} {
+		if rec := call(http.MethodPost, body); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", body, rec.Code)
+		}
+	}
+	if rec := call(http.MethodGet, ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: status %d, want 405", rec.Code)
+	}
+}
+
+func TestStaleSessionGameExpires(t *testing.T) {
+	s := newTestServer()
+	stale := NewGameFromConfig(classic())
+	tryPlace(stale, 3, cellR)
+	stale.LastSeen = time.Now().Add(-sessionIdleTTL - time.Hour)
+	c := newSession(s, stale)
+
+	if loc := get(s.handleGame, "/game", c).Header().Get("Location"); loc != "/?expired=1" {
+		t.Fatalf("stale game: redirected to %q, want /?expired=1", loc)
+	}
+	g := sessionOf(t, s, c)
+	if g == stale || g.Turns != 0 {
+		t.Error("the stale board was resumed")
+	}
+	if rec := get(s.handleGame, "/game", c); rec.Code != http.StatusOK {
+		t.Errorf("fresh game after the expiry: status %d", rec.Code)
+	}
+
+	recent := NewGameFromConfig(classic())
+	recent.LastSeen = time.Now().Add(-sessionIdleTTL + time.Hour)
+	c = newSession(s, recent)
+	if rec := get(s.handleGame, "/game", c); rec.Code != http.StatusOK || sessionOf(t, s, c) != recent {
+		t.Errorf("game idle under the limit: status %d, not resumed", rec.Code)
+	}
+}
+
+func TestThreePlayerRotationAndWin(t *testing.T) {
+	s := newTestServer()
+	cfg := classic()
+	cfg.Players = 3
+	g := NewGameFromConfig(cfg)
+	c := newSession(s, g)
+
+	for i, want := range []byte{cellY, cellG, cellR, cellY} {
+		post(s.handlePlay, "/play", url.Values{"col": {strconv.Itoa(i)}}, c)
+		if g.Current != want || g.Grid[5][i] != turnOrder[i%3] {
+			t.Fatalf("after move %d: %q to play, cell %q", i+1, g.Current, g.Grid[5][i])
+		}
+	}
+
+	// parsePosition has no letters for the extra colors
+	g.Grid = gridOf(t, ".......", ".......", ".......", ".......", ".......", "....RY.")
+	for col := 0; col < 3; col++ {
+		g.Grid[4][col], g.Grid[5][col] = turnOrder[col], cellG
+	}
+	g.Current = cellG
+	rec := post(s.handlePlay, "/play", url.Values{"col": {"3"}}, c)
+	if rec.Header().Get("Location") != "/result" || g.LastPlayed != cellG || g.Scores.G != 1 || g.Scores.R+g.Scores.Y != 0 {
+		t.Errorf("Green's line: winner %q, scores %+v", g.LastPlayed, g.Scores)
+	}
+
+	// the AI plays against one opponent only: no hints with three players
+	h := NewGameFromConfig(cfg)
+	c = newSession(s, h)
+	if rec := post(s.handleHint, "/hint", nil, c); rec.Code != http.StatusConflict || h.HintsUsed != 0 {
+		t.Errorf("hint with three players: status %d", rec.Code)
+	}
+	if strings.Contains(get(s.handleGame, "/game", c).Body.String(), `id="hintBtn"`) {
+		t.Error("the hint button is shown in a three-player game")
+	}
+}
+
+func TestColorBlindModeReachesThePage(t *testing.T) {
+	s := newTestServer()
+	rec := post(s.handleTheme, "/theme", url.Values{"theme": {"classic"}, "colorblind": {"on"}})
+	var cb *http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == "pg_colorblind" {
+			cb = c
+		}
+	}
+	if cb == nil || cb.Value != "1" {
+		t.Fatalf("pg_colorblind cookie %v, want 1", cb)
+	}
+
+	c := newSession(s, nil)
+	plain := get(s.handleGame, "/game", c).Body.String()
+	shaped := get(s.handleGame, "/game", c, cb).Body.String()
+	if strings.Contains(plain, "colorblind") || strings.Contains(plain, "▲") {
+		t.Error("the plain page carries the color-blind mode")
+	}
+	if !strings.Contains(shaped, `class="theme-classic colorblind`) || !strings.Contains(shaped, "● ") || !strings.Contains(shaped, "▲ ") {
+		t.Error("the color-blind page has no class or glyphs")
+	}
+}
+
+func TestOnlineStateNamesTheSideToMove(t *testing.T) {
+	s := newTestServer()
+	cfg := classic()
+	cfg.Player1, cfg.Player2 = "Ana", "Bo"
+	code, red, _ := seatedLobby(s, cfg)
+	lb, _ := s.store.Lobby(code)
+	state := func(side string) lobbyState {
+		t.Helper()
+		var st lobbyState
+		rec := get(s.handleOnlineState, "/online/state?code="+code+"&side="+side)
+		if err := json.Unmarshal(rec.Body.Bytes(), &st); err != nil {
+			t.Fatalf("status %d: %v", rec.Code, err)
+		}
+		return st
+	}
+
+	if st := state("R"); st.Current != "R" || st.CurrentName != "Ana" || !st.YouAreRed || st.YouAreYellow {
+		t.Errorf("Red's view before any move: %+v", st)
+	}
+	post(s.handleOnlinePlay, "/online/play", url.Values{"code": {code}, "side": {"R"}, "col": {"3"}, "token": {lb.MoveToken}}, red)
+	if st := state("Y"); st.Current != "Y" || st.CurrentName != "Bo" || st.YouAreRed || !st.YouAreYellow {
+		t.Errorf("Yellow's view after Red's move: %+v", st)
+	}
+	if st := state(""); st.Current != "Y" || st.YouAreRed || st.YouAreYellow {
+		t.Errorf("spectator's view: %+v", st)
+	}
+}
+
+func TestGameOverReasons(t *testing.T) {
+	s := newTestServer()
+	playLast := func(grid [][]byte, col int) *Game {
+		g := NewGameFromConfig(classic())
+		g.Grid, g.Turns = grid, 41
+		post(s.handlePlay, "/play", url.Values{"col": {strconv.Itoa(col)}}, newSession(s, g))
+		return g
+	}
+
+	won := playLast(gridOf(t, ".......", ".......", ".......", ".......", ".......", "RRR.YYY"), 3)
+	drawn := playLast(gridOf(t, ".RRYYYR", "RYYRRRY", "YYYRYRY", "RRYRYYY", "RYRYRRR", "RRYYRYR"), 0)
+	timedOut := NewGameFromConfig(classic())
+	forfeit(timedOut, cellR)
+
+	for _, c := range []struct {
+		g    *Game
+		want overReason
+		page string
+	}{
+		{won, reasonConnect, "🏆"},
+		{drawn, reasonDraw, "🤝"},
+		{timedOut, reasonTimeout, "⏱️"},
+	} {
+		if !c.g.GameOver || c.g.GameOverReason != c.want {
+			t.Errorf("over %t, reason %q, want %q", c.g.GameOver, c.g.GameOverReason, c.want)
+			continue
+		}
+		if got := s.viewModel(c.g)["GameOverReason"]; got != string(c.want) {
+			t.Errorf("view model reason %v, want %q", got, c.want)
+		}
+		if body := get(s.handleResult, "/result", newSession(s, c.g)).Body.String(); !strings.Contains(body, c.page) {
+			t.Errorf("%s result page without its %s trophy", c.want, c.page)
+		}
+	}
+}
+
+func TestCoordinatesOverlay(t *testing.T) {
+	s := newTestServer()
+	var on *http.Cookie
+	for _, c := range post(s.handleCoords, "/coords", nil).Result().Cookies() {
+		if c.Name == "pg_coords" {
+			on = c
+		}
+	}
+	if on == nil || on.Value != "1" {
+		t.Fatalf("pg_coords cookie %v, want 1", on)
+	}
+
+	g := NewGameFromConfig(classic())
+	for _, c := range []*http.Cookie{on, {Name: "pg_coords", Value: "0"}} {
+		req := httptest.NewRequest(http.MethodGet, "/game", nil)
+		req.AddCookie(c)
+		rec := httptest.NewRecorder()
+		data := s.viewModel(g)
+		s.render(rec, req, "game", data)
+		want := c.Value == "1"
+		if data["Coords"] != want {
+			t.Errorf("cookie %s: Coords = %v", c.Value, data["Coords"])
+		}
+		if got := strings.Contains(rec.Body.String(), `<div class="coord-col" title="Colonne 7">7 ⬇</div>`); got != want {
+			t.Errorf("cookie %s: 1-based column label shown = %t", c.Value, got)
+		}
+	}
+}
+
+func TestTournamentSummary(t *testing.T) {
+	var out, errOut strings.Builder
+	if code := runTournament([]string{"-games", "4", "-a", "balanced", "-b", "defensive", "-seed", "7"}, &out, &errOut); code != 0 {
+		t.Fatalf("exit %d: %s", code, errOut.String())
+	}
+	var res tournamentResult
+	if err := json.Unmarshal([]byte(out.String()), &res); err != nil {
+		t.Fatalf("summary is not JSON: %v\n%s", err, out.String())
+	}
+	if res.Games != 4 || res.A.AI != "balanced" || res.B.AI != "defensive" || res.Seed != 7 {
+		t.Errorf("summary %+v", res)
+	}
+	if res.A.Wins+res.B.Wins+res.Draws != 4 {
+		t.Errorf("%d + %d wins and %d draws for 4 games", res.A.Wins, res.B.Wins, res.Draws)
+	}
+	if rates := res.A.WinRate + res.B.WinRate + res.DrawRate; rates < 0.999 || rates > 1.001 || res.AvgTurns < 7 {
+		t.Errorf("rates sum to %.3f, %.1f turns a game", rates, res.AvgTurns)
+	}
+
+	for _, args := range [][]string{{"-games", "0"}, {"-a", "nobody"}, {"-tiebreak", "coin"}, {"-bogus"}} {
+		if code := runTournament(args, &out, &errOut); code != 2 {
+			t.Errorf("%v: exit %d, want 2", args, code)
+		}
+	}
+}
+
+func TestTurnCapEndsInADraw(t *testing.T) {
+	s := newTestServer()
+	cfg := classic()
+	cfg.MaxTurns = 3
+	g := NewGameFromConfig(cfg)
+	g.Scores.R, g.Scores.Y = 2, 1
+	c := newSession(s, g)
+
+	var rec *httptest.ResponseRecorder
+	for i, col := range []int{0, 1, 2} {
+		if left := s.viewModel(g)["TurnsLeft"]; left != 3-i {
+			t.Errorf("before move %d: %v turns left", i+1, left)
+		}
+		rec = post(s.handlePlay, "/play", url.Values{"col": {strconv.Itoa(col)}}, c)
+	}
+	if rec.Header().Get("Location") != "/result" || !g.GameOver || g.GameOverReason != reasonDraw {
+		t.Fatalf("after the cap: over %t, reason %q", g.GameOver, g.GameOverReason)
+	}
+	if g.Scores.R != 2 || g.Scores.Y != 1 {
+		t.Errorf("scores %+v changed on a capped draw", g.Scores)
+	}
+
+	g = NewGameFromConfig(classic())
+	c = newSession(s, g)
+	for col := 0; col < 5; col++ {
+		post(s.handlePlay, "/play", url.Values{"col": {strconv.Itoa(col % 2)}}, c)
+	}
+	if g.GameOver || s.viewModel(g)["TurnsLeft"] != 0 {
+		t.Error("a game without a cap ended or counts turns down")
+	}
+}
+
+func TestSameSessionOnBothSeatsIsUnranked(t *testing.T) {
+	s := newTestServer()
+	host, guest := newSession(s, nil), newSession(s, nil)
+	seat := func(creator, joiner *http.Cookie) *lobby {
+		t.Helper()
+		code := redirectQuery(t, get(s.handleOnlineCreate, "/online/create", creator)).Get("code")
+		get(s.handleOnlineJoin, "/online/join?code="+code, joiner)
+		lb, _ := s.store.Lobby(code)
+		return lb
+	}
+
+	self := seat(host, host)
+	if !self.HasYellow || self.YellowSID != host.Value || !self.Game.Unranked {
+		t.Errorf("one session on both seats: yellow %t, unranked %t", self.HasYellow, self.Game.Unranked)
+	}
+	if st := lobbyStateOf(self, "R", time.Now()); !st.Unranked {
+		t.Error("the online state does not report the game unranked")
+	}
+
+	if lb := seat(guest, host); !lb.HasYellow || lb.Game.Unranked {
+		t.Errorf("two sessions: yellow %t, unranked %t", lb.HasYellow, lb.Game.Unranked)
+	}
+}
+
+func TestConfigDeterminesTheGame(t *testing.T) {
+	cfg := GameConfig{
+		Rows: 7, Cols: 9, Blocks: 6, SolidBlocks: true, WinLen: 5, FlipEvery: 3,
+		Variant: "custom", Difficulty: "hard", Mode: "online", Players: 2,
+		Player1: "Ana", Player2: "Bo", MaxTurns: 40, ConfirmMoves: true,
+		EarlyDraw: true, FlipGuard: true, CenterOpening: true, Starter: cellY,
+		PowerUps: true, LobbyCode: "K7PQ", Seed: 42,
+	}
+	a, b := NewGameFromConfig(cfg), NewGameFromConfig(cfg)
+	if x, y := strings.Join(formatGrid(a.Grid), "/"), strings.Join(formatGrid(b.Grid), "/"); x != y {
+		t.Fatalf("same seed, different layouts:\n%s\n%s", x, y)
+	}
+	blocks := 0
+	for _, row := range a.Grid {
+		for _, v := range row {
+			switch v {
+			case cellSolid:
+				blocks++
+			case cellEmpty:
+			default:
+				t.Fatalf("unexpected cell %q on a new board", v)
+			}
+		}
+	}
+	if a.Rows != 7 || a.Cols != 9 || blocks != 6 || a.WinLen != 5 || a.FlipEvery != 3 ||
+		a.Mode != "online" || a.Player1 != "Ana" || a.Player2 != "Bo" || a.MaxTurns != 40 ||
+		!a.ConfirmMoves || !a.EarlyDraw || !a.FlipGuard || !a.CenterOpening || a.Current != cellY ||
+		!a.PowerUps || a.ClearsLeft.R != powerUpsPerSide || a.LobbyCode != "K7PQ" || a.Seed != 42 ||
+		a.Turns != 0 || a.GameOver || a.PendingCol != -1 {
+		t.Errorf("game does not match its config: %+v", a)
+	}
+	for i := range a.Grid {
+		if string(a.Start[i]) != string(a.Grid[i]) {
+			t.Fatal("Start is not the initial layout")
+		}
+	}
+
+	// the rematch config carries the rules, not the layout
+	re := a.rematchConfig()
+	if re.Rows != cfg.Rows || re.Cols != cfg.Cols || re.Blocks != cfg.Blocks || re.WinLen != cfg.WinLen ||
+		re.FlipEvery != cfg.FlipEvery || re.MaxTurns != cfg.MaxTurns || !re.PowerUps || re.Seed != 0 {
+		t.Errorf("rematch config %+v", re)
+	}
+}
+
+func TestSeatsBelongToTheirSessions(t *testing.T) {
+	s := newTestServer()
+	code, red, yellow := seatedLobby(s, classic())
+	lb, _ := s.store.Lobby(code)
+	asRed := url.Values{"code": {code}, "side": {"R"}}
+
+	rec := post(s.handleOnlinePlay, "/online/play", url.Values{"code": {code}, "side": {"R"}, "col": {"3"}, "token": {lb.MoveToken}}, yellow)
+	if rec.Code != http.StatusForbidden || lb.Game.Turns != 0 {
+		t.Fatalf("Yellow playing as Red: status %d, turns %d", rec.Code, lb.Game.Turns)
+	}
+	lb.ReadyR = false
+	for name, h := range map[string]http.HandlerFunc{
+		"ready":  s.handleOnlineReady,
+		"ping":   s.handleOnlinePing,
+		"replay": s.handleOnlineReplay,
+		"chat":   s.handleChatPost,
+		"wait":   s.handleOnlineWait,
+	} {
+		form := url.Values{"code": {code}, "side": {"R"}, "text": {"gg"}}
+		var rec *httptest.ResponseRecorder
+		if name == "wait" {
+			rec = get(h, "/online/wait?"+form.Encode(), yellow)
+		} else {
+			rec = post(h, "/online/"+name, form, yellow)
+		}
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("%s as Red from Yellow's session: status %d, want 403", name, rec.Code)
+		}
+	}
+	if lb.ReadyR || lb.RematchR || len(lb.Chat) != 0 {
+		t.Error("a request for the wrong seat changed the lobby")
+	}
+	if loc := get(s.handleOnlineJoin, "/online/join?code="+code, newSession(s, nil)).Header().Get("Location"); loc != "/online/watch?code="+code {
+		t.Errorf("third session joining: redirected to %q, want the spectator page", loc)
+	}
+
+	// rematch votes only count once the game is over
+	lb.ReadyR = true
+	post(s.handleOnlineReplay, "/online/replay", asRed, red)
+	if lb.RematchR {
+		t.Error("rematch vote accepted during the game")
+	}
+	forfeit(lb.Game, cellY)
+	old := lb.Game
+	post(s.handleOnlineReplay, "/online/replay", asRed, red)
+	post(s.handleOnlineReplay, "/online/replay", url.Values{"code": {code}, "side": {"Y"}}, yellow)
+	if lb.Game == old || lb.Game.Scores.R != 1 {
+		t.Error("both votes after the game did not start the rematch")
+	}
+}
+
+func TestBlockTypes(t *testing.T) {
+	grid := gridOf(t,
+		".......",
+		"X.S....",
+		".......",
+		"X.S....",
+		".......",
+		"YY.S...",
+	)
+	for _, c := range []struct {
+		col int
+		up  bool
+		row int
+	}{
+		{0, false, 4}, // through both X down to the Y
+		{0, true, 0},  // up through both X to the top
+		{2, false, 0}, // stops on the S in row 1
+		{2, true, 4},  // stops under the S in row 3
+		{3, false, 4}, // stops on the S in the bottom row
+		{1, false, 4},
+	} {
+		if got := dropRow(grid, c.col, c.up); got != c.row {
+			t.Errorf("column %d, gravity up %t: lands on row %d, want %d", c.col, c.up, got, c.row)
+		}
+	}
+
+	// a block of either kind breaks a line
+	lens := lensFor(4, dirLens{})
+	for _, b := range []string{"X", "S"} {
+		g := gridOf(t, ".......", ".......", ".......", ".......", ".......", "YY"+b+"YY..")
+		if winningLine(g, 5, 1, cellY, lens) != nil {
+			t.Errorf("YY%sYY counted as a line", b)
+		}
+	}
+
+	s := newTestServer()
+	g := NewGameFromConfig(classic())
+	g.Grid = grid
+	body := get(s.handleGame, "/game", newSession(s, g)).Body.String()
+	if strings.Count(body, `class="piece block solid"`) != 3 || strings.Count(body, `class="piece block"`) != 2 {
+		t.Error("the two block kinds are not rendered apart")
+	}
+}
+
+func TestAPIStatsCountsActivity(t *testing.T) {
+	s := newTestServer()
+	s.startedAt = time.Now().Add(-90 * time.Second)
+	seatedLobby(s, classic()) // two sessions and a lobby
+
+	win := NewGameFromConfig(classic())
+	win.Grid = gridOf(t, ".......", ".......", ".......", ".......", ".......", "RRR.YYY")
+	post(s.handlePlay, "/play", url.Values{"col": {"3"}}, newSession(s, win))
+	drawn := NewGameFromConfig(classic())
+	drawn.Grid = gridOf(t, ".RRYYYR", "RYYRRRY", "YYYRYRY", "RRYRYYY", "RYRYRRR", "RRYYRYR")
+	post(s.handlePlay, "/play", url.Values{"col": {"0"}}, newSession(s, drawn))
+
+	var v statsView
+	rec := get(s.handleAPIStats, "/api/stats")
+	if err := json.Unmarshal(rec.Body.Bytes(), &v); err != nil {
+		t.Fatalf("status %d: %v", rec.Code, err)
+	}
+	if v.GamesPlayed != 2 || v.Draws != 1 || v.Wins["R"] != 1 || v.Wins["Y"] != 0 {
+		t.Errorf("games %d, draws %d, wins %v", v.GamesPlayed, v.Draws, v.Wins)
+	}
+	if v.Sessions != 4 || v.ActiveLobbies != 1 || v.UptimeSeconds < 90 {
+		t.Errorf("sessions %d, lobbies %d, uptime %ds", v.Sessions, v.ActiveLobbies, v.UptimeSeconds)
+	}
+	if rec := post(s.handleAPIStats, "/api/stats", nil); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: status %d", rec.Code)
+	}
+}
+
+func TestFlipEvent(t *testing.T) {
+	s := newTestServer()
+	cfg := classic()
+	cfg.FlipEvery = 2
+	code, red, yellow := seatedLobby(s, cfg)
+	lb, _ := s.store.Lobby(code)
+
+	if ev := lobbyStateOf(lb, "R", time.Now()).Event; ev != "" {
+		t.Errorf("event %q before any move", ev)
+	}
+	post(s.handleOnlinePlay, "/online/play", url.Values{"code": {code}, "side": {"R"}, "col": {"3"}, "token": {lb.MoveToken}}, red)
+	if ev := lobbyStateOf(lb, "Y", time.Now()).Event; ev != eventDrop {
+		t.Errorf("first move: event %q, want %q", ev, eventDrop)
+	}
+	post(s.handleOnlinePlay, "/online/play", url.Values{"code": {code}, "side": {"Y"}, "col": {"3"}, "token": {lb.MoveToken}}, yellow)
+	if !lb.Game.GravityUp {
+		t.Fatal("gravity did not flip after the second move")
+	}
+	if ev := lobbyStateOf(lb, "R", time.Now()).Event; ev != eventFlip {
+		t.Errorf("flip-triggering move: event %q, want %q", ev, eventFlip)
+	}
+	if ev := stateOf(lb.Game).Event; ev != eventFlip {
+		t.Errorf("game state event %q, want %q", ev, eventFlip)
+	}
+}
+
+func TestBlockRerollImprovesFairness(t *testing.T) {
+	for seed := int64(1); seed < 200; seed++ {
+		g := NewGameFromConfig(classic())
+		placeBlocks(g.Grid, 5, cellBlk, mrand.New(mrand.NewSource(seed)))
+		before := boardFairness(g.Grid, 4, false)
+		if before >= minFairness {
+			continue
+		}
+		// Same seed, so rollBlocks's first layout is the unfair one above.
+		rollBlocks(g, 5, mrand.New(mrand.NewSource(seed)))
+		after := boardFairness(g.Grid, 4, false)
+		if after < minFairness || after <= before {
+			t.Errorf("seed %d: fairness %.2f after re-rolling, %.2f before", seed, after, before)
+		}
+		return
+	}
+	t.Fatal("no unfair layout among the seeds tried")
+}
+
+func TestHTTPTimeoutsFromEnv(t *testing.T) {
+	t.Setenv("POWER4_READ_TIMEOUT", "2s")
+	t.Setenv("POWER4_WRITE_TIMEOUT", "0")
+	t.Setenv("POWER4_IDLE_TIMEOUT", "90s")
+	srv := newHTTPServer(":0", http.NotFoundHandler())
+	if srv.ReadTimeout != 2*time.Second || srv.WriteTimeout != 0 || srv.IdleTimeout != 90*time.Second {
+		t.Errorf("timeouts read %v, write %v, idle %v", srv.ReadTimeout, srv.WriteTimeout, srv.IdleTimeout)
+	}
+
+	os.Unsetenv("POWER4_READ_TIMEOUT")
+	if srv := newHTTPServer(":0", http.NotFoundHandler()); srv.ReadTimeout != 5*time.Second {
+		t.Errorf("default read timeout %v", srv.ReadTimeout)
+	}
+}
+
+func TestAdminLobby(t *testing.T) {
+	s := newTestServer()
+	s.adminToken = "s3cret"
+	code, _, _ := seatedLobby(s, classic())
+	inspect := s.requireAdmin(s.handleAdminLobby)
+	call := func(h http.HandlerFunc, method, auth string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/admin/lobby?code="+code, nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		return rec
+	}
+
+	for _, auth := range []string{"", "Bearer wrong", "s3cret", "Basic s3cret"} {
+		if rec := call(inspect, http.MethodGet, auth); rec.Code != http.StatusUnauthorized {
+			t.Errorf("Authorization %q: status %d, want 401", auth, rec.Code)
+		}
+	}
+
+	rec := call(inspect, http.MethodGet, "Bearer s3cret")
+	var v adminLobbyView
+	if err := json.Unmarshal(rec.Body.Bytes(), &v); err != nil {
+		t.Fatalf("status %d: %v", rec.Code, err)
+	}
+	if v.Code != code || !v.HasRed || !v.HasYellow || !v.ReadyR || !v.ReadyY {
+		t.Errorf("inspection %+v", v)
+	}
+	if strings.Contains(rec.Body.String(), "sid") {
+		t.Error("inspection leaks a session id")
+	}
+
+	if rec := call(s.requireAdmin(s.handleAdminTerminate), http.MethodPost, "Bearer nope"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("terminate without the token: status %d", rec.Code)
+	}
+	if _, ok := s.store.Lobby(code); !ok {
+		t.Fatal("a rejected terminate removed the lobby")
+	}
+}
+
+func TestAnalyzeFlagsABlunder(t *testing.T) {
+	s := newTestServer()
+	c := newSession(s, NewGameFromConfig(classic()))
+	g := sessionOf(t, s, c)
+	// Yellow's 6 ignores Red's vertical three in column 3.
+	for _, col := range []string{"3", "0", "3", "0", "3", "6", "3"} {
+		post(s.handlePlay, "/play", url.Values{"col": {col}}, c)
+	}
+	if !g.GameOver || g.GameOverReason != reasonConnect {
+		t.Fatalf("game over %v, reason %q", g.GameOver, g.GameOverReason)
+	}
+
+	rec := get(s.handleAnalyze, "/analyze", c)
+	var v struct {
+		Moves    []plyNote `json:"moves"`
+		Blunders int       `json:"blunders"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &v); err != nil {
+		t.Fatalf("status %d: %v", rec.Code, err)
+	}
+	if len(v.Moves) != 7 {
+		t.Fatalf("%d annotated moves, want 7", len(v.Moves))
+	}
+	if n := v.Moves[5]; !n.Blunder || n.Best != 3 || n.Note == "" {
+		t.Errorf("Yellow's 6: %+v", n)
+	}
+	if n := v.Moves[6]; n.Blunder || n.Best != 3 {
+		t.Errorf("Red's winning move: %+v", n)
+	}
+	if v.Blunders < 1 {
+		t.Errorf("blunders %d", v.Blunders)
+	}
+}
+
+func TestMalformedFormsGet400(t *testing.T) {
+	s := newTestServer()
+	c := newSession(s, NewGameFromConfig(classic()))
+	bodies := []struct {
+		name, ctype, body string
+	}{
+		{"bad escape", "application/x-www-form-urlencoded", "col=%zz"},
+		{"no boundary", "multipart/form-data", "col=3"},
+		{"truncated multipart", "multipart/form-data; boundary=xx", "--xx\r\nContent-Disposition: form-data; name=\"col\"\r\n\r\n3"},
+		{"oversized", "application/x-www-form-urlencoded", "text=" + strings.Repeat("a", maxFormBytes+1)},
+	}
+	handlers := map[string]http.HandlerFunc{
+		"/play":        s.handlePlay,
+		"/start":       s.handleStartPost,
+		"/online/play": s.handleOnlinePlay,
+		"/online/chat": s.handleChatPost,
+	}
+	for path, h := range handlers {
+		for _, b := range bodies {
+			req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(b.body))
+			req.Header.Set("Content-Type", b.ctype)
+			req.AddCookie(c)
+			rec := httptest.NewRecorder()
+			h(rec, req)
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("%s, %s: status %d, want 400", path, b.name, rec.Code)
+			}
+		}
+	}
+}
+
+func TestChatCapKeepsIDsGrowing(t *testing.T) {
+	s := newTestServer()
+	s.chatCap = 3
+	code, red, _ := seatedLobby(s, classic())
+	lb, _ := s.store.Lobby(code)
+	for i := 1; i <= 5; i++ {
+		form := url.Values{"code": {code}, "side": {"R"}, "text": {"msg " + strconv.Itoa(i)}}
+		if rec := post(s.handleChatPost, "/chat/post", form, red); rec.Code != http.StatusNoContent {
+			t.Fatalf("message %d: status %d", i, rec.Code)
+		}
+	}
+
+	if len(lb.Chat) != 3 || lb.NextChatID != 5 {
+		t.Fatalf("%d messages kept, next id %d; want 3 and 5", len(lb.Chat), lb.NextChatID)
+	}
+	for i, m := range lb.Chat {
+		if want := int64(i + 3); m.ID != want || m.Text != "msg "+strconv.Itoa(i+3) {
+			t.Errorf("kept message %d: id %d %q, want id %d", i, m.ID, m.Text, want)
+		}
+	}
+
+	var feed struct {
+		Items []struct {
+			ID int64 `json:"id"`
+		} `json:"items"`
+	}
+	rec := get(s.handleChatFeed, "/chat/feed?code="+code+"&since=4")
+	if err := json.Unmarshal(rec.Body.Bytes(), &feed); err != nil {
+		t.Fatalf("status %d: %v", rec.Code, err)
+	}
+	if len(feed.Items) != 1 || feed.Items[0].ID != 5 {
+		t.Errorf("feed since 4: %+v", feed.Items)
+	}
+}
+
+func TestOnlineStateNegotiation(t *testing.T) {
+	s := newTestServer()
+	code, _, _ := seatedLobby(s, classic())
+	cases := []struct {
+		accept, ctype, body string
+	}{
+		{"", "application/json", `"turns":0`},
+		{"application/json", "application/json", `"turns":0`},
+		{"image/png", "application/json", `"turns":0`},
+		{"text/html", "text/html", `class="board board-easy"`},
+		{"text/plain", "text/plain", "turns=0 current=R"},
+		{"text/html;q=0.5, text/plain", "text/plain", "turns=0 current=R"},
+		{"text/plain;q=0.2, */*;q=0.8", "application/json", `"turns":0`},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/online/state?code="+code+"&side=R", nil)
+		if tc.accept != "" {
+			req.Header.Set("Accept", tc.accept)
+		}
+		rec := httptest.NewRecorder()
+		s.handleOnlineState(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Errorf("Accept %q: status %d", tc.accept, rec.Code)
+			continue
+		}
+		if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, tc.ctype) {
+			t.Errorf("Accept %q: Content-Type %q, want %s", tc.accept, ct, tc.ctype)
+		}
+		if !strings.Contains(rec.Body.String(), tc.body) {
+			t.Errorf("Accept %q: body lacks %q:\n%s", tc.accept, tc.body, rec.Body)
+		}
+		if rec.Header().Get("Vary") != "Accept" {
+			t.Errorf("Accept %q: Vary %q", tc.accept, rec.Header().Get("Vary"))
+		}
+	}
+}
+
+func TestTryPlace(t *testing.T) {
+	g := NewGameFromConfig(classic())
+	g.Grid = gridOf(t, "..R....", "..Y....", "..R....", "..Y....", "..R....", "X.Y....")
+
+	if row, ok := tryPlace(g, 0, cellR); !ok || row != 4 || g.Grid[4][0] != cellR {
+		t.Errorf("onto a block: row %d, ok %v", row, ok)
+	}
+	if g.Turns != 1 || len(g.Moves) != 1 || g.Moves[0].Row != 4 || g.Moves[0].Col != 0 || g.LastPlayed != cellR {
+		t.Errorf("after a drop: turns %d, moves %+v, last played %q", g.Turns, g.Moves, g.LastPlayed)
+	}
+
+	before := strings.Join(formatGrid(g.Grid), "/")
+	for _, col := range []int{2, -1, 7} {
+		if row, ok := tryPlace(g, col, cellY); ok {
+			t.Errorf("column %d: placed at row %d", col, row)
+		}
+	}
+	if after := strings.Join(formatGrid(g.Grid), "/"); after != before || g.Turns != 1 || len(g.Moves) != 1 {
+		t.Errorf("refused drops changed the game: %s, turns %d", after, g.Turns)
+	}
+
+	g.GravityUp = true
+	if row, ok := tryPlace(g, 1, cellY); !ok || row != 0 || g.Moves[1].Side != cellY || !g.Moves[1].GravityUp {
+		t.Errorf("gravity up: row %d, ok %v, move %+v", row, ok, g.Moves[len(g.Moves)-1])
+	}
+}
+
+func TestPrefsCookieFillsTheStartForm(t *testing.T) {
+	s := newTestServer()
+	prefsCookie := func(v string) *http.Cookie { return &http.Cookie{Name: "pg_prefs", Value: v} }
+
+	body := get(s.handleStart, "/", prefsCookie("hard."+hex.EncodeToString([]byte("Zoé")))).Body.String()
+	if !strings.Contains(body, `name="player1" placeholder="Rouge" value="Zoé"`) {
+		t.Error("remembered name not prefilled")
+	}
+	if !strings.Contains(body, `value="hard"   selected`) {
+		t.Error("remembered difficulty not selected")
+	}
+
+	// each field is checked on its own; a bad one is dropped, never echoed
+	for v, want := range map[string]prefs{
+		"expert." + hex.EncodeToString([]byte("Zoé")):                           {Name: "Zoé"},
+		"hard." + hex.EncodeToString([]byte("Zo\x07é")):                         {Difficulty: "hard"},
+		"hard." + hex.EncodeToString([]byte(strings.Repeat("z", maxNameLen+1))): {Difficulty: "hard"},
+		"hard.zz": {Difficulty: "hard"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.AddCookie(prefsCookie(v))
+		if got := prefsForRequest(req); got != want {
+			t.Errorf("pg_prefs %q read as %+v, want %+v", v, got, want)
+		}
+	}
+
+	// a session game's own names win over the cookie
+	g := NewGameFromConfig(classic())
+	g.Player1, g.Difficulty = "Ana", "easy"
+	body = get(s.handleStart, "/", newSession(s, g), prefsCookie("hard."+hex.EncodeToString([]byte("Zoé")))).Body.String()
+	if !strings.Contains(body, `value="Ana"`) || strings.Contains(body, "Zoé") {
+		t.Error("the cookie overrode the session's names")
+	}
+}
+
+func TestSwapColorsKeepsScoresWithThePlayers(t *testing.T) {
+	s := newTestServer()
+	cfg := classic()
+	cfg.Player1, cfg.Player2 = "Ana", "Ben"
+	c := newSession(s, NewGameFromConfig(cfg))
+	g := sessionOf(t, s, c)
+	// winFor stacks side's pieces in column 3 while the other side
+	// alternates between columns 0 and 1.
+	winFor := func(side byte) {
+		t.Helper()
+		filler := 0
+		for !g.GameOver {
+			col := 3
+			if g.Current != side {
+				col, filler = filler, 1-filler
+			}
+			post(s.handlePlay, "/play", url.Values{"col": {strconv.Itoa(col)}}, c)
+		}
+	}
+
+	winFor(cellR) // Ana
+	post(s.handleReplay, "/replay", url.Values{"swap": {"1"}}, c)
+	if g.Player1 != "Ben" || g.Player2 != "Ana" || g.Scores.R != 0 || g.Scores.Y != 1 || g.Series != "Y" {
+		t.Fatalf("after swapping: red %q, yellow %q, scores %+v, series %q", g.Player1, g.Player2, g.Scores, g.Series)
+	}
+
+	winFor(cellY) // Ana again, now yellow
+	post(s.handleReplay, "/replay", nil, c)
+	if g.Player1 != "Ben" || g.Scores.R != 0 || g.Scores.Y != 2 {
+		t.Fatalf("replay without swap: red %q, scores %+v", g.Player1, g.Scores)
+	}
+	post(s.handleReplay, "/replay", url.Values{"swap": {"1"}}, c)
+	if g.Player1 != "Ana" || g.Scores.R != 2 || g.Scores.Y != 0 || g.Series != "RR" {
+		t.Errorf("swapped back: red %q, scores %+v, series %q", g.Player1, g.Scores, g.Series)
+	}
+}
+
+func TestAPIRateLimitIsPerIP(t *testing.T) {
+	s := newTestServer()
+	s.apiLimiter = newIPLimiter(1, 3)
+	h := s.limited(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) })
+	from := func(addr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/online/state?code=ABCD", nil)
+		req.RemoteAddr = addr
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		return rec
+	}
+
+	for i := 0; i < 3; i++ {
+		if rec := from("10.0.0.1:4000"); rec.Code != http.StatusNoContent {
+			t.Fatalf("request %d within the burst: status %d", i+1, rec.Code)
+		}
+	}
+	rec := from("10.0.0.1:4001") // another port, same client
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "1" {
+		t.Errorf("over the burst: status %d, Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if rec := from("10.0.0.2:4000"); rec.Code != http.StatusNoContent {
+		t.Errorf("another IP: status %d", rec.Code)
+	}
+
+	// the bucket refills at rate tokens per second, then idle ones are swept
+	l := s.apiLimiter
+	now := time.Now()
+	if ok, _ := l.allow("10.0.0.1", now.Add(1100*time.Millisecond)); !ok {
+		t.Error("no token after a second")
+	}
+	l.allow("10.0.0.3", now.Add(2*limiterSweepEvery))
+	if len(l.buckets) != 1 {
+		t.Errorf("%d buckets after the sweep, want only the new one", len(l.buckets))
+	}
+}
+
+func TestTieBreakPolicies(t *testing.T) {
+	g := NewGameFromConfig(classic())
+	ties := []int{0, 1, 4, 6}
+	for policy, want := range map[string]int{"": 0, tieLeftmost: 0, tieCenter: 4} {
+		g.AI.TieBreak = policy
+		if got := breakTie(g, ties); got != want {
+			t.Errorf("policy %q: column %d, want %d", policy, got, want)
+		}
+	}
+	if got := breakTie(g, nil); got != -1 {
+		t.Errorf("no candidates: column %d", got)
+	}
+
+	// seeded: the same seed and turn always pick the same column
+	g.AI.TieBreak, g.AI.Seed = tieSeeded, 42
+	first := breakTie(g, ties)
+	for i := 0; i < 5; i++ {
+		if got := breakTie(g, ties); got != first {
+			t.Fatalf("seeded pick changed from %d to %d", first, got)
+		}
+	}
+}
+
+func TestEndlessScoresAndClearsLines(t *testing.T) {
+	s := newTestServer()
+	cfg := classic()
+	cfg.Endless, cfg.MaxTurns = true, 10
+	c := newSession(s, NewGameFromConfig(cfg))
+	g := sessionOf(t, s, c)
+	play := func(cols ...int) {
+		for _, col := range cols {
+			post(s.handlePlay, "/play", url.Values{"col": {strconv.Itoa(col)}}, c)
+		}
+	}
+
+	// Red's bottom row goes, Yellow's three pieces fall into its place
+	play(0, 0, 1, 1, 2, 2, 3)
+	if g.GameOver || g.Points.R != 1 || g.Points.Y != 0 {
+		t.Fatalf("after Red's line: over %v, points %+v", g.GameOver, g.Points)
+	}
+	if got := strings.Join(formatGrid(g.Grid)[4:], "/"); got != "......./YYY...." {
+		t.Errorf("board after clearing: %s", got)
+	}
+
+	// Yellow completes the settled row: the board is empty again
+	play(3)
+	if g.Points.Y != 1 || strings.Count(strings.Join(formatGrid(g.Grid), ""), ".") != 42 {
+		t.Errorf("after Yellow's line: points %+v, board %v", g.Points, formatGrid(g.Grid))
+	}
+
+	// the turn cap ends it, level on points
+	play(6, 6)
+	if !g.GameOver || g.GameOverReason != reasonDraw || g.Scores.R+g.Scores.Y != 0 {
+		t.Errorf("at the turn cap: over %v, reason %q, scores %+v", g.GameOver, g.GameOverReason, g.Scores)
+	}
+
+	cfg.MaxTurns = 7
+	c = newSession(s, NewGameFromConfig(cfg))
+	g = sessionOf(t, s, c)
+	play(0, 0, 1, 1, 2, 2, 3)
+	if !g.GameOver || g.GameOverReason != reasonConnect || g.Scores.R != 1 {
+		t.Errorf("ahead at the cap: over %v, reason %q, scores %+v", g.GameOver, g.GameOverReason, g.Scores)
+	}
+}
+
+func TestWinLineIsOrdered(t *testing.T) {
+	s := newTestServer()
+	g := NewGameFromConfig(classic())
+	g.Grid = gridOf(t, ".......", ".......", "...R...", "...Y...", ".RYR...", "RYYY...")
+	g.Current = cellR
+	c := newSession(s, g)
+	// (3,2) completes the diagonal in its middle
+	post(s.handlePlay, "/play", url.Values{"col": {"2"}}, c)
+	if !g.GameOver {
+		t.Fatal("the diagonal did not win")
+	}
+
+	wl := stateOf(g).WinLine
+	if wl == nil || len(wl.Cells) != 4 {
+		t.Fatalf("win line %+v", wl)
+	}
+	want := winningLine(g.Grid, 3, 2, cellR, g.lens())
+	for i, rc := range wl.Cells {
+		if rc != want[i] || !g.Winning[rc[0]][rc[1]] {
+			t.Errorf("cell %d is %v, want %v of %v", i, rc, want[i], want)
+		}
+		if i > 0 && [2]int{rc[0] - wl.Cells[i-1][0], rc[1] - wl.Cells[i-1][1]} != wl.Dir {
+			t.Errorf("step %d is not %v", i, wl.Dir)
+		}
+	}
+	if wl.Dir != [2]int{-1, 1} && wl.Dir != [2]int{1, -1} {
+		t.Errorf("direction %v for a rising diagonal", wl.Dir)
+	}
+	if ends := [2][2]int{wl.Cells[0], wl.Cells[3]}; ends != [2][2]int{{5, 0}, {2, 3}} && ends != [2][2]int{{2, 3}, {5, 0}} {
+		t.Errorf("line ends %v", ends)
+	}
+}
+
+func TestFlipGuard(t *testing.T) {
+	s := newTestServer()
+	// Red's move at turn 2 is due to flip gravity before Yellow plays.
+	gravityAfter := func(guard bool, bottom string) bool {
+		cfg := classic()
+		cfg.FlipEvery, cfg.FlipGuard = 2, guard
+		g := NewGameFromConfig(cfg)
+		g.Grid = gridOf(t, ".......", ".......", ".......", ".......", "RR.....", bottom)
+		g.Turns, g.Current = 1, cellR
+		post(s.handlePlay, "/play", url.Values{"col": {"6"}}, newSession(s, g))
+		if g.Turns != 2 || g.Current != cellY {
+			t.Fatalf("Red's move not played: turns %d", g.Turns)
+		}
+		return g.GravityUp
+	}
+
+	if gravityAfter(true, "YYY....") {
+		t.Error("guarded: the flip scattered Yellow's winning drop")
+	}
+	if !gravityAfter(false, "YYY....") {
+		t.Error("unguarded: no flip")
+	}
+	if !gravityAfter(true, "YY.....") {
+		t.Error("guarded without a threat: the flip should happen")
+	}
+}
+
+func TestForkLeavesTheLobbyAlone(t *testing.T) {
+	s := newTestServer()
+	code, red, _ := seatedLobby(s, classic())
+	lb, _ := s.store.Lobby(code)
+	post(s.handleOnlinePlay, "/online/play", url.Values{"code": {code}, "side": {"R"}, "col": {"3"}, "token": {lb.MoveToken}}, red)
+	live := strings.Join(formatGrid(lb.Game.Grid), "/")
+
+	c := newSession(s, NewGameFromConfig(classic()))
+	if rec := post(s.handleOnlineFork, "/online/fork", url.Values{"code": {code}}, c); rec.Code != http.StatusSeeOther {
+		t.Fatalf("fork: status %d", rec.Code)
+	}
+	fork := sessionOf(t, s, c)
+	if fork.Mode != "local" || fork.LobbyCode != "" || strings.Join(formatGrid(fork.Grid), "/") != live || fork.Current != cellY {
+		t.Fatalf("fork: mode %q, lobby %q, to move %q", fork.Mode, fork.LobbyCode, fork.Current)
+	}
+
+	for _, col := range []string{"3", "4", "4"} {
+		post(s.handlePlay, "/play", url.Values{"col": {col}}, c)
+	}
+	fork.Grid[0][0] = cellBlk
+	if fork.Turns != 4 {
+		t.Fatalf("fork turns %d, want 4", fork.Turns)
+	}
+	if got := strings.Join(formatGrid(lb.Game.Grid), "/"); got != live || lb.Game.Turns != 1 || len(lb.Game.Moves) != 1 || lb.Game.Current != cellY {
+		t.Errorf("the lobby changed: %s, turns %d, %d moves", got, lb.Game.Turns, len(lb.Game.Moves))
+	}
+}
+
+func TestAIAvoidsHandingOverAWin(t *testing.T) {
+	g := NewGameFromConfig(classic())
+	// Red filling (5,3) would give Yellow (4,3) and its row.
+	g.Grid = gridOf(t, ".......", ".......", ".......", ".......", "YYY....", "RRY..R.")
+	g.Current = cellR
+	handsOver := func(col int) bool {
+		win, undo, _ := simTurn(g, col, cellR)
+		defer undo()
+		return !win && hasWinningDrop(g, cellY)
+	}
+
+	g.AI.IgnoreReplies = true
+	if naive := chooseMove(g, cellR); naive != 3 || !handsOver(naive) {
+		t.Fatalf("naive AI played %d; the board no longer shows the blunder", naive)
+	}
+	g.AI.IgnoreReplies = false
+	if col := chooseMove(g, cellR); handsOver(col) {
+		t.Errorf("AI played %d, handing Yellow a win", col)
+	}
+}
+
+func TestStartFormValidation(t *testing.T) {
+	s := newTestServer()
+	long := strings.Repeat("n", maxNameLen+1)
+	cases := []struct {
+		name string
+		form url.Values
+		msg  string
+	}{
+		{"mode", url.Values{"mode": {"lan"}}, "mode inconnu"},
+		{"player1", url.Values{"player1": {long}}, "caractères maximum"},
+		{"player4", url.Values{"players": {"4"}, "player4": {long}}, "caractères maximum"},
+		{"ai_name", url.Values{"mode": {"ai"}, "ai_name": {long}}, "caractères maximum"},
+		{"players", url.Values{"players": {"5"}}, "entre 2 et 4 joueurs"},
+		{"players online", url.Values{"mode": {"online"}, "players": {"3"}}, "mode local uniquement"},
+		{"players not a number", url.Values{"players": {"deux"}}, "nombre entier attendu"},
+		{"max_turns", url.Values{"max_turns": {"1.5"}}, "nombre entier attendu"},
+		{"difficulty", url.Values{"difficulty": {"insane"}}, "difficulté inconnue"},
+		{"variant", url.Values{"variant": {"hexagonal"}}, "variante inconnue"},
+		{"block_density", url.Values{"custom_density": {"1"}, "block_density": {"99"}}, "densité entre 0 et"},
+	}
+	for _, tc := range cases {
+		tc.form.Set("player2", "Ben") // a valid value, echoed back as typed
+		rec := post(s.handleStartPost, "/start", tc.form)
+		body := rec.Body.String()
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", tc.name, rec.Code)
+			continue
+		}
+		if !strings.Contains(body, `<span class="field-error">`) || !strings.Contains(body, tc.msg) {
+			t.Errorf("%s: no %q error on the page", tc.name, tc.msg)
+		}
+		if !strings.Contains(body, `value="Ben"`) {
+			t.Errorf("%s: the submitted name was not kept", tc.name)
+		}
+		if rec.Header().Get("Set-Cookie") != "" {
+			t.Errorf("%s: a rejected form set %q", tc.name, rec.Header().Get("Set-Cookie"))
+		}
+	}
+
+	if rec := post(s.handleStartPost, "/start", url.Values{"player1": {"Ana"}}); rec.Code != http.StatusSeeOther {
+		t.Errorf("valid form: status %d", rec.Code)
+	}
+}
+
+func TestDailyBoardIsSharedForAUTCDay(t *testing.T) {
+	s := newTestServer()
+	layout := func(g *Game) string { return strings.Join(formatGrid(g.Grid), "/") }
+
+	a := issuedSession(t, s, get(s.handleDaily, "/daily"))
+	b := issuedSession(t, s, get(s.handleDaily, "/daily", &http.Cookie{Name: "pg_prefs", Value: "." + hex.EncodeToString([]byte("Zoé"))}))
+	if a == b || layout(a) != layout(b) || a.Daily != b.Daily || a.Daily != dailyDate(time.Now()) {
+		t.Errorf("two daily games today: %s (%s) and %s (%s)", layout(a), a.Daily, layout(b), b.Daily)
+	}
+	if !strings.ContainsAny(layout(a), "XS") {
+		t.Errorf("daily board without blocks: %s", layout(a))
+	}
+
+	// 23:30 in New York is already the next day in UTC
+	ny := time.FixedZone("EST", -5*3600)
+	late := dailyDate(time.Date(2026, 3, 1, 23, 30, 0, 0, ny))
+	early := dailyDate(time.Date(2026, 3, 2, 4, 30, 0, 0, time.UTC))
+	if late != early {
+		t.Fatalf("daily dates %s and %s", late, early)
+	}
+	x, y := NewGameFromConfig(dailyBoard(late, "")), NewGameFromConfig(dailyBoard(early, "Ana"))
+	if layout(x) != layout(y) {
+		t.Errorf("same UTC day, different boards: %s and %s", layout(x), layout(y))
+	}
+	if z := NewGameFromConfig(dailyBoard("2026-03-03", "")); layout(z) == layout(x) {
+		t.Errorf("the next day reuses the board %s", layout(z))
+	}
+}
+
+func TestAIDebugLog(t *testing.T) {
+	var buf strings.Builder
+	aiDebug = log.New(&buf, "", 0)
+	defer func() { aiDebug = nil }()
+
+	g := NewGameFromConfig(classic())
+	g.Grid = gridOf(t, ".......", ".......", ".......", ".......", "YYY....", "RRY..R.")
+	chooseMove(g, cellR)
+	line := buf.String()
+	for _, field := range []string{
+		"side=R ", "ai=balanced ", "turn=0 ", "gravity_up=false ", "tiebreak=leftmost ",
+		"candidates=0:-70/-73,1:-70/-72,2:-60/-61,3:-60/-5060!,", "chosen=2 ", "reason=score\n",
+	} {
+		if !strings.Contains(line, field) {
+			t.Errorf("log lacks %q:\n%s", field, line)
+		}
+	}
+
+	buf.Reset()
+	g.Grid = gridOf(t, ".......", ".......", ".......", ".......", ".......", "RRR.YYY")
+	chooseMove(g, cellR)
+	if line := buf.String(); !strings.Contains(line, "chosen=3 reason=win") {
+		t.Errorf("winning move logged as:\n%s", line)
+	}
+
+	aiDebug = nil
+	buf.Reset()
+	chooseMove(g, cellR)
+	if buf.Len() != 0 {
+		t.Errorf("logged with the flag off: %s", buf.String())
+	}
+}
+
+func TestPauseRejectsMovesAndStopsTheClock(t *testing.T) {
+	s := newTestServer()
+	s.forfeitGrace = 30 * time.Second
+	code, red, yellow := seatedLobby(s, classic())
+	lb, _ := s.store.Lobby(code)
+	g := lb.Game
+	play := func(side string, c *http.Cookie) {
+		post(s.handleOnlinePlay, "/online/play", url.Values{"code": {code}, "side": {side}, "col": {"3"}, "token": {lb.MoveToken}}, c)
+	}
+	seat := url.Values{"code": {code}, "side": {"Y"}}
+
+	play("R", red)
+	if rec := post(s.handleOnlinePause, "/online/pause", seat, yellow); rec.Code != http.StatusSeeOther || lb.PausedBy != "Y" {
+		t.Fatalf("pause: status %d, paused by %q", rec.Code, lb.PausedBy)
+	}
+	play("Y", yellow)
+	if g.Turns != 1 {
+		t.Fatalf("a move went through during the pause: turns %d", g.Turns)
+	}
+	if rec := post(s.handleOnlineResume, "/online/resume", url.Values{"code": {code}, "side": {"R"}}, red); rec.Code != http.StatusConflict {
+		t.Errorf("resumed by the other seat: status %d", rec.Code)
+	}
+
+	// a pause longer than the forfeit grace: Yellow's turn does not run out
+	now := time.Now()
+	g.Moves[0].At = now.Add(-62 * time.Second)
+	lb.PausedAt, lb.LastSeenY = now.Add(-60*time.Second), now.Add(-60*time.Second)
+	if s.sweepLobby(lb, now) || g.GameOver {
+		t.Fatal("forfeited while paused")
+	}
+	if secs := lobbyStateOf(lb, "R", now).PausedSecs; secs != 60 {
+		t.Errorf("paused for %ds, want 60", secs)
+	}
+
+	post(s.handleOnlineResume, "/online/resume", seat, yellow)
+	if lb.PausedBy != "" || s.sweepLobby(lb, time.Now()) {
+		t.Fatalf("resume: paused by %q, game over %v", lb.PausedBy, g.GameOver)
+	}
+	play("Y", yellow)
+	if g.Turns != 2 {
+		t.Fatalf("move after resuming: turns %d", g.Turns)
+	}
+	if th := g.Moves[1].Think; th < 2*time.Second || th > 3*time.Second {
+		t.Errorf("Yellow thought for %s; the minute of pause should not count", th)
+	}
+}
+
+func TestWinLengthPerDirection(t *testing.T) {
+	s := newTestServer()
+	cfg := classic()
+	cfg.WinBy = dirLens{D: 5}
+	newGame := func(rows ...string) (*Game, *http.Cookie) {
+		g := NewGameFromConfig(cfg)
+		g.Grid = gridOf(t, rows...)
+		g.Current = cellR
+		return g, newSession(s, g)
+	}
+
+	// four on a diagonal no longer win...
+	g, c := newGame(".......", ".......", "...R...", "...Y...", ".RYR...", "RYYY...")
+	post(s.handlePlay, "/play", url.Values{"col": {"2"}}, c)
+	if g.GameOver || g.Turns != 1 {
+		t.Fatalf("a diagonal of 4 with D=5: over %v, turns %d", g.GameOver, g.Turns)
+	}
+	// ...four in a row still do
+	g, c = newGame(".......", ".......", ".......", ".......", "YYY....", "RRR....")
+	post(s.handlePlay, "/play", url.Values{"col": {"3"}}, c)
+	if !g.GameOver || len(g.WinLine) != 4 {
+		t.Fatalf("a row of 4: over %v, line %v", g.GameOver, g.WinLine)
+	}
+	// and five on a diagonal do
+	diag := gridOf(t, ".......", "....R..", "...R...", "..R....", ".R.....", "R......")
+	if line := winningLine(diag, 3, 2, cellR, g.lens()); len(line) != 5 {
+		t.Errorf("a diagonal of 5: line %v", line)
+	}
+
+	for _, by := range []dirLens{{D: 7}, {H: 8}, {V: 2}, {V: 7}} {
+		sr := startRequest{WinBy: by}
+		if _, err := sr.normalize(); err == nil {
+			t.Errorf("lengths %+v accepted on a 6×7 board", by)
+		}
+	}
+	sr := startRequest{WinBy: dirLens{H: 3, V: 6, D: 5}}
+	if _, err := sr.normalize(); err != nil {
+		t.Errorf("valid per-direction lengths rejected: %v", err)
+	}
+}
+
+func TestZeroBlockBoard(t *testing.T) {
+	s := newTestServer()
+	blocks := func(g *Game) int {
+		cells := strings.Join(formatGrid(g.Grid), "")
+		return strings.Count(cells, "X") + strings.Count(cells, "S")
+	}
+
+	g := issuedSession(t, s, post(s.handleStartPost, "/start", url.Values{"difficulty": {"hard"}, "no_blocks": {"1"}}))
+	if g.Cols != 9 || blocks(g) != 0 {
+		t.Errorf("hard without blocks: %d columns, %d blocks", g.Cols, blocks(g))
+	}
+	grid := NewGameFromConfig(classic()).Grid
+	placeBlocks(grid, 0, cellBlk, mrand.New(mrand.NewSource(1)))
+	if strings.Join(formatGrid(grid), "") != strings.Repeat(".", 42) {
+		t.Errorf("placeBlocks(0) changed the grid: %v", formatGrid(grid))
+	}
+
+	play := func(moves string) (*Game, *http.Cookie) {
+		c := newSession(s, NewGameFromConfig(classic()))
+		g := sessionOf(t, s, c)
+		for i, m := range moves {
+			if g.GameOver {
+				t.Fatalf("game over after %d of %q", i, moves)
+			}
+			post(s.handlePlay, "/play", url.Values{"col": {string(m)}}, c)
+		}
+		return g, c
+	}
+
+	g, _ = play("0101010")
+	if !g.GameOver || g.GameOverReason != reasonConnect || g.WinLine[0][1] != 0 || g.WinLine[3][1] != 0 {
+		t.Errorf("vertical win: over %v, reason %q, line %v", g.GameOver, g.GameOverReason, g.WinLine)
+	}
+
+	// every cell filled without a line
+	g, _ = play("015325242155326241140216415463300006466533")
+	if !g.GameOver || g.GameOverReason != reasonDraw || g.Turns != 42 || g.WinLine != nil {
+		t.Errorf("full board: over %v, reason %q, turns %d, line %v", g.GameOver, g.GameOverReason, g.Turns, g.WinLine)
+	}
+}
+
+func TestAPIPreview(t *testing.T) {
+	s := newTestServer()
+	g := NewGameFromConfig(classic())
+	g.Grid = gridOf(t, "..R....", "..Y....", "..R....", "..Y.SR.", "..R..RX", "..Y..R.")
+	g.Current = cellR
+	c := newSession(s, g)
+	before := strings.Join(formatGrid(g.Grid), "/")
+
+	preview := func(col int) previewView {
+		t.Helper()
+		var v previewView
+		rec := get(s.handleAPIPreview, "/api/preview?col="+strconv.Itoa(col), c)
+		if err := json.Unmarshal(rec.Body.Bytes(), &v); err != nil {
+			t.Fatalf("col %d: status %d: %v", col, rec.Code, err)
+		}
+		return v
+	}
+
+	if v := preview(5); v.Row != 2 || !v.Wins || v.Draws || v.Full || v.Side != "R" {
+		t.Errorf("winning drop: %+v", v)
+	}
+	if v := preview(4); v.Row != 2 || v.Wins || len(v.Through) != 0 {
+		t.Errorf("onto a solid block: %+v", v)
+	}
+	if v := preview(2); !v.Full || v.Wins {
+		t.Errorf("full column: %+v", v)
+	}
+	if v := preview(6); v.Row != 5 || len(v.Through) != 1 || v.Through[0] != [2]int{4, 6} {
+		t.Errorf("through a block: %+v", v)
+	}
+	if rec := get(s.handleAPIPreview, "/api/preview?col=7", c); rec.Code != http.StatusBadRequest {
+		t.Errorf("column off the board: status %d", rec.Code)
+	}
+
+	if after := strings.Join(formatGrid(g.Grid), "/"); after != before || g.Turns != 0 || len(g.Moves) != 0 {
+		t.Errorf("previews changed the game: %s, turns %d", after, g.Turns)
+	}
+}
+
+// fakeRedis serves the RESP commands redisStore sends (AUTH, PING, GET,
+// SET, DEL, SCAN) from a map, on a loopback port.
+type fakeRedis struct {
+	mu       sync.Mutex
+	data     map[string]string
+	password string
+	ln       net.Listener
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{data: make(map[string]string), password: password, ln: ln}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	authed := f.password == ""
+	for {
+		req, err := readRESP(rd)
+		if err != nil {
+			return
+		}
+		items, _ := req.([]any)
+		args := make([]string, len(items))
+		for i, it := range items {
+			args[i], _ = it.(string)
+		}
+		if len(args) == 0 {
+			return
+		}
+		f.mu.Lock()
+		reply := "-ERR unknown command\r\n"
+		switch cmd := strings.ToUpper(args[0]); {
+		case cmd == "AUTH":
+			authed = args[1] == f.password
+			reply = "+OK\r\n"
+			if !authed {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case !authed:
+			reply = "-NOAUTH Authentication required.\r\n"
+		case cmd == "PING":
+			reply = "+PONG\r\n"
+		case cmd == "SET":
+			f.data[args[1]] = args[2]
+			reply = "+OK\r\n"
+		case cmd == "GET":
+			reply = "$-1\r\n"
+			if v, ok := f.data[args[1]]; ok {
+				reply = fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+			}
+		case cmd == "DEL":
+			n := 0
+			if _, ok := f.data[args[1]]; ok {
+				delete(f.data, args[1])
+				n = 1
+			}
+			reply = fmt.Sprintf(":%d\r\n", n)
+		case cmd == "SCAN":
+			var keys []string
+			for k := range f.data {
+				if ok, _ := path.Match(args[3], k); ok {
+					keys = append(keys, fmt.Sprintf("$%d\r\n%s\r\n", len(k), k))
+				}
+			}
+			reply = fmt.Sprintf("*2\r\n$1\r\n0\r\n*%d\r\n%s", len(keys), strings.Join(keys, ""))
+		}
+		f.mu.Unlock()
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+func TestStores(t *testing.T) {
+	f := newFakeRedis(t, "pw")
+	stores := map[string]Store{
+		"memory": newMemStore(),
+		"redis":  &redisStore{addr: f.ln.Addr().String(), password: "pw", prefix: "p4:", ttl: storeTTL},
+	}
+	for name, st := range stores {
+		if _, ok := st.Game("nope"); ok {
+			t.Errorf("%s: found a game never stored", name)
+		}
+		g := NewGameFromConfig(classic())
+		g.Player1 = "Ana"
+		g.Grid[5][3] = cellR
+		st.PutGame("sid1", g)
+		st.PutGame("sid1", g) // overwriting does not count twice
+		st.PutGame("sid2", NewGameFromConfig(classic()))
+		if got, ok := st.Game("sid1"); !ok || got.Player1 != "Ana" || got.Grid[5][3] != cellR {
+			t.Errorf("%s: game read back as %v", name, got)
+		}
+
+		st.PutLobby("ABCD", &lobby{Game: g, HasRed: true, SeatGen: 3})
+		st.PutLobby("EFGH", &lobby{})
+		if lb, ok := st.Lobby("ABCD"); !ok || !lb.HasRed || lb.SeatGen != 3 || lb.Game.Player1 != "Ana" {
+			t.Errorf("%s: lobby read back as %+v", name, lb)
+		}
+		codes := st.LobbyCodes()
+		sort.Strings(codes)
+		if strings.Join(codes, ",") != "ABCD,EFGH" {
+			t.Errorf("%s: lobby codes %v", name, codes)
+		}
+		if games, lobbies := st.Len(); games != 2 || lobbies != 2 {
+			t.Errorf("%s: Len %d games, %d lobbies", name, games, lobbies)
+		}
+
+		st.DeleteLobby("ABCD")
+		st.DeleteLobby("ABCD")
+		if _, ok := st.Lobby("ABCD"); ok {
+			t.Errorf("%s: deleted lobby still found", name)
+		}
+		if _, lobbies := st.Len(); lobbies != 1 {
+			t.Errorf("%s: %d lobbies after the delete", name, lobbies)
+		}
+	}
+
+	f.mu.Lock()
+	if _, ok := f.data["p4:lobby:EFGH"]; !ok {
+		t.Errorf("redis keys %v lack the prefix", f.data)
+	}
+	f.mu.Unlock()
+	bad := &redisStore{addr: f.ln.Addr().String(), password: "wrong", prefix: "p4:", ttl: storeTTL}
+	if _, err := bad.do("PING"); err == nil {
+		t.Error("a wrong password was accepted")
+	}
+}
+
+func TestOnlineLink(t *testing.T) {
+	s := newTestServer()
+	link := func(method string, c *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/online/WXYZ", nil)
+		if c != nil {
+			req.AddCookie(c)
+		}
+		rec := httptest.NewRecorder()
+		s.handleOnlineLink(rec, req)
+		return rec
+	}
+	host, guest, third := newSession(s, NewGameFromConfig(classic())), newSession(s, NewGameFromConfig(classic())), newSession(s, NewGameFromConfig(classic()))
+
+	// GET only shows the landing page, even for an unknown code
+	rec := link(http.MethodGet, host)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `action="/online/WXYZ"`) {
+		t.Fatalf("landing page: status %d", rec.Code)
+	}
+	if _, ok := s.store.Lobby("WXYZ"); ok {
+		t.Fatal("a GET created the lobby")
+	}
+
+	// create: the first POST makes the lobby, its sender holding Red
+	rec = link(http.MethodPost, host)
+	lb, ok := s.store.Lobby("WXYZ")
+	if !ok || !lb.seatOwnedBy("R", host.Value) || lb.HasYellow || rec.Header().Get("Location") != "/online/wait?code=WXYZ&side=R" {
+		t.Fatalf("create: lobby %v, redirect %q", ok, rec.Header().Get("Location"))
+	}
+	if rec := link(http.MethodGet, host); rec.Header().Get("Location") != "/online/wait?code=WXYZ&side=R" {
+		t.Errorf("creator's GET: redirect %q", rec.Header().Get("Location"))
+	}
+
+	// join: a GET leaves Yellow free, the POST takes it
+	if rec := link(http.MethodGet, guest); rec.Code != http.StatusOK || lb.HasYellow {
+		t.Fatalf("guest's GET: status %d, yellow taken %v", rec.Code, lb.HasYellow)
+	}
+	rec = link(http.MethodPost, guest)
+	if !lb.seatOwnedBy("Y", guest.Value) || rec.Header().Get("Location") != "/online/wait?code=WXYZ&side=Y" {
+		t.Fatalf("join: redirect %q", rec.Header().Get("Location"))
+	}
+	if rec := link(http.MethodPost, guest); rec.Header().Get("Location") != "/online/wait?code=WXYZ&side=Y" {
+		t.Errorf("joining twice: redirect %q", rec.Header().Get("Location"))
+	}
+
+	// spectate: with both seats taken, GET and POST both lead to the watch page
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		if rec := link(method, third); rec.Header().Get("Location") != "/online/watch?code=WXYZ" {
+			t.Errorf("%s when full: redirect %q", method, rec.Header().Get("Location"))
+		}
+	}
+	if !lb.seatOwnedBy("R", host.Value) || !lb.seatOwnedBy("Y", guest.Value) {
+		t.Error("a spectator moved a seat")
+	}
+
+	if rec := link(http.MethodDelete, host); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("DELETE: status %d", rec.Code)
+	}
+}
+
+func TestOnlineNoFlipLobby(t *testing.T) {
+	s := newTestServer()
+	// everFlips plays 14 quiet moves in a lobby created with query and
+	// reports whether gravity ever pointed up.
+	everFlips := func(code, query string) bool {
+		red, yellow := newSession(s, nil), newSession(s, nil)
+		get(s.handleOnlineCreate, "/online/create?code="+code+query, red)
+		lb, ok := s.store.Lobby(code)
+		if !ok {
+			t.Fatalf("lobby %s not created", code)
+		}
+		lb.HasYellow, lb.Joined, lb.YellowSID = true, true, yellow.Value
+		lb.ReadyR, lb.ReadyY = true, true
+		flipped := false
+		for i, col := range "01532524215532" {
+			side, c := "R", red
+			if i%2 == 1 {
+				side, c = "Y", yellow
+			}
+			post(s.handleOnlinePlay, "/online/play", url.Values{"code": {code}, "side": {side}, "col": {string(col)}, "token": {lb.MoveToken}}, c)
+			st := lobbyStateOf(lb, side, time.Now())
+			if lb.Game.Turns != i+1 || st.GravityUp != lb.Game.GravityUp {
+				t.Fatalf("%s move %d: turns %d, state gravity %v", code, i+1, lb.Game.Turns, st.GravityUp)
+			}
+			flipped = flipped || lb.Game.GravityUp
+		}
+		return flipped
+	}
+
+	if !everFlips("QRST", "") {
+		t.Fatal("the default lobby never flipped; the check below proves nothing")
+	}
+	if everFlips("QRSU", "&no_flip=1") {
+		t.Error("a no-flip lobby flipped gravity")
+	}
+}
+
+func TestWinOnTheLastCell(t *testing.T) {
+	// Yellow's drop in column 3 fills the board and completes a diagonal.
+	rows := []string{"YRR.YYR", "RYYRRRY", "YYRYYYR", "YRRYRYR", "YYRRRYY", "RRYRYRR"}
+	for _, up := range []bool{false, true} {
+		board := append([]string(nil), rows...)
+		if up { // the same board upside down: the gap is now at the bottom
+			for i, j := 0, len(board)-1; i < j; i, j = i+1, j-1 {
+				board[i], board[j] = board[j], board[i]
+			}
+		}
+		g := NewGameFromConfig(classic())
+		g.Grid, g.GravityUp = gridOf(t, board...), up
+		g.Turns, g.Current = 41, cellY
+		s := newTestServer()
+		post(s.handlePlay, "/play", url.Values{"col": {"3"}}, newSession(s, g))
+
+		last := [2]int{0, 3}
+		if up {
+			last = [2]int{5, 3}
+		}
+		if !g.GameOver || g.GameOverReason != reasonConnect || g.Scores.Y != 1 || g.Turns != 42 {
+			t.Errorf("gravity up %v: over %v, reason %q, scores %+v", up, g.GameOver, g.GameOverReason, g.Scores)
+		}
+		if len(g.WinLine) != 4 || (g.WinLine[0] != last && g.WinLine[3] != last) || g.Grid[last[0]][last[1]] != cellY {
+			t.Errorf("gravity up %v: line %v misses the last cell %v", up, g.WinLine, last)
+		}
+		if g.Message != "" || s.stats.draws != 0 || s.stats.winsBy[cellY] != 1 {
+			t.Errorf("gravity up %v: message %q, draws %d, wins %v", up, g.Message, s.stats.draws, s.stats.winsBy)
+		}
+	}
+}
+
+func TestHighlightMarksTheCurrentPlayersPieces(t *testing.T) {
+	s := newTestServer()
+	g := NewGameFromConfig(classic())
+	g.Grid = gridOf(t, ".......", ".......", ".......", "...Y...", "..XR...", ".RYRY..")
+	g.Current = cellY
+	c := newSession(s, g)
+
+	mine := s.viewModel(g)["Mine"].([][]bool)
+	for r, row := range g.Grid {
+		for col, v := range row {
+			if mine[r][col] != (v == cellY) {
+				t.Errorf("cell (%d,%d) %q: mine %v", r, col, v, mine[r][col])
+			}
+		}
+	}
+
+	on := &http.Cookie{Name: "pg_highlight", Value: "1"}
+	if n := strings.Count(get(s.handleGame, "/game", c, on).Body.String(), " mine\""); n != 3 {
+		t.Errorf("highlighted page marks %d cells, want Yellow's 3", n)
+	}
+	if n := strings.Count(get(s.handleGame, "/game", c).Body.String(), " mine\""); n != 0 {
+		t.Errorf("highlight off: %d cells marked", n)
+	}
+
+	// online, each seat sees its own pieces, whoever is to move
+	code, _, _ := seatedLobby(s, classic())
+	lb, _ := s.store.Lobby(code)
+	lb.Game.Grid = gridOf(t, ".......", ".......", ".......", ".......", ".......", "RRY....")
+	if m := s.lobbyViewModel(lb, code, "Y")["Mine"].([][]bool); m[5][0] || !m[5][2] {
+		t.Errorf("Yellow's seat marks %v", m[5])
+	}
+}
+
+func TestCORS(t *testing.T) {
+	s := newTestServer()
+	s.corsOrigins = parseOrigins(" https://arena.example.com/ ,https://bots.example.org")
+	h := s.cors(s.handleAPIStats)
+	call := func(method, origin string, preflight bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/stats", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		if preflight {
+			req.Header.Set("Access-Control-Request-Method", "GET")
+		}
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		return rec
+	}
+
+	rec := call(http.MethodGet, "https://arena.example.com", false)
+	if rec.Code != http.StatusOK || rec.Header().Get("Access-Control-Allow-Origin") != "https://arena.example.com" ||
+		rec.Header().Get("Access-Control-Allow-Credentials") != "true" || rec.Header().Get("Vary") != "Origin" {
+		t.Errorf("allowed origin: status %d, headers %v", rec.Code, rec.Header())
+	}
+
+	rec = call(http.MethodGet, "https://evil.example.net", false)
+	if rec.Header().Get("Access-Control-Allow-Origin") != "" || rec.Header().Get("Access-Control-Allow-Credentials") != "" {
+		t.Errorf("other origin got %v", rec.Header())
+	}
+	if rec := call(http.MethodOptions, "https://evil.example.net", true); rec.Code != http.StatusForbidden {
+		t.Errorf("other origin's preflight: status %d", rec.Code)
+	}
+
+	rec = call(http.MethodOptions, "https://bots.example.org", true)
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Access-Control-Allow-Methods") == "" ||
+		rec.Header().Get("Access-Control-Allow-Origin") != "https://bots.example.org" || rec.Body.Len() != 0 {
+		t.Errorf("preflight: status %d, headers %v", rec.Code, rec.Header())
+	}
+
+	if rec := call(http.MethodGet, "", false); rec.Header().Get("Access-Control-Allow-Origin") != "" || rec.Code != http.StatusOK {
+		t.Errorf("same origin: status %d, headers %v", rec.Code, rec.Header())
+	}
+
+	// "*" lets anyone read, but never with the session cookie
+	s.corsOrigins = parseOrigins("*")
+	rec = call(http.MethodGet, "https://anyone.example", false)
+	if rec.Header().Get("Access-Control-Allow-Origin") != "*" || rec.Header().Get("Access-Control-Allow-Credentials") != "" {
+		t.Errorf("wildcard: headers %v", rec.Header())
+	}
+
+	// the default allows no other origin
+	s.corsOrigins = parseOrigins("")
+	if rec := call(http.MethodOptions, "https://arena.example.com", true); rec.Code != http.StatusForbidden {
+		t.Errorf("default preflight: status %d", rec.Code)
+	}
+}
+
+func TestMoveChainDetectsTampering(t *testing.T) {
+	s := newTestServer()
+	code, red, yellow := seatedLobby(s, classic())
+	lb, _ := s.store.Lobby(code)
+	for i, col := range "3344556" {
+		side, c := "R", red
+		if i%2 == 1 {
+			side, c = "Y", yellow
+		}
+		post(s.handleOnlinePlay, "/online/play", url.Values{"code": {code}, "side": {side}, "col": {string(col)}, "token": {lb.MoveToken}}, c)
+	}
+
+	var export struct {
+		Start     []string   `json:"start"`
+		Moves     []logEntry `json:"moves"`
+		ChainHead string     `json:"chainHead"`
+	}
+	rec := get(s.handleOnlineMoves, "/online/moves?code="+code)
+	if err := json.Unmarshal(rec.Body.Bytes(), &export); err != nil {
+		t.Fatalf("status %d: %v", rec.Code, err)
+	}
+	if len(export.Moves) != 7 || export.ChainHead != export.Moves[6].Hash {
+		t.Fatalf("%d moves, head %q", len(export.Moves), export.ChainHead)
+	}
+	if i := verifyChain(export.Start, export.Moves); i != -1 {
+		t.Fatalf("untouched game fails at move %d", i)
+	}
+
+	tamper := map[string]func(m *logEntry){
+		"col":     func(m *logEntry) { m.Col = 6 - m.Col },
+		"row":     func(m *logEntry) { m.Row-- },
+		"side":    func(m *logEntry) { m.Side = "Y" },
+		"gravity": func(m *logEntry) { m.GravityUp = !m.GravityUp },
+		"kind":    func(m *logEntry) { m.Kind = "clear" },
+	}
+	for name, edit := range tamper {
+		moves := append([]logEntry(nil), export.Moves...)
+		edit(&moves[2])
+		if i := verifyChain(export.Start, moves); i != 2 {
+			t.Errorf("%s of move 3 changed: verifyChain = %d, want 2", name, i)
+		}
+	}
+	start := append([]string(nil), export.Start...)
+	start[0] = "X......"
+	if i := verifyChain(start, export.Moves); i != 0 {
+		t.Errorf("changed starting board: verifyChain = %d, want 0", i)
+	}
+}
+
+func TestAINameReachesTheResultPage(t *testing.T) {
+	s := newTestServer()
+	rec := post(s.handleStartPost, "/start", url.Values{"mode": {"ai"}, "player1": {"Ana"}, "ai_name": {"RoboPower"}, "variant": {"classic"}})
+	c := issuedCookie(t, s, rec)
+	g := sessionOf(t, s, c)
+	if g.AIName != "RoboPower" || g.Player2 != "RoboPower" || !g.isAISide(cellY) {
+		t.Fatalf("AI name %q, yellow %q", g.AIName, g.Player2)
+	}
+	if body := get(s.handleGame, "/game", c).Body.String(); !strings.Contains(body, "RoboPower 🤖") {
+		t.Error("the game page does not label the AI")
+	}
+
+	// Red ignores Yellow's row; the AI completes it
+	g.Grid = gridOf(t, ".......", ".......", ".......", ".......", ".......", "....YYY")
+	g.Turns, g.Current = 4, cellR
+	post(s.handlePlay, "/play", url.Values{"col": {"0"}}, c)
+	if !g.GameOver {
+		t.Fatal("the AI did not win")
+	}
+	if body := get(s.handleResult, "/result", c).Body.String(); !strings.Contains(body, "Victoire de RoboPower 🤖") {
+		t.Error("the result page does not name the AI")
+	}
+}
+
+func TestFlipTimingPerMode(t *testing.T) {
+	s := newTestServer()
+	// gravities lists the gravity after each of 8 moves: U for up, D for down
+	gravities := func(players int, mode string) string {
+		cfg := classic()
+		cfg.Players, cfg.FlipEvery, cfg.FlipMode = players, 2, mode
+		c := newSession(s, NewGameFromConfig(cfg))
+		g := sessionOf(t, s, c)
+		out := ""
+		for i := 0; i < 8; i++ {
+			post(s.handlePlay, "/play", url.Values{"col": {strconv.Itoa(i % 7)}}, c)
+			if g.Turns != i+1 {
+				t.Fatalf("%d players, %q: move %d not played", players, mode, i+1)
+			}
+			out += map[bool]string{false: "D", true: "U"}[g.GravityUp]
+		}
+		return out
+	}
+
+	for _, tc := range []struct {
+		players int
+		mode    string
+		want    string
+	}{
+		{2, flipPerMove, "DUUDDUUD"},
+		{2, flipPerRound, "DDDUUUUD"},
+		{3, flipPerMove, "DUUDDUUD"},
+		{3, flipPerRound, "DDDDDUUU"},
+	} {
+		if got := gravities(tc.players, tc.mode); got != tc.want {
+			t.Errorf("%d players, %s: gravity %s, want %s", tc.players, tc.mode, got, tc.want)
+		}
+	}
+}
+
+func TestRerollOnlyBeforeTheFirstMove(t *testing.T) {
+	s := newTestServer()
+	cfg := rulesFor("easy", "").config()
+	cfg.Player1, cfg.Player2, cfg.Seed = "Ana", "Ben", 1
+	c := newSession(s, NewGameFromConfig(cfg))
+	g := sessionOf(t, s, c)
+	layout := func() string { return strings.Join(formatGrid(g.Grid), "/") }
+	blocks := func() int { return strings.Count(layout(), "X") }
+	first, n := layout(), blocks()
+
+	post(s.handleReroll, "/board/reroll", url.Values{"seed": {"7"}}, c)
+	seven := layout()
+	if seven == first || blocks() != n || g.Player1 != "Ana" || g.Seed != 7 || strings.Join(formatGrid(g.Start), "/") != seven {
+		t.Fatalf("reroll: %s (was %s), %d blocks, players %q, seed %d", seven, first, blocks(), g.Player1, g.Seed)
+	}
+	post(s.handleReroll, "/board/reroll", url.Values{"seed": {"8"}}, c)
+	post(s.handleReroll, "/board/reroll", url.Values{"seed": {"7"}}, c)
+	if layout() != seven {
+		t.Errorf("seed 7 again: %s, want %s", layout(), seven)
+	}
+
+	post(s.handlePlay, "/play", url.Values{"col": {"3"}}, c)
+	played := layout()
+	if rec := post(s.handleReroll, "/board/reroll", url.Values{"seed": {"8"}}, c); rec.Code != http.StatusConflict || layout() != played {
+		t.Errorf("after a move: status %d, board %s", rec.Code, layout())
+	}
+}
+
+func TestDegenerateGridsDoNotPanic(t *testing.T) {
+	grids := map[string]func() [][]byte{
+		"nil":      func() [][]byte { return nil },
+		"no rows":  func() [][]byte { return [][]byte{} },
+		"no cols":  func() [][]byte { return [][]byte{{}} },
+		"1x1":      func() [][]byte { return [][]byte{{cellEmpty}} },
+		"1x1 full": func() [][]byte { return [][]byte{{cellR}} },
+	}
+	lens := lensFor(4, dirLens{})
+	for name, grid := range grids {
+		g := NewGameFromConfig(classic())
+		g.Grid = grid()
+		g.Rows, g.Cols = len(g.Grid), 0
+		if len(g.Grid) > 0 {
+			g.Cols = len(g.Grid[0])
+		}
+		helpers := map[string]func(){
+			"winningLine":     func() { winningLine(grid(), 0, 0, cellR, lens) },
+			"findWin":         func() { findWin(grid(), cellR, lens) },
+			"isDraw":          func() { isDraw(grid()) },
+			"isDeadPosition":  func() { isDeadPosition(grid(), lens, cellR) },
+			"minMissing":      func() { minMissing(grid(), lens, cellR) },
+			"hasWinnableLine": func() { hasWinnableLine(grid(), 4) },
+			"lineMap":         func() { lineMap(grid(), 4) },
+			"boardFairness":   func() { boardFairness(grid(), 4, false) },
+			"placeBlocks":     func() { placeBlocks(grid(), 3, cellBlk, mrand.New(mrand.NewSource(1))) },
+			"dropRow":         func() { dropRow(grid(), 0, false) },
+			"resettleBoard":   func() { resettleBoard(grid(), true) },
+			"formatGrid":      func() { formatGrid(grid()) },
+			"landingRow":      func() { landingRow(g, 0) },
+			"noMoveLeft":      func() { noMoveLeft(g) },
+			"evalBoard":       func() { evalBoard(g, cellR, g.AI) },
+			"chooseMove":      func() { chooseMove(g, cellR) },
+		}
+		for fn, call := range helpers {
+			func() {
+				defer func() {
+					if p := recover(); p != nil {
+						t.Errorf("%s on a %s grid panics: %v", fn, name, p)
+					}
+				}()
+				call()
+			}()
+		}
+	}
+}
+
+func TestCenterOpening(t *testing.T) {
+	s := newTestServer()
+	cfg := classic()
+	cfg.CenterOpening = true
+	c := newSession(s, NewGameFromConfig(cfg))
+	g := sessionOf(t, s, c)
+
+	disabled := s.viewModel(g)["Disabled"].([]bool)
+	for col, off := range disabled {
+		if off != (col != 3) {
+			t.Errorf("first move: column %d disabled %v", col, off)
+		}
+	}
+	post(s.handlePlay, "/play", url.Values{"col": {"0"}}, c)
+	if g.Turns != 0 {
+		t.Fatal("an off-center first move was played")
+	}
+	post(s.handlePlay, "/play", url.Values{"col": {"3"}}, c)
+	post(s.handlePlay, "/play", url.Values{"col": {"0"}}, c)
+	if g.Turns != 2 || g.Grid[5][0] != cellY {
+		t.Errorf("after the opening: turns %d", g.Turns)
+	}
+
+	// an even board has two middle columns
+	cfg.Cols = 8
+	g = NewGameFromConfig(cfg)
+	for col := 0; col < 8; col++ {
+		if openingAllows(g, col) != (col == 3 || col == 4) {
+			t.Errorf("8 columns: column %d allowed %v", col, openingAllows(g, col))
+		}
+	}
+
+	cfg.Cols = 7
+	code, red, _ := seatedLobby(s, cfg)
+	lb, _ := s.store.Lobby(code)
+	post(s.handleOnlinePlay, "/online/play", url.Values{"code": {code}, "side": {"R"}, "col": {"1"}, "token": {lb.MoveToken}}, red)
+	if lb.Game.Turns != 0 {
+		t.Error("online: an off-center first move was played")
+	}
+	post(s.handleOnlinePlay, "/online/play", url.Values{"code": {code}, "side": {"R"}, "col": {"3"}, "token": {lb.MoveToken}}, red)
+	if lb.Game.Turns != 1 {
+		t.Error("online: the center first move was refused")
+	}
+}
+
+func TestAchievements(t *testing.T) {
+	s := newTestServer()
+	// win has Red win on grid (gravity up or down) by dropping into col 3
+	win := func(name, series string, up bool, rows ...string) (*Game, *http.Cookie) {
+		t.Helper()
+		g := NewGameFromConfig(classic())
+		g.Player1, g.Series = name, series
+		g.Grid, g.GravityUp, g.Current = gridOf(t, rows...), up, cellR
+		c := newSession(s, g)
+		post(s.handlePlay, "/play", url.Values{"col": {"3"}}, c)
+		if !g.GameOver || g.GameOverReason != reasonConnect {
+			t.Fatalf("%s did not win", name)
+		}
+		return g, c
+	}
+	bottom := []string{".......", ".......", ".......", ".......", "YYY....", "RRR...."}
+	top := []string{"RRR....", "YYY....", ".......", ".......", ".......", "......."}
+
+	g, c := win("Ana", "", false, bottom...)
+	if strings.Join(g.Trophies, ",") != "first-win" {
+		t.Errorf("first win: %v", g.Trophies)
+	}
+	if body := get(s.handleResult, "/result", c).Body.String(); !strings.Contains(body, "Première victoire") {
+		t.Error("the result page does not show the first-win trophy")
+	}
+	if g, _ = win(" ana ", "", false, bottom...); len(g.Trophies) != 0 {
+		t.Errorf("same player, second win: %v", g.Trophies)
+	}
+
+	// 0–2 down, then level, then ahead
+	if g, _ = win("Ben", "YYRR", false, bottom...); strings.Join(g.Trophies, ",") != "first-win,comeback" {
+		t.Errorf("comeback: %v", g.Trophies)
+	}
+	if g, _ = win("Cléo", "YRY", false, bottom...); strings.Contains(strings.Join(g.Trophies, ","), "comeback") {
+		t.Errorf("never 0–2 down: %v", g.Trophies)
+	}
+
+	if g, _ = win("Dan", "", true, top...); strings.Join(g.Trophies, ",") != "first-win,upside-down" {
+		t.Errorf("win with gravity up: %v", g.Trophies)
+	}
+}
+
+func TestChatLimits(t *testing.T) {
+	s := newTestServer()
+	code, red, _ := seatedLobby(s, classic())
+	say := func(code, text string, c *http.Cookie) int {
+		return post(s.handleChatPost, "/chat/post", url.Values{"code": {code}, "side": {"R"}, "text": {text}}, c).Code
+	}
+
+	// the configured cap replaces the default, both ways
+	s.chatMaxLen = 300
+	if st := say(code, strings.Repeat("a", defaultChatMaxLen+40), red); st != http.StatusNoContent {
+		t.Errorf("%d characters under a 300 cap: status %d", defaultChatMaxLen+40, st)
+	}
+	if st := say(code, strings.Repeat("a", 301), red); st != http.StatusRequestEntityTooLarge {
+		t.Errorf("301 characters: status %d", st)
+	}
+	s.chatMaxLen = 10
+	if st := say(code, strings.Repeat("é", 10), red); st != http.StatusNoContent {
+		t.Errorf("10 accented characters under a 10 cap: status %d", st)
+	}
+	if st := say(code, strings.Repeat("é", 11), red); st != http.StatusRequestEntityTooLarge {
+		t.Errorf("11 characters: status %d", st)
+	}
+
+	// one budget for every lobby
+	s.chatLimiter = newIPLimiter(1, 2)
+	other, red2, _ := seatedLobby(s, classic())
+	say(code, "un", red)
+	say(other, "deux", red2)
+	rec := post(s.handleChatPost, "/chat/post", url.Values{"code": {other}, "side": {"R"}, "text": {"trois"}}, red2)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("third message across lobbies: status %d, Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+}
+
+func TestDoubleCreateMakesOneLobby(t *testing.T) {
+	s := newTestServer()
+	c := newSession(s, nil)
+	create := func(c *http.Cookie) string {
+		return redirectQuery(t, get(s.handleOnlineCreate, "/online/create?p1=Ana", c)).Get("code")
+	}
+
+	first, second := create(c), create(c)
+	if first == "" || second != first {
+		t.Fatalf("double click: lobbies %q and %q", first, second)
+	}
+	if _, lobbies := s.store.Len(); lobbies != 1 {
+		t.Fatalf("%d lobbies after a double click", lobbies)
+	}
+
+	if other := create(newSession(s, nil)); other == first {
+		t.Error("another session got the same lobby")
+	}
+
+	// past the debounce, the same session gets a new lobby
+	rc := s.recentCreates[c.Value]
+	rc.at = rc.at.Add(-createDebounce)
+	s.recentCreates[c.Value] = rc
+	if later := create(c); later == first {
+		t.Error("a create after the debounce reused the lobby")
+	}
+	if _, lobbies := s.store.Len(); lobbies != 3 {
+		t.Errorf("%d lobbies, want 3", lobbies)
+	}
+}
+
+func TestFinishedGameRender(t *testing.T) {
+	s := newTestServer()
+	c := newSession(s, NewGameFromConfig(classic()))
+	post(s.handlePlay, "/play", url.Values{"col": {"3"}}, c)
+	rec := get(s.handleGame, "/game", c)
+	body := rec.Body.String()
+	if rec.Code != http.StatusOK || strings.Contains(body, "notice finished") || !strings.Contains(body, `class="col-hit"`) {
+		t.Fatalf("in progress: status %d, finished notice or no columns", rec.Code)
+	}
+
+	for _, m := range "030303" {
+		post(s.handlePlay, "/play", url.Values{"col": {string(m)}}, c)
+	}
+	if g := sessionOf(t, s, c); !g.GameOver {
+		t.Fatal("game not over")
+	}
+	rec = get(s.handleGame, "/game", c)
+	body = rec.Body.String()
+	if rec.Code != http.StatusOK || rec.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("finished: status %d, Cache-Control %q", rec.Code, rec.Header().Get("Cache-Control"))
+	}
+	for _, want := range []string{`class="notice finished"`, `action="/replay"`, `action="/reset"`, `action="/result"`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("finished page lacks %s", want)
+		}
+	}
+	for _, gone := range []string{`class="col-hit"`, `action="/coords"`, `action="/highlight"`, `class="hint-bar"`} {
+		if strings.Contains(body, gone) {
+			t.Errorf("finished page still shows %s", gone)
+		}
+	}
+}
+
+func TestPuzzleLink(t *testing.T) {
+	s := newTestServer()
+	g := NewGameFromConfig(classic())
+	g.Grid = gridOf(t, ".......", ".......", ".......", "...Y...", "..RR.X.", ".YRYS..")
+	d := encodePuzzle(g)
+
+	rec := get(s.handlePuzzle, "/puzzle?d="+d)
+	if rec.Code != http.StatusSeeOther && rec.Code != http.StatusFound {
+		t.Fatalf("valid link: status %d: %s", rec.Code, rec.Body)
+	}
+	pg := issuedSession(t, s, rec)
+	if got, want := strings.Join(formatGrid(pg.Grid), "/"), strings.Join(formatGrid(g.Grid), "/"); got != want {
+		t.Errorf("round trip: %s, want %s", got, want)
+	}
+	if pg.WinLen != 4 || pg.Current != cellR || pg.GameOver {
+		t.Errorf("round trip: win %d, current %c, over %v", pg.WinLen, pg.Current, pg.GameOver)
+	}
+	if again := encodePuzzle(pg); again != d {
+		t.Errorf("re-encoded %q, want %q", again, d)
+	}
+
+	raw, _ := base64.RawURLEncoding.DecodeString(d)
+	badCell := append([]byte(nil), raw...)
+	badCell[len(badCell)-1] = 0xff
+	for name, tc := range map[string]struct {
+		d    string
+		want int
+	}{
+		"oversized":  {strings.Repeat("A", maxPuzzleParam+1), http.StatusRequestEntityTooLarge},
+		"not base64": {"!!" + d, http.StatusBadRequest},
+		"truncated":  {base64.RawURLEncoding.EncodeToString(raw[:len(raw)-1]), http.StatusBadRequest},
+		"bad cell":   {base64.RawURLEncoding.EncodeToString(badCell), http.StatusBadRequest},
+		"empty":      {"", http.StatusBadRequest},
+	} {
+		if rec := get(s.handlePuzzle, "/puzzle?d="+url.QueryEscape(tc.d)); rec.Code != tc.want {
+			t.Errorf("%s: status %d, want %d", name, rec.Code, tc.want)
+		}
+	}
+}
+
+func TestResultsLogAppendsAJSONLine(t *testing.T) {
+	s := newTestServer()
+	path := t.TempDir() + "/results.jsonl"
+	var err error
+	if s.results, err = openResultsLog(path); err != nil {
+		t.Fatal(err)
+	}
+	finish := func() *Game {
+		c := newSession(s, NewGameFromConfig(classic()))
+		for _, m := range "3030303" {
+			post(s.handlePlay, "/play", url.Values{"col": {string(m)}}, c)
+		}
+		return sessionOf(t, s, c)
+	}
+	if g := finish(); !g.GameOver {
+		t.Fatal("game not over")
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	if len(lines) != 1 || !strings.HasSuffix(string(b), "\n") {
+		t.Fatalf("log = %q, want one terminated line", b)
+	}
+	var sum gameSummary
+	if err := json.Unmarshal([]byte(lines[0]), &sum); err != nil {
+		t.Fatalf("line %q: %v", lines[0], err)
+	}
+	if sum.WinnerSide != "R" || sum.Reason != string(reasonConnect) || sum.Turns != 7 || len(sum.Players) != 2 || sum.At.IsZero() {
+		t.Errorf("summary = %+v", sum)
+	}
+
+	// a failed write is logged, the game still ends
+	s.results.f.Close()
+	if g := finish(); !g.GameOver {
+		t.Error("game not over after a failed log write")
+	}
+}
+
+func TestSelectiveSearchFindsATwoMoveWin(t *testing.T) {
+	g := NewGameFromConfig(classic())
+	// Red in 2 makes YYRRR.Y on the bottom row and leaves RR.RR above it
+	// to fill: two threats, Yellow blocks one at most
+	g.Grid = gridOf(t, ".......", ".......", ".......", "YY.....", "RR.RR.Y", "YY.RR.Y")
+	g.Current, g.Turns = cellR, 12
+	if hasWinningDrop(g, cellR) {
+		t.Fatal("Red already wins in one")
+	}
+	before := strings.Join(formatGrid(g.Grid), "/")
+
+	if c := chooseMove(g, cellR); c == 2 {
+		t.Fatal("the one-ply AI already finds the win; pick a harder position")
+	}
+	g.AI.Selective = 2
+	if c := chooseMove(g, cellR); c != 2 {
+		t.Errorf("selective AI plays %d, want 2", c)
+	}
+	if after := strings.Join(formatGrid(g.Grid), "/"); after != before || g.Turns != 12 || g.GravityUp {
+		t.Errorf("search left the board as %s, turn %d", after, g.Turns)
+	}
+	if !winsByForce(g, 2, cellR, 2) || winsByForce(g, 2, cellR, 1) {
+		t.Error("column 2 should win in two moves, not one")
+	}
+}
+
+func TestMultiBlockPassThrough(t *testing.T) {
+	s := newTestServer()
+	g := NewGameFromConfig(classic())
+	g.Grid = gridOf(t, ".......", "...X...", ".......", "...X...", ".......", "X......")
+	c := newSession(s, g)
+	post(s.handlePlay, "/play", url.Values{"col": {"3"}}, c)
+	if g.Grid[5][3] != cellR {
+		t.Fatalf("piece not at the bottom: %v", formatGrid(g.Grid))
+	}
+
+	d := lastDrop(g)
+	if d == nil || d.From != "top" || len(d.Path) != 6 || d.Path[5] != [2]int{5, 3} {
+		t.Fatalf("drop = %+v", d)
+	}
+	if want := [][2]int{{1, 3}, {3, 3}}; fmt.Sprint(d.Through) != fmt.Sprint(want) {
+		t.Errorf("through = %v, want %v", d.Through, want)
+	}
+	passed := s.viewModel(g)["Passed"].([][]bool)
+	n := 0
+	for r := range passed {
+		for c := range passed[r] {
+			if passed[r][c] {
+				n++
+			}
+		}
+	}
+	if n != 2 || !passed[1][3] || !passed[3][3] || passed[5][0] {
+		t.Errorf("passed = %v", passed)
+	}
+	if body := get(s.handleGame, "/game", c).Body.String(); strings.Count(body, " passed\"") != 2 {
+		t.Errorf("page marks %d cells passed, want 2", strings.Count(body, " passed\""))
+	}
+}
+
+func TestSeedPicksTheStarter(t *testing.T) {
+	seen := map[byte]bool{}
+	for seed := int64(1); seed <= 40; seed++ {
+		cfg := rulesFor("normal", "").config()
+		cfg.RandomStart, cfg.Seed = true, seed
+		a, b := NewGameFromConfig(cfg), NewGameFromConfig(cfg)
+		if a.Current != b.Current || a.Current != firstPlayer(seed, 2) {
+			t.Fatalf("seed %d: starters %c and %c, firstPlayer %c", seed, a.Current, b.Current, firstPlayer(seed, 2))
+		}
+		if coinStarter(a) != playerName(a, a.Current) {
+			t.Errorf("seed %d: announced %q, starter %c", seed, coinStarter(a), a.Current)
+		}
+		seen[a.Current] = true
+
+		cfg.RandomStart = false
+		if g := NewGameFromConfig(cfg); g.Current != cellR || coinStarter(g) != "" {
+			t.Errorf("seed %d without the coin: starter %c, announced %q", seed, g.Current, coinStarter(g))
+		}
+	}
+	if !seen[cellR] || !seen[cellY] {
+		t.Errorf("40 seeds only ever started %v", seen)
+	}
+	for seed := int64(1); seed <= 40; seed++ {
+		if p := firstPlayer(seed, 3); p != cellR && p != cellY && p != cellG {
+			t.Fatalf("three players, seed %d: starter %c", seed, p)
+		}
+	}
+}
+
+func TestHistoryStateMatchesAForwardReplay(t *testing.T) {
+	s := newTestServer()
+	cfg := rulesFor("normal", "").config()
+	cfg.Seed = 3
+	c := newSession(s, NewGameFromConfig(cfg))
+	g := sessionOf(t, s, c)
+	if g.FlipEvery == 0 {
+		t.Fatal("normal rules without flips")
+	}
+
+	type snap struct {
+		grid string
+		up   bool
+		next string
+	}
+	snaps := []snap{{strings.Join(formatGrid(g.Grid), "/"), g.GravityUp, string(g.Current)}}
+	rng := mrand.New(mrand.NewSource(5))
+	for len(g.Moves) < 14 && !g.GameOver {
+		col := rng.Intn(g.Cols)
+		if _, ok := landingRow(g, col); !ok {
+			continue
+		}
+		post(s.handlePlay, "/play", url.Values{"col": {strconv.Itoa(col)}}, c)
+		snaps = append(snaps, snap{strings.Join(formatGrid(g.Grid), "/"), g.GravityUp, string(g.Current)})
+	}
+	flipped := false
+	for _, sn := range snaps {
+		flipped = flipped || sn.up
+	}
+	if !flipped || len(snaps) != len(g.Moves)+1 {
+		t.Fatalf("%d moves, flipped %v: pick another seed", len(g.Moves), flipped)
+	}
+
+	for _, ply := range []int{0, 4, 5, 6, 9, len(g.Moves)} {
+		rec := get(s.handleHistoryState, "/game/history/state?ply="+strconv.Itoa(ply), c)
+		var got struct {
+			Grid      []string `json:"grid"`
+			GravityUp bool     `json:"gravityUp"`
+			ToMove    string   `json:"toMove"`
+			Turns     int      `json:"turns"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("ply %d: status %d: %s", ply, rec.Code, rec.Body)
+		}
+		want := snaps[ply]
+		if grid := strings.Join(got.Grid, "/"); grid != want.grid || got.GravityUp != want.up || got.ToMove != want.next || got.Turns != ply {
+			t.Errorf("ply %d: %s up=%v next=%s turns=%d, want %s up=%v next=%s",
+				ply, grid, got.GravityUp, got.ToMove, got.Turns, want.grid, want.up, want.next)
+		}
+	}
+	for _, q := range []string{"-1", strconv.Itoa(len(g.Moves) + 1), "x"} {
+		if rec := get(s.handleHistoryState, "/game/history/state?ply="+q, c); rec.Code != http.StatusBadRequest {
+			t.Errorf("ply=%s: status %d", q, rec.Code)
+		}
+	}
+}
+
+func TestBlockDensity(t *testing.T) {
+	for _, tc := range []struct{ rows, cols, pct, want int }{
+		{6, 7, 0, 0},
+		{6, 7, 15, 6},  // 6.3
+		{6, 7, 10, 4},  // 4.2
+		{7, 9, 25, 16}, // 15.75, rounded up
+		{6, 7, 40, 14}, // 16.8, capped at a third
+		{12, 12, 40, 48},
+		{4, 4, 40, 5},
+	} {
+		if got := blocksForDensity(tc.rows, tc.cols, tc.pct); got != tc.want {
+			t.Errorf("%d×%d at %d%%: %d blocks, want %d", tc.rows, tc.cols, tc.pct, got, tc.want)
+		}
+	}
+
+	s := newTestServer()
+	blocks := func(g *Game) int { return strings.Count(strings.Join(formatGrid(g.Grid), ""), "X") }
+	for pct, want := range map[string]func(rows, cols int) int{
+		"0":  func(int, int) int { return 0 },
+		"20": func(rows, cols int) int { return (rows*cols*20 + 50) / 100 },
+		"40": maxBlocks,
+	} {
+		rec := post(s.handleStartPost, "/start", url.Values{"difficulty": {"normal"}, "custom_density": {"1"}, "block_density": {pct}})
+		g := issuedSession(t, s, rec)
+		if n := blocks(g); n != want(g.Rows, g.Cols) {
+			t.Errorf("%s%% on %d×%d: %d blocks, want %d", pct, g.Rows, g.Cols, n, want(g.Rows, g.Cols))
+		}
+	}
+	for _, pct := range []string{"-1", "41"} {
+		rec := post(s.handleStartPost, "/start", url.Values{"difficulty": {"normal"}, "custom_density": {"1"}, "block_density": {pct}})
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "densité entre 0 et 40") {
+			t.Errorf("%s%%: status %d, no density error", pct, rec.Code)
+		}
+		if rec := get(s.handleOnlineCreate, "/online/create?density="+pct, newSession(s, nil)); rec.Code != http.StatusBadRequest {
+			t.Errorf("online at %s%%: status %d", pct, rec.Code)
+		}
+	}
+
+	rec := get(s.handleOnlineCreate, "/online/create?rows=8&cols=8&density=40", newSession(s, nil))
+	lb, ok := s.store.Lobby(redirectQuery(t, rec).Get("code"))
+	if !ok {
+		t.Fatal("no lobby created")
+	}
+	if n := blocks(lb.Game); n != maxBlocks(8, 8) {
+		t.Errorf("online 8×8 at 40%%: %d blocks, want %d", n, maxBlocks(8, 8))
+	}
+}
+
+func TestResultOG(t *testing.T) {
+	s := newTestServer()
+	code, red, _ := seatedLobby(s, classic())
+	lb, _ := s.store.Lobby(code)
+	g := lb.Game
+	g.Player1, g.Player2 = "Ana", "Zoé"
+	g.Scores.R, g.Scores.Y = 2, 4
+	g.GameOver, g.GameOverReason, g.LastPlayed = true, reasonConnect, cellY
+
+	rec := get(s.handleResultOG, "/result/og?code="+strings.ToLower(code))
+	body := rec.Body.String()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, body)
+	}
+	for _, want := range []string{
+		`<meta property="og:title" content="Zoé a gagné 4-2"/>`,
+		`content="http://example.com/result/board.png?code=` + code + `"`,
+		`href="/online/watch?code=` + code + `"`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("page lacks %s", want)
+		}
+	}
+
+	g.Scores.R, g.Scores.Y, g.LastPlayed = 3, 1, cellR
+	if body := get(s.handleResultOG, "/result/og?code="+code).Body.String(); !strings.Contains(body, `content="Ana a gagné 3-1"`) {
+		t.Error("Red's win is not titled winner first")
+	}
+
+	// a session's game has no address a link preview could follow
+	for _, q := range []string{"", "?code=", "?code=%20"} {
+		if rec := get(s.handleResultOG, "/result/og"+q, red); rec.Code != http.StatusNotFound {
+			t.Errorf("og%s: status %d, want 404", q, rec.Code)
+		}
+	}
+	if rec := get(s.handleResultOG, "/result/og?code=ZZZZ"); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown lobby: status %d", rec.Code)
+	}
+}
+
+func TestStoreCountersMatchTheMaps(t *testing.T) {
+	s := newTestServer()
+	s.unjoinedTTL = 15 * time.Minute
+	m := s.store.(*memStore)
+	check := func(step string) {
+		t.Helper()
+		games, lobbies := m.Len()
+		if games != len(m.games) || lobbies != len(m.lobbies) {
+			t.Fatalf("%s: counted %d games, %d lobbies; maps hold %d, %d", step, games, lobbies, len(m.games), len(m.lobbies))
+		}
+		var v statsView
+		if err := json.Unmarshal(get(s.handleAPIStats, "/api/stats").Body.Bytes(), &v); err != nil {
+			t.Fatal(err)
+		}
+		if v.Sessions != games || v.ActiveLobbies != lobbies {
+			t.Fatalf("%s: /api/stats says %d sessions, %d lobbies", step, v.Sessions, v.ActiveLobbies)
+		}
+	}
+
+	check("empty")
+	for i := 0; i < 3; i++ {
+		get(s.handleOnlineCreate, "/online/create", newSession(s, nil))
+	}
+	check("three invites")
+	seated, _, _ := seatedLobby(s, classic())
+	check("a seated lobby")
+	c := newSession(s, nil)
+	m.PutGame(c.Value, NewGameFromConfig(classic()))
+	check("a game stored again under its id")
+	var invite string
+	for _, code := range m.LobbyCodes() {
+		if code != seated {
+			invite = code
+		}
+	}
+	m.DeleteLobby(invite)
+	m.DeleteLobby(invite)
+	m.DeleteLobby("ZZZZ")
+	check("deletes, twice and unknown")
+	m.PutLobby(invite, newLobby(classic(), c.Value))
+	check("a code reused")
+
+	// the sweeper drops the unanswered invites, keeps the seated lobby
+	s.sweepLobbies(time.Now().Add(20 * time.Minute))
+	if _, lobbies := m.Len(); lobbies != 1 {
+		t.Errorf("%d lobbies after the sweep, want the seated one", lobbies)
+	}
+	check("after the sweep")
+	s.sweepLobbies(time.Now().Add(2 * lobbyIdleTTL))
+	check("everything swept")
+}
+
+func TestNextRound(t *testing.T) {
+	s := newTestServer()
+	cfg := rulesFor("normal", "").config()
+	cfg.Player1, cfg.Player2 = "Ana", "Ben"
+	c := newSession(s, NewGameFromConfig(cfg))
+	g := sessionOf(t, s, c)
+	layout := func() string { return strings.Join(formatGrid(g.Grid), "/") }
+	first := layout()
+	post(s.handlePlay, "/play", url.Values{"col": {"3"}}, c)
+	g.GameOver, g.GameOverReason, g.LastPlayed = true, reasonConnect, cellR
+	g.Scores.R, g.Scores.Y, g.Series = 2, 1, "RYR"
+
+	for round, want := range []byte{cellY, cellR} {
+		post(s.handleReplay, "/replay", url.Values{"next": {"1"}}, c)
+		g = sessionOf(t, s, c)
+		if g.Scores.R != 2 || g.Scores.Y != 1 || g.Series != "RYR" || g.Player1 != "Ana" || g.Player2 != "Ben" {
+			t.Errorf("round %d: scores %+v, series %q, players %s/%s", round, g.Scores, g.Series, g.Player1, g.Player2)
+		}
+		if g.Current != want || g.starter() != want || g.Turns != 0 || g.GameOver {
+			t.Errorf("round %d: %c to move first (turn %d, over %v), want %c", round, g.Current, g.Turns, g.GameOver, want)
+		}
+		if layout() == first {
+			t.Errorf("round %d: the blocks did not move", round)
+		}
+		first = layout()
+		post(s.handlePlay, "/play", url.Values{"col": {"3"}}, c)
+		g.GameOver = true
+	}
+}
+
+func TestCustomLobbyCodeAlphabet(t *testing.T) {
+	s := newTestServer()
+	rec := get(s.handleOnlineCreate, "/online/create?code=%20ab7k%20", newSession(s, nil))
+	if code := redirectQuery(t, rec).Get("code"); code != "AB7K" {
+		t.Errorf("lowercase code led to %q, want AB7K", code)
+	}
+	if _, ok := s.store.Lobby("AB7K"); !ok {
+		t.Error("no lobby under the upper-cased code")
+	}
+
+	for _, c := range []string{"ABOK", "abok", "AB0K", "ABIK", "AB1K", "AB7", "AB7KM", "AB-K"} {
+		rec := get(s.handleOnlineCreate, "/online/create?code="+url.QueryEscape(c), newSession(s, nil))
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "ni I, ni O") {
+			t.Errorf("code %q: status %d, %q", c, rec.Code, strings.TrimSpace(rec.Body.String()))
+		}
+	}
+	if _, lobbies := s.store.Len(); lobbies != 1 {
+		t.Errorf("%d lobbies, want only AB7K", lobbies)
+	}
+	if strings.ContainsAny(lobbyCodeLetters, "IO01") {
+		t.Errorf("alphabet %q has look-alikes", lobbyCodeLetters)
+	}
+}
+
+func TestOpponentThinkingTimesFromTheLastMove(t *testing.T) {
+	s := newTestServer()
+	s.thinkingAfter = 10 * time.Second
+	code, red, _ := seatedLobby(s, classic())
+	lb, _ := s.store.Lobby(code)
+	thinking := func(side string) bool {
+		t.Helper()
+		var st lobbyState
+		rec := get(s.handleOnlineState, "/online/state?code="+code+"&side="+side)
+		if err := json.Unmarshal(rec.Body.Bytes(), &st); err != nil {
+			t.Fatalf("status %d: %v", rec.Code, err)
+		}
+		return st.OpponentThinking
+	}
+
+	// before the first move the clock starts with the game
+	lb.Game.CreatedAt = time.Now().Add(-5 * time.Second)
+	if thinking("Y") {
+		t.Error("5s after creation: already thinking")
+	}
+	lb.Game.CreatedAt = time.Now().Add(-30 * time.Second)
+	if !thinking("Y") || thinking("R") || thinking("") {
+		t.Error("30s after creation: Yellow should see Red thinking, and only Yellow")
+	}
+
+	post(s.handleOnlinePlay, "/online/play", url.Values{"code": {code}, "side": {"R"}, "col": {"3"}, "token": {lb.MoveToken}}, red)
+	if thinking("R") {
+		t.Error("right after Red's move: Yellow already thinking")
+	}
+	// a chat line touches the lobby, not the clock
+	lb.Game.Moves[0].At = time.Now().Add(-30 * time.Second)
+	lb.UpdatedAt = time.Now()
+	if !thinking("R") {
+		t.Error("30s after the move, fresh lobby: Yellow not thinking")
+	}
+	// and an old lobby does not make a fresh move look slow
+	lb.Game.Moves[0].At, lb.UpdatedAt = time.Now(), time.Now().Add(-time.Minute)
+	if thinking("R") {
+		t.Error("fresh move, stale lobby: Yellow thinking")
+	}
+
+	lb.Game.Moves[0].At = time.Now().Add(-30 * time.Second)
+	lb.PausedBy = "R"
+	if thinking("R") {
+		t.Error("paused game: Yellow thinking")
+	}
+	lb.PausedBy, lb.Game.GameOver = "", true
+	if thinking("R") {
+		t.Error("finished game: Yellow thinking")
+	}
+}
+
+func TestEndlessTies(t *testing.T) {
+	cases := []struct {
+		name         string
+		players      int
+		points, seqs tally
+		reason       overReason
+		winner       byte
+		msg          string
+	}{
+		{"two players level", 2, tally{R: 2, Y: 2}, tally{R: 3, Y: 4}, reasonDraw, 0, "Égalité aux points (2 chacun)"},
+		{"nobody scored", 3, tally{}, tally{}, reasonDraw, 0, "Égalité aux points (0 chacun)"},
+		{"three, latest line wins", 3, tally{R: 2, Y: 2, G: 1}, tally{R: 4, Y: 3, G: 5}, reasonConnect, cellR, "à égalité avec 1 autre(s) joueur(s)"},
+		{"four, three level", 4, tally{R: 1, Y: 3, G: 3, B: 3}, tally{R: 1, Y: 7, G: 10, B: 9}, reasonConnect, cellG, "à égalité avec 2 autre(s) joueur(s)"},
+		{"four, a clear leader", 4, tally{R: 1, Y: 2, G: 1, B: 4}, tally{R: 2, Y: 5, G: 1, B: 8}, reasonConnect, cellB, "l’emporte aux points (4) !"},
+	}
+	for _, tc := range cases {
+		g := NewGameFromConfig(GameConfig{Rows: 6, Cols: 7, WinLen: 4, Players: tc.players, Endless: true, Mode: "local"})
+		g.Points, g.PointSeq = tc.points, tc.seqs
+		if endlessOver(g) {
+			t.Fatalf("%s: over before the turn cap", tc.name)
+		}
+		g.Turns = g.MaxTurns
+		if !endlessOver(g) || !g.GameOver || g.GameOverReason != tc.reason {
+			t.Errorf("%s: over %v, reason %q, want %q", tc.name, g.GameOver, g.GameOverReason, tc.reason)
+			continue
+		}
+		if !strings.Contains(g.Message, tc.msg) {
+			t.Errorf("%s: message %q lacks %q", tc.name, g.Message, tc.msg)
+		}
+		if tc.winner == 0 {
+			if g.Scores != (tally{}) {
+				t.Errorf("%s: a draw scored %+v", tc.name, g.Scores)
+			}
+			continue
+		}
+		if g.LastPlayed != tc.winner || g.Scores.of(tc.winner) != 1 || g.Series != string(tc.winner) {
+			t.Errorf("%s: winner %c, scores %+v, series %q; want %c", tc.name, g.LastPlayed, g.Scores, g.Series, tc.winner)
+		}
+	}
+}
+
+func TestUnjoinedLobbyIsSweptFirst(t *testing.T) {
+	s := newTestServer()
+	s.unjoinedTTL = 15 * time.Minute
+	invite := "AB7K"
+	s.store.PutLobby(invite, newLobby(classic(), newSession(s, nil).Value))
+	seated, _, _ := seatedLobby(s, classic())
+	left, _, _ := seatedLobby(s, classic())
+	lb, _ := s.store.Lobby(left)
+	lb.HasYellow, lb.YellowSID = false, "" // the guest came and went
+
+	exists := func(code string) bool { _, ok := s.store.Lobby(code); return ok }
+	now := time.Now()
+	s.sweepLobbies(now.Add(10 * time.Minute))
+	if !exists(invite) {
+		t.Error("invite swept before unjoinedTTL")
+	}
+	s.sweepLobbies(now.Add(20 * time.Minute))
+	if exists(invite) || !exists(seated) || !exists(left) {
+		t.Errorf("after 20m: invite %v, seated %v, left %v; want only the invite gone", exists(invite), exists(seated), exists(left))
+	}
+	s.sweepLobbies(now.Add(lobbyIdleTTL + time.Minute))
+	if exists(seated) || exists(left) {
+		t.Error("joined lobbies outlived lobbyIdleTTL")
+	}
+
+	// 0 = no separate timeout: an invite lasts as long as the others
+	s.unjoinedTTL = 0
+	s.store.PutLobby(invite, newLobby(classic(), newSession(s, nil).Value))
+	s.sweepLobbies(now.Add(20 * time.Minute))
+	if !exists(invite) {
+		t.Error("POWER4_UNJOINED_TTL=0: invite swept after 20m")
+	}
+}